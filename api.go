@@ -1,21 +1,21 @@
 package main
 
 import (
-	"bytes"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"mime/multipart"
+	"mime"
 	"mime/quotedprintable"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/DusanKasan/parsemail"
 	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
 )
 
 // Commonly used strings.
@@ -45,7 +45,8 @@ type APIConfigResp struct {
 // Response with message log entries.
 type APIMessageLogResp struct {
 	APIGeneralResp
-	Messages []MessageLog `json:"messages"`
+	Messages   []MessageLog `json:"messages"`
+	NextCursor string       `json:"next_cursor"` // Provide as the cursor parameter to get the next page.
 }
 
 // Response with message entry.
@@ -54,6 +55,21 @@ type APIMessageEntryResp struct {
 	Messages MessageLog `json:"message"`
 }
 
+// Response with a timeline of delivery events for a message.
+type APIMessageTimelineResp struct {
+	APIGeneralResp
+	DeliveryStatus string                `json:"delivery_status"`
+	TotalDelay     float64               `json:"total_delay"` // Seconds from the first to the last event.
+	Events         []SysLogTimelineEvent `json:"events"`
+}
+
+// Response with unmatched syslog messages.
+type APISysLogUnmatchedResp struct {
+	APIGeneralResp
+	Entries []SysLogUnmatched `json:"entries"`
+	Drops   map[string]uint64 `json:"drops"` // Number of syslog messages not associated with a message since start, per reason.
+}
+
 // Response to spam report requests.
 type APISpamReportResp struct {
 	APIGeneralResp
@@ -62,6 +78,11 @@ type APISpamReportResp struct {
 
 // Typical API responses are done with JSON. To make it easier to respond, this function will marshal/send json to a response writer.
 func (s *HTTPServer) JSONResponse(w http.ResponseWriter, resp interface{}) {
+	s.JSONResponseCode(w, http.StatusOK, resp)
+}
+
+// Send a JSON response with a HTTP status code other than OK.
+func (s *HTTPServer) JSONResponseCode(w http.ResponseWriter, code int, resp interface{}) {
 	// Encode response as json.
 	js, err := json.Marshal(resp)
 	if err != nil {
@@ -72,6 +93,7 @@ func (s *HTTPServer) JSONResponse(w http.ResponseWriter, resp interface{}) {
 
 	// If no error, we can set content type header and send response.
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
 	w.Write(js)
 }
 
@@ -83,9 +105,149 @@ func (s *HTTPServer) APISendGeneralResp(w http.ResponseWriter, status, error str
 	s.JSONResponse(w, resp)
 }
 
+// Set the header to download a response as a file. The file name is quoted as needed,
+// as it may include addresses or other values from a request.
+func APIAttachmentHeader(w http.ResponseWriter, fileName string) {
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fileName}))
+}
+
+// Wildcards in search terms are matched literally, escaped with this character.
+var apiLikeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+// Split a search query into LIKE patterns, one for each word.
+// Words without a letter or digit, such as only wildcards, would match every message so they are left out.
+func APISearchTerms(query string) (patterns []string) {
+	for _, word := range strings.Fields(query) {
+		if strings.IndexFunc(word, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) == -1 {
+			continue
+		}
+		patterns = append(patterns, "%"+apiLikeEscaper.Replace(word)+"%")
+	}
+	return
+}
+
+// Filter a message log query by a search query. A query without any words to search for matches no messages.
+func APIMessageLogSearch(db *gorm.DB, query string) *gorm.DB {
+	// As a query was provided, we need to parse the query out to a SQL where statement.
+	// Splitting the query up by words to allow matches against 2 differen fields in the same query.
+	// Example: test@example.com sent
+	// The above will match both an email address and the status of sent.
+	patterns := APISearchTerms(query)
+	if len(patterns) == 0 {
+		return db.Where("1 = 0")
+	}
+	var queries []string
+	var statements []interface{} // Must be an interface to expand to arguments in a function call.
+	// For each word, setup LIKE statements.
+	for _, likeStatement := range patterns {
+		// Append like queries to slice.
+		queries = append(queries, "(`from` LIKE ? ESCAPE '!' OR `to` LIKE ? ESCAPE '!' OR `subject` LIKE ? ESCAPE '!' OR `source_ip` LIKE ? ESCAPE '!' OR `message_id` LIKE ? ESCAPE '!' OR `status` LIKE ? ESCAPE '!')")
+		// Append statements to slice.
+		statements = append(statements, likeStatement, likeStatement, likeStatement, likeStatement, likeStatement, likeStatement)
+	}
+
+	// Join queries with an AND, and also turn statements into arguments for the database WHERE statement.
+	return db.Where(strings.Join(queries, " AND "), statements...)
+}
+
+// Encode a pagination cursor from the sort keys of the last entry of a page.
+func APIEncodeCursor(keys ...string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strings.Join(keys, "|")))
+}
+
+// Decode a pagination cursor into the expected number of sort keys.
+func APIDecodeCursor(cursor string, count int) ([]string, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid cursor.")
+	}
+	keys := strings.SplitN(string(decoded), "|", count)
+	if len(keys) != count {
+		return nil, fmt.Errorf("Invalid cursor.")
+	}
+	return keys, nil
+}
+
+// Pull a page of message log entries, newest first.
+// Pages are found by the position of the last entry of the previous page rather than an offset,
+//  so that deep pages do not need to scan all entries before them.
+func APIMessageLogPage(db *gorm.DB, cursor string, limit int) (entries []MessageLog, nextCursor string, err error) {
+	if cursor != "" {
+		keys, err := APIDecodeCursor(cursor, 2)
+		if err != nil {
+			return nil, "", err
+		}
+		received, err := time.Parse(time.RFC3339Nano, keys[0])
+		if err != nil {
+			return nil, "", fmt.Errorf("Invalid cursor.")
+		}
+		// Times are stored in local time, and must be compared the same way.
+		received = received.In(time.Local)
+		db = db.Where("received < ? OR (received = ? AND uuid < ?)", received, received, keys[1])
+	}
+
+	// Pull one extra entry to find if there is another page.
+	db.Order("received desc, uuid desc").Limit(limit + 1).Find(&entries)
+	if len(entries) > limit {
+		entries = entries[:limit]
+		last := entries[limit-1]
+		nextCursor = APIEncodeCursor(last.Received.Format(time.RFC3339Nano), last.UUID)
+	}
+	return
+}
+
+// Filter a query ordered by ID, newest first, to entries after the cursor.
+func APIIDCursorFilter(db *gorm.DB, cursor string) (*gorm.DB, error) {
+	if cursor == "" {
+		return db, nil
+	}
+	keys, err := APIDecodeCursor(cursor, 1)
+	if err != nil {
+		return nil, err
+	}
+	id, err := strconv.ParseInt(keys[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid cursor.")
+	}
+	return db.Where("id < ?", id), nil
+}
+
+// Decode the plain text or HTML body of a message, based on the transfer encoding.
+func APIMessageBody(reader io.Reader, html bool) (io.Reader, error) {
+	// Parse the email fields.
+	email, err := parsemail.Parse(reader)
+	if err != nil {
+		return nil, err
+	}
+	body := email.TextBody
+	if html {
+		body = email.HTMLBody
+	}
+
+	// Create a reader with the body of the email.
+	bodyR := strings.NewReader(body)
+	// If email transfer encoding is quoted-printable or base64, we need to decode the message.
+	encoding := email.Header.Get("Content-Transfer-Encoding")
+	if encoding == "quoted-printable" {
+		return quotedprintable.NewReader(bodyR), nil
+	} else if encoding == "base64" {
+		return base64.NewDecoder(base64.StdEncoding, bodyR), nil
+	}
+	// This is a standard email body, which needs no decoding.
+	return bodyR, nil
+}
+
 // Setup HTTP router with routes for the API calls.
 func (s *HTTPServer) RegisterAPIRoutes(r *mux.Router) {
+	// The v2 API is registered first, so the v1 not found handler does not catch its requests.
+	s.RegisterAPIV2Routes(r)
+	s.RegisterOpenAPIRoutes(r)
+
 	api := r.PathPrefix("/api").Subrouter()
+	// Deletion and export are registered first, as the message routes accept any method.
+	s.RegisterDeleteRoutes(api)
+	s.RegisterExportRoutes(api)
+
 	// Just a test call.
 	api.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
 		s.APISendGeneralResp(w, APIOK, "")
@@ -94,10 +256,10 @@ func (s *HTTPServer) RegisterAPIRoutes(r *mux.Router) {
 	// Retrieve the configuration.
 	api.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
 		resp := APIConfigResp{}
-		resp.CustomBrand = app.config.UICustomBrand
-		resp.DisableSpamReporting = app.config.UIDisableSpamReporting
-		resp.DisableLogs = app.config.UIDisableLogs
-		resp.MessageCount = app.messageCount
+		resp.CustomBrand = app.Config().UICustomBrand
+		resp.DisableSpamReporting = app.Config().UIDisableSpamReporting
+		resp.DisableLogs = app.Config().UIDisableLogs
+		resp.MessageCount = AuthMessageCount(AuthRequestUser(r))
 		s.JSONResponse(w, resp)
 	})
 
@@ -111,39 +273,36 @@ func (s *HTTPServer) RegisterAPIRoutes(r *mux.Router) {
 		if page <= 0 { // If page is lower than 1, we need it to be page 1.
 			page = 1
 		}
-		// Offset based on page number and max messages per page set.
-		offset := app.config.MessagesPerPage * (page - 1)
-		if offset <= 0 { // If lower than 1, we can just set to -1 to unset the offset field in queries.
-			offset = -1
-		}
 
 		var entries []MessageLog
-		// If a query is not provided, we can just pull entires from the database without additional filters.
-		if query == "" {
-			app.db.Order("received desc").Offset(offset).Limit(app.config.MessagesPerPage).Find(&entries)
-		} else {
-			// As a query was provided, we need to parse the query out to a SQL where statement.
-			// Splitting the query up by words to allow matches against 2 differen fields in the same query.
-			// Example: test@example.com sent
-			// The above will match both an email address and the status of sent.
-			queryS := strings.Split(query, " ")
-			var queries []string
-			var statements []interface{} // Must be an interface to expand to arguments in a function call.
-			// For each word, setup LIKE statements.
-			for _, q := range queryS {
-				likeStatement := "%" + q + "%"
-				// Append like queries to slice.
-				queries = append(queries, "(`from` LIKE ? OR `to` LIKE ? OR `subject` LIKE ? OR `source_ip` LIKE ? OR `message_id` LIKE ? OR `status` LIKE ?)")
-				// Append statements to slice.
-				statements = append(statements, likeStatement, likeStatement, likeStatement, likeStatement, likeStatement, likeStatement)
+		// Users limited to addresses or domains may only see messages matching their scopes.
+		db := AuthScopeFilter(app.db, AuthRequestUser(r))
+		// If a query is provided, we filter by it. Search queries are recorded in the audit log.
+		if query != "" {
+			if AuditRecordSearch(r, query) != nil {
+				s.APISendGeneralResp(w, APIERR, AuditNotRecorded)
+				return
 			}
+			db = APIMessageLogSearch(db, query)
+		}
 
-			// Join queries with an AND, and also turn statements into arguments for the database WHERE statement.
-			app.db.Where(strings.Join(queries, " AND "), statements...).Order("received desc").Offset(offset).Limit(app.config.MessagesPerPage).Find(&entries)
+		resp := APIMessageLogResp{}
+		// Page numbers are still supported, but the cursor from the previous page is faster on large archives.
+		cursor := r.Form.Get("cursor")
+		if cursor == "" && page > 1 {
+			// Offset based on page number and max messages per page set.
+			offset := app.Config().MessagesPerPage * (page - 1)
+			db.Order("received desc").Offset(offset).Limit(app.Config().MessagesPerPage).Find(&entries)
+		} else {
+			var err error
+			entries, resp.NextCursor, err = APIMessageLogPage(db, cursor, app.Config().MessagesPerPage)
+			if err != nil {
+				s.APISendGeneralResp(w, APIERR, err.Error())
+				return
+			}
 		}
 
 		// Return found entries, if any.
-		resp := APIMessageLogResp{}
 		resp.Status = APIOK
 		resp.Messages = entries
 		s.JSONResponse(w, resp)
@@ -160,34 +319,21 @@ func (s *HTTPServer) RegisterAPIRoutes(r *mux.Router) {
 			return
 		}
 
-		// Search the database for a message log entry for the message id to ensure that it exists.
-		var messageEntry MessageLog
-		app.db.Where("uuid = ?", UUID).First(&messageEntry)
+		// Search the database for a message log entry for the message id to ensure that it exists and is visible to the user.
+		messageEntry := AuthFindMessage(r, UUID)
 		// If return UUID is blank, we didn't find an entry.
 		if messageEntry.UUID == "" {
+			AuditRecord(r, AuditActionRead, UUID, "log", AuditOutcomeNotFound)
 			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 			return
 		}
-
-		// Search for SysLog ID information that matches the message ID.
-		var matches []SysLogIDInfo
-		app.db.Where("message_id = ?", messageEntry.MessageID).Find(&matches)
-		// If no matches, no logs.
-		if len(matches) == 0 {
-			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		if AuditRecord(r, AuditActionRead, UUID, "log", AuditOutcomeSuccess) != nil {
+			http.Error(w, AuditNotRecorded, http.StatusInternalServerError)
 			return
 		}
 
-		// Place all SIDs into a slice so that we can run a single query to get all log messages.
-		var sids []string
-		hostname := matches[0].Hostname // The hostname of the first entry should suffice here. We shouldn't see another host with that message id.
-		for _, match := range matches {
-			sids = append(sids, match.SID)
-		}
-
-		// Find log messages orderd by timestamp matching the SIDs we gathered above.
-		var messages []SysLogMessage
-		app.db.Where("s_id IN (?) AND hostname = ?", sids, hostname).Order("timestamp").Find(&messages)
+		// Find log messages from every host the message passed through.
+		messages := SysLogMessageLogs(messageEntry.MessageID)
 		// If no log entries... We just can't provide them.
 		if len(messages) == 0 {
 			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
@@ -202,13 +348,55 @@ func (s *HTTPServer) RegisterAPIRoutes(r *mux.Router) {
 		}
 	})
 
+	// Pull a timeline of delivery events for a message.
+	api.HandleFunc("/message/{id}/timeline", func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r) // Parses the variable matched in the request URI.
+		UUID := vars["id"]
+
+		// The response structure.
+		resp := APIMessageTimelineResp{}
+
+		// Search the database for a message log entry for the message id to ensure that it exists and is visible to the user.
+		messageEntry := AuthFindMessage(r, UUID)
+		// If return UUID is blank, we didn't find an entry.
+		if messageEntry.UUID == "" {
+			AuditRecord(r, AuditActionRead, UUID, "timeline", AuditOutcomeNotFound)
+			resp.Status = APIERR
+			resp.Error = APINoMessage
+			s.JSONResponse(w, resp)
+			return
+		}
+		if AuditRecord(r, AuditActionRead, UUID, "timeline", AuditOutcomeSuccess) != nil {
+			resp.Status = APIERR
+			resp.Error = AuditNotRecorded
+			s.JSONResponse(w, resp)
+			return
+		}
+
+		// Build the timeline from log messages on every host the message passed through.
+		resp.Status = APIOK
+		resp.DeliveryStatus = messageEntry.Status
+		resp.Events = SysLogMessageTimeline(messageEntry.MessageID)
+		if len(resp.Events) != 0 {
+			resp.TotalDelay = resp.Events[len(resp.Events)-1].Elapsed
+		}
+		s.JSONResponse(w, resp)
+	})
+
 	api.HandleFunc("/message/{id}.{type}", func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r) // Parses the variable matched in the request URI.
 		UUID := vars["id"]
 		messageType := vars["type"]
 
-		// If message id provided is blank, the message cannot exist.
-		if UUID == "" {
+		// Downloading the original source is recorded separately from reading in the audit log.
+		auditAction := AuditActionRead
+		if messageType == "eml" {
+			auditAction = AuditActionDownload
+		}
+
+		// If message id provided is blank or not visible to the user, the message cannot exist.
+		if UUID == "" || AuthFindMessage(r, UUID).UUID == "" {
+			AuditRecord(r, auditAction, UUID, messageType, AuditOutcomeNotFound)
 			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 			return
 		}
@@ -217,6 +405,7 @@ func (s *HTTPServer) RegisterAPIRoutes(r *mux.Router) {
 		reader, err := MailGetMessageData(UUID)
 		// If we could not get a reader, that is more than likely due to the message not existing.
 		if err != nil {
+			AuditRecord(r, auditAction, UUID, messageType, AuditOutcomeNotFound)
 			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 			return
 		}
@@ -224,6 +413,10 @@ func (s *HTTPServer) RegisterAPIRoutes(r *mux.Router) {
 		if x, ok := reader.(io.Closer); ok {
 			defer x.Close()
 		}
+		if AuditRecord(r, auditAction, UUID, messageType, AuditOutcomeSuccess) != nil {
+			http.Error(w, AuditNotRecorded, http.StatusInternalServerError)
+			return
+		}
 
 		// Based on response type requested, parse the message data accordingly.
 		if messageType == "eml" { // Original email source.
@@ -235,78 +428,25 @@ func (s *HTTPServer) RegisterAPIRoutes(r *mux.Router) {
 				s.APISendGeneralResp(w, APIERR, APIReadMessage)
 				return
 			}
-		} else if messageType == "txt" { // Plain text format.
-			// Provide plain text mime type.
-			w.Header().Set("Content-Type", "text/plain")
-			// Parse the email fields.
-			email, err := parsemail.Parse(reader)
+		} else if messageType == "txt" || messageType == "html" { // Plain text or HTML body.
+			// Decode the body from the message.
+			body, err := APIMessageBody(reader, messageType == "html")
 			if err != nil { // If error, return to client an error.
 				s.APISendGeneralResp(w, APIERR, APIReadMessage)
 				return
 			}
-
-			// If email transfer encoding is quoted-printable, we need to decode the message.
-			encoding := email.Header.Get("Content-Transfer-Encoding")
-			if encoding == "quoted-printable" {
-				// Create a reader with the text body of the email.
-				bodyR := strings.NewReader(email.TextBody)
-				quotedR := quotedprintable.NewReader(bodyR)
-				// Copy from the reader to the response writer.
-				_, err = io.Copy(w, quotedR)
-				if err != nil { // If error, return to client an error.
-					s.APISendGeneralResp(w, APIERR, APIReadMessage)
-					return
-				}
-			} else if encoding == "base64" { // If encoded with Base64
-				// Create a reader with the text body of the email.
-				bodyR := strings.NewReader(email.TextBody)
-				base64R := base64.NewDecoder(base64.StdEncoding, bodyR)
-				// Copy from the reader to the response writer.
-				_, err = io.Copy(w, base64R)
-				if err != nil { // If error, return to client an error.
-					s.APISendGeneralResp(w, APIERR, APIReadMessage)
-					return
-				}
+			// Provide the mime type of the body.
+			if messageType == "html" {
+				w.Header().Set("Content-Type", "text/html")
 			} else {
-				// As this is a standard plain text email, we can just write it to the response writer.
-				w.Write([]byte(email.TextBody))
+				w.Header().Set("Content-Type", "text/plain")
 			}
-		} else if messageType == "html" { // HTML body requested.
-			// Set mime type to html.
-			w.Header().Set("Content-Type", "text/html")
-			// Parse the email fields.
-			email, err := parsemail.Parse(reader)
+			// Copy from the reader to the response writer.
+			_, err = io.Copy(w, body)
 			if err != nil { // If error, return to client an error.
 				s.APISendGeneralResp(w, APIERR, APIReadMessage)
 				return
 			}
-
-			// If email transfer encoding is quoted-printable, we need to decode the message.
-			encoding := email.Header.Get("Content-Transfer-Encoding")
-			if encoding == "quoted-printable" {
-				// Create a reader with the html body of the email.
-				bodyR := strings.NewReader(email.HTMLBody)
-				quotedR := quotedprintable.NewReader(bodyR)
-				// Copy from the reader to the response writer.
-				_, err = io.Copy(w, quotedR)
-				if err != nil { // If error, return to client an error.
-					s.APISendGeneralResp(w, APIERR, APIReadMessage)
-					return
-				}
-			} else if encoding == "base64" { // If encoded with Base64
-				// Create a reader with the html body of the email.
-				bodyR := strings.NewReader(email.HTMLBody)
-				base64R := base64.NewDecoder(base64.StdEncoding, bodyR)
-				// Copy from the reader to the response writer.
-				_, err = io.Copy(w, base64R)
-				if err != nil { // If error, return to client an error.
-					s.APISendGeneralResp(w, APIERR, APIReadMessage)
-					return
-				}
-			} else {
-				// Standard HTML email body, we can just write it to the response writer.
-				w.Write([]byte(email.HTMLBody))
-			}
 		} else {
 			// No matching message type was found. Just provide a no endpoint response.
 			s.APISendGeneralResp(w, APIERR, APINoEndpoint)
@@ -317,131 +457,44 @@ func (s *HTTPServer) RegisterAPIRoutes(r *mux.Router) {
 	api.HandleFunc("/message/{id}/learn_{type}", func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r) // Parses the variable matched in the request URI.
 		UUID := vars["id"]
-
-		// If message id provided is blank, the message cannot exist.
-		if UUID == "" {
-			s.APISendGeneralResp(w, APIERR, APINoMessage)
-			return
-		}
-
-		// The response type should only be spam or ham.
 		reportType := vars["type"]
-		var reportingURI string
-		if reportType == "spam" {
-			reportingURI = app.config.SpamReportingSpamURI
-		} else if reportType == "ham" {
-			reportingURI = app.config.SpamReportingHamURI
-		}
 
-		// If the reporting URI was not sent, we return a no endpoint found message.
-		if reportingURI == "" {
-			s.APISendGeneralResp(w, APIERR, APINoEndpoint)
+		// Denied reports are recorded in the audit log.
+		if !AuthHasPermission(AuthRequestUser(r), PermReportSpam) {
+			AuditRecord(r, AuditActionReport, UUID, reportType, AuditOutcomeDenied)
+			s.JSONResponseCode(w, http.StatusForbidden, APIGeneralResp{Status: APIERR, Error: AuthPermissionDenied})
 			return
 		}
 
-		// To report spam, we need the message data. So we will find it in either the database or file system accordingly.
-		reader, err := MailGetMessageData(UUID)
-		if err != nil { // If no message found, we tell the client.
+		// If message id provided is blank or not visible to the user, the message cannot exist.
+		if UUID == "" || AuthFindMessage(r, UUID).UUID == "" {
+			AuditRecord(r, AuditActionReport, UUID, reportType, AuditOutcomeNotFound)
 			s.APISendGeneralResp(w, APIERR, APINoMessage)
 			return
 		}
-		// If we need to close after reading, defer the close to after this function call.
-		if x, ok := reader.(io.Closer); ok {
-			defer x.Close()
-		}
 
 		// Build a response for the request.
 		resp := APISpamReportResp{}
-		anySuccess := false // We rely on this variable to determine if a successful request was made.
 
-		// Multipart Form Data writer/buffer for sending message via post.
-		var b bytes.Buffer
-		mw := multipart.NewWriter(&b)
-
-		// file form entry.
-		fw, err := mw.CreateFormFile(app.config.SpamReportingUploadName, UUID+".eml")
-		if err != nil {
-			s.APISendGeneralResp(w, APIERR, "Unable to build report.")
+		// Send the report to the configured spam reporting tools.
+		requests, anySuccess, err := SpamReportMessage(UUID, reportType)
+		if err == ErrSpamReportNoEndpoint {
+			s.APISendGeneralResp(w, APIERR, APINoEndpoint)
 			return
-		}
-		// Copy message data to multipart form entry.
-		if _, err = io.Copy(fw, reader); err != nil {
-			s.APISendGeneralResp(w, APIERR, "Unable to build report.")
+		} else if err != nil {
+			s.APISendGeneralResp(w, APIERR, err.Error())
 			return
 		}
+		resp.Requests = requests
 
-		// If an authentication field is set, add it to the form data.
-		if app.config.SpamReportingAuthKey != "" {
-			mw.WriteField(app.config.SpamReportingAuthKey, app.config.SpamReportingAuthValue)
-		}
-
-		// We are done adding to the multipart form.
-		mw.Close()
-
-		// Go through the configured spam reporting URLs and submit.
-		for _, baseURL := range app.config.SpamReportingAPIBaseURLS {
-			url := baseURL + reportingURI
-
-			// Request string map to provide feedback via API on what happend per reporting URL.
-			request := make(map[string]string)
-			request["url"] = url
-
-			// Make request for the report using the form data.
-			req, err := http.NewRequest("POST", url, &b)
-			if err != nil { // If failed, just mark this request as failed and continue.
-				request["success"] = "false"
-				request["error"] = fmt.Sprintf("%v", err)
-				resp.Requests = append(resp.Requests, request)
-				continue
-			}
-
-			// Set the content type header to the multipart formdata header with proper boundary.
-			req.Header.Set("Content-Type", mw.FormDataContentType())
-
-			// If an authentication header is set in config, we need to send it.
-			authHeaderS := strings.Split(app.config.SpamReportingAuthHeader, ": ")
-			if len(authHeaderS) == 2 {
-				req.Header.Set(authHeaderS[0], authHeaderS[1])
-			}
-
-			// Setup http client.
-			client := &http.Client{
-				Timeout: time.Second * 10,
-			}
-			// Send report.
-			res, err := client.Do(req)
-			if err != nil { // If error, just store that this errored and continue.
-				request["success"] = "false"
-				request["error"] = fmt.Sprintf("%v", err)
-				resp.Requests = append(resp.Requests, request)
-				continue
-			}
-
-			// If the status code is not ok, something went wrong... Store that this failed and continue.
-			if res.StatusCode != http.StatusOK {
-				request["success"] = "false"
-				request["error"] = fmt.Sprintf("%v", res.StatusCode)
-				resp.Requests = append(resp.Requests, request)
-				continue
-			}
-			// If we made this this far, sending the report was a success.
-			request["success"] = "true"
-
-			// read the respons ebody.
-			defer res.Body.Close()
-			body, _ := ioutil.ReadAll(res.Body)
-			request["response"] = string(body)
-			// Add the request to the list of requests in the response.
-			resp.Requests = append(resp.Requests, request)
-			// A request was successful.
-			anySuccess = true
-		}
 		// If no successful request, we return an erro.
 		if !anySuccess {
 			resp.Status = APIERR
 			resp.Error = "No successful request was made."
+			AuditRecord(r, AuditActionReport, UUID, reportType, AuditOutcomeError)
 		} else { // If a request was successful, return an ok.
 			resp.Status = APIOK
+			AuditRecord(r, AuditActionReport, UUID, reportType, AuditOutcomeSuccess)
 		}
 		// Send response.
 		s.JSONResponse(w, resp)
@@ -463,22 +516,61 @@ func (s *HTTPServer) RegisterAPIRoutes(r *mux.Router) {
 			return
 		}
 
-		// Search the database for a message log entry for the message id to ensure that it exists.
-		var messageEntry MessageLog
-		app.db.Where("uuid = ?", UUID).First(&messageEntry)
+		// Search the database for a message log entry for the message id to ensure that it exists and is visible to the user.
+		messageEntry := AuthFindMessage(r, UUID)
 		// If return UUID is blank, we didn't find an entry.
 		if messageEntry.UUID == "" {
+			AuditRecord(r, AuditActionRead, UUID, "metadata", AuditOutcomeNotFound)
 			resp.Status = APIERR
 			resp.Error = APINoMessage
 			s.JSONResponse(w, resp)
 			return
 		}
+		if AuditRecord(r, AuditActionRead, UUID, "metadata", AuditOutcomeSuccess) != nil {
+			resp.Status = APIERR
+			resp.Error = AuditNotRecorded
+			s.JSONResponse(w, resp)
+			return
+		}
 
 		resp.Status = APIOK
 		resp.Messages = messageEntry
 		s.JSONResponse(w, resp)
 	})
 
+	// Retrieve syslog messages which could not be associated with a message, along with drop counters.
+	api.HandleFunc("/syslog/unmatched", s.AuthRequire(PermViewDiagnostics, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm() // r.Form isn't filled unless we first parse.
+
+		// Page variable provided should be an integer.
+		page, _ := strconv.Atoi(r.Form.Get("p"))
+		if page <= 0 { // If page is lower than 1, we need it to be page 1.
+			page = 1
+		}
+
+		resp := APISysLogUnmatchedResp{}
+		resp.Status = APIOK
+		resp.Entries = SysLogFindUnmatched(r.Form.Get("q"), r.Form.Get("reason"), page)
+		resp.Drops = SysLogDropCounts()
+		s.JSONResponse(w, resp)
+	}))
+
+	// Login, API token and user management.
+	s.RegisterAuthRoutes(api)
+	s.RegisterOIDCRoutes(api)
+
+	// Audit log query and export.
+	s.RegisterAuditRoutes(api)
+
+	// Export and erasure of everything involving an address.
+	s.RegisterDataSubjectRoutes(api)
+
+	// Reloading the configuration.
+	s.RegisterConfigRoutes(api)
+
+	// Statistics of messages received.
+	s.RegisterStatsRoutes(api)
+
 	// If nothing else, we return a not found response.
 	api.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		s.APISendGeneralResp(w, APIERR, APINoEndpoint)
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Response with audit log entries.
+type APIAuditResp struct {
+	APIGeneralResp
+	Total   int        `json:"total"`
+	Entries []AuditLog `json:"entries"`
+}
+
+// Response with the result of verifying the audit log.
+type APIAuditVerifyResp struct {
+	APIGeneralResp
+	Valid    bool  `json:"valid"`
+	Checked  int   `json:"checked"`   // Number of entries checked.
+	BrokenID int64 `json:"broken_id"` // The first entry which does not match its hash, if not valid.
+}
+
+// Parse a time provided to the API, either as RFC3339 or a date.
+func APIParseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return t, fmt.Errorf("Invalid time %s, use RFC3339 or YYYY-MM-DD format.", value)
+	}
+	return t, nil
+}
+
+// Read audit log filters from a request.
+func APIAuditFilter(r *http.Request) (filter AuditFilter, err error) {
+	r.ParseForm() // r.Form isn't filled unless we first parse.
+	filter.Username = r.Form.Get("user")
+	filter.Action = r.Form.Get("action")
+	filter.MessageUUID = r.Form.Get("uuid")
+	filter.Outcome = r.Form.Get("outcome")
+	if filter.Since, err = APIParseTime(r.Form.Get("since")); err != nil {
+		return
+	}
+	filter.Until, err = APIParseTime(r.Form.Get("until"))
+	return
+}
+
+// Setup HTTP router with routes for the audit log.
+func (s *HTTPServer) RegisterAuditRoutes(api *mux.Router) {
+	// Query the audit log, newest first.
+	api.HandleFunc("/audit", s.AuthRequire(PermViewAudit, func(w http.ResponseWriter, r *http.Request) {
+		filter, err := APIAuditFilter(r)
+		if err != nil {
+			s.APISendGeneralResp(w, APIERR, err.Error())
+			return
+		}
+
+		// Page variable provided should be an integer.
+		page, _ := strconv.Atoi(r.Form.Get("p"))
+		if page <= 0 { // If page is lower than 1, we need it to be page 1.
+			page = 1
+		}
+
+		resp := APIAuditResp{}
+		resp.Status = APIOK
+		AuditFilterQuery(filter).Count(&resp.Total)
+		AuditFilterQuery(filter).Order("id desc").Offset(app.Config().MessagesPerPage * (page - 1)).Limit(app.Config().MessagesPerPage).Find(&resp.Entries)
+		s.JSONResponse(w, resp)
+	})).Methods("GET")
+
+	// Export the audit log matching the filters, oldest first, as CSV or JSON.
+	api.HandleFunc("/audit/export", s.AuthRequire(PermViewAudit, func(w http.ResponseWriter, r *http.Request) {
+		filter, err := APIAuditFilter(r)
+		if err != nil {
+			s.APISendGeneralResp(w, APIERR, err.Error())
+			return
+		}
+		format := r.Form.Get("format")
+		if format == "" {
+			format = "csv"
+		}
+		if format != "csv" && format != "json" {
+			s.APISendGeneralResp(w, APIERR, "Format must be csv or json.")
+			return
+		}
+
+		rows, err := AuditFilterQuery(filter).Order("id").Rows()
+		if err != nil {
+			s.APISendGeneralResp(w, APIERR, err.Error())
+			return
+		}
+		defer rows.Close()
+
+		// Entries are streamed, as the audit log may be large.
+		fileName := "audit-" + time.Now().Format("20060102-150405") + "." + format
+		APIAttachmentHeader(w, fileName)
+		if format == "csv" {
+			w.Header().Set("Content-Type", "text/csv")
+			cw := csv.NewWriter(w)
+			cw.Write([]string{"id", "time", "user_id", "username", "action", "message_uuid", "query", "source_ip", "outcome", "detail", "hash"})
+			for rows.Next() {
+				var entry AuditLog
+				app.db.ScanRows(rows, &entry)
+				cw.Write([]string{
+					strconv.FormatInt(entry.ID, 10),
+					entry.Time.UTC().Format(time.RFC3339),
+					strconv.FormatInt(entry.UserID, 10),
+					entry.Username,
+					entry.Action,
+					entry.MessageUUID,
+					entry.Query,
+					entry.SourceIP,
+					entry.Outcome,
+					entry.Detail,
+					entry.Hash,
+				})
+			}
+			cw.Flush()
+			return
+		}
+
+		// JSON is exported one entry per line.
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		for rows.Next() {
+			var entry AuditLog
+			app.db.ScanRows(rows, &entry)
+			enc.Encode(entry)
+		}
+	})).Methods("GET")
+
+	// Verify that the audit log has not been modified.
+	api.HandleFunc("/audit/verify", s.AuthRequire(PermViewAudit, func(w http.ResponseWriter, r *http.Request) {
+		resp := APIAuditVerifyResp{}
+		resp.Status = APIOK
+		resp.BrokenID, resp.Checked = AuditVerify()
+		resp.Valid = resp.BrokenID == 0
+		s.JSONResponse(w, resp)
+	})).Methods("GET")
+}
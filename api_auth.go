@@ -0,0 +1,309 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Response with the logged in user.
+type APIAuthResp struct {
+	APIGeneralResp
+	AuthEnabled bool     `json:"auth_enabled"`
+	OIDCEnabled bool     `json:"oidc_enabled"` // If login with SSO is available.
+	User        *User    `json:"user"`
+	Permissions []string `json:"permissions"` // Permissions of the logged in user's role.
+	CSRFToken   string   `json:"csrf_token"`  // Must be sent in the X-CSRF-Token header to change state.
+}
+
+// Response with a newly created API token. The token is only provided once.
+type APIAuthTokenResp struct {
+	APIGeneralResp
+	Token    string   `json:"token"`
+	APIToken APIToken `json:"api_token"`
+}
+
+// Response with API tokens.
+type APIAuthTokensResp struct {
+	APIGeneralResp
+	APITokens []APIToken `json:"api_tokens"`
+}
+
+// Response with a user.
+type APIUserResp struct {
+	APIGeneralResp
+	User User `json:"user"`
+}
+
+// Response with users.
+type APIUsersResp struct {
+	APIGeneralResp
+	Users []User `json:"users"`
+}
+
+// Read a list from a form field, which may be repeated or comma separated.
+func APIFormList(r *http.Request, name string) (values []string) {
+	for _, value := range r.Form[name] {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				values = append(values, item)
+			}
+		}
+	}
+	return
+}
+
+// Setup HTTP router with routes for login, API tokens and user management.
+func (s *HTTPServer) RegisterAuthRoutes(api *mux.Router) {
+	// Login with a username and password to start a session.
+	api.HandleFunc("/auth/login", func(w http.ResponseWriter, r *http.Request) {
+		if !app.Config().AuthEnabled {
+			s.APISendGeneralResp(w, APIERR, AuthNotEnabled)
+			return
+		}
+		r.ParseForm() // r.Form isn't filled unless we first parse.
+
+		// Check the login.
+		user, ok := AuthCheckPassword(r.Form.Get("username"), r.Form.Get("password"))
+		if !ok {
+			s.APISendGeneralResp(w, APIERR, AuthInvalidLogin)
+			return
+		}
+
+		// Start a session for the user.
+		session, err := AuthStartSession(w, user)
+		if err != nil {
+			s.APISendGeneralResp(w, APIERR, "Unable to start session.")
+			return
+		}
+
+		AuthLoadScopes(&user)
+		resp := APIAuthResp{}
+		resp.Status = APIOK
+		resp.AuthEnabled = true
+		resp.OIDCEnabled = OIDCEnabled()
+		resp.User = &user
+		resp.Permissions = AuthRolePermissions[user.Role]
+		resp.CSRFToken = session.CSRFToken
+		s.JSONResponse(w, resp)
+	}).Methods("POST")
+
+	// End the current session.
+	api.HandleFunc("/auth/logout", func(w http.ResponseWriter, r *http.Request) {
+		AuthEndSession(w, r)
+		s.APISendGeneralResp(w, APIOK, "")
+	}).Methods("POST")
+
+	// Retrieve the logged in user, and the CSRF token for the web interface.
+	api.HandleFunc("/auth/me", func(w http.ResponseWriter, r *http.Request) {
+		resp := APIAuthResp{}
+		resp.Status = APIOK
+		resp.AuthEnabled = app.Config().AuthEnabled
+		resp.OIDCEnabled = OIDCEnabled()
+		resp.User = AuthRequestUser(r)
+		if resp.User != nil {
+			resp.Permissions = AuthRolePermissions[resp.User.Role]
+		}
+		resp.CSRFToken = AuthRequestSession(r).CSRFToken
+		s.JSONResponse(w, resp)
+	})
+
+	// Change the password of the logged in user.
+	api.HandleFunc("/auth/password", func(w http.ResponseWriter, r *http.Request) {
+		user := AuthRequestUser(r)
+		if user == nil {
+			s.APISendGeneralResp(w, APIERR, AuthNotEnabled)
+			return
+		}
+		// Users of an external directory change their password there.
+		if user.Source != UserSourceLocal {
+			s.APISendGeneralResp(w, APIERR, "Your password is managed by "+user.Source+".")
+			return
+		}
+		r.ParseForm() // r.Form isn't filled unless we first parse.
+
+		// The current password must be confirmed.
+		if _, ok := AuthCheckPassword(user.Username, r.Form.Get("current_password")); !ok {
+			s.APISendGeneralResp(w, APIERR, AuthInvalidLogin)
+			return
+		}
+		// The session making the change stays logged in.
+		if err := AuthSetPassword(user, r.Form.Get("password"), AuthRequestSession(r).TokenHash); err != nil {
+			s.APISendGeneralResp(w, APIERR, err.Error())
+			return
+		}
+		s.APISendGeneralResp(w, APIOK, "")
+	}).Methods("PUT")
+
+	// List API tokens of the logged in user.
+	api.HandleFunc("/auth/tokens", func(w http.ResponseWriter, r *http.Request) {
+		user := AuthRequestUser(r)
+		if user == nil {
+			s.APISendGeneralResp(w, APIERR, AuthNotEnabled)
+			return
+		}
+
+		resp := APIAuthTokensResp{}
+		resp.Status = APIOK
+		app.db.Where("user_id = ?", user.ID).Order("id").Find(&resp.APITokens)
+		s.JSONResponse(w, resp)
+	}).Methods("GET")
+
+	// Create an API token for the logged in user.
+	api.HandleFunc("/auth/tokens", func(w http.ResponseWriter, r *http.Request) {
+		user := AuthRequestUser(r)
+		if user == nil {
+			s.APISendGeneralResp(w, APIERR, AuthNotEnabled)
+			return
+		}
+		r.ParseForm() // r.Form isn't filled unless we first parse.
+
+		token, err := AuthGenerateToken()
+		if err != nil {
+			s.APISendGeneralResp(w, APIERR, "Unable to generate token.")
+			return
+		}
+
+		resp := APIAuthTokenResp{}
+		resp.Status = APIOK
+		resp.Token = token
+		resp.APIToken.UserID = user.ID
+		resp.APIToken.Name = r.Form.Get("name")
+		resp.APIToken.TokenHash = AuthHashToken(token)
+		app.db.Create(&resp.APIToken)
+		s.JSONResponse(w, resp)
+	}).Methods("POST")
+
+	// Delete an API token of the logged in user.
+	api.HandleFunc("/auth/tokens/{id}", func(w http.ResponseWriter, r *http.Request) {
+		user := AuthRequestUser(r)
+		if user == nil {
+			s.APISendGeneralResp(w, APIERR, AuthNotEnabled)
+			return
+		}
+		vars := mux.Vars(r) // Parses the variable matched in the request URI.
+
+		app.db.Where("id = ? AND user_id = ?", vars["id"], user.ID).Delete(APIToken{})
+		s.APISendGeneralResp(w, APIOK, "")
+	}).Methods("DELETE")
+
+	// List users.
+	api.HandleFunc("/users", s.AuthRequire(PermManageUsers, func(w http.ResponseWriter, r *http.Request) {
+		resp := APIUsersResp{}
+		resp.Status = APIOK
+		app.db.Order("username").Find(&resp.Users)
+		for i := range resp.Users {
+			AuthLoadScopes(&resp.Users[i])
+		}
+		s.JSONResponse(w, resp)
+	})).Methods("GET")
+
+	// Create a user.
+	api.HandleFunc("/users", s.AuthRequire(PermManageUsers, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm() // r.Form isn't filled unless we first parse.
+
+		// Users have the least access unless a role is provided.
+		role := r.Form.Get("role")
+		if role == "" {
+			role = RoleReadOnly
+		}
+		scopes := APIFormList(r, "scopes")
+		for _, scope := range scopes {
+			if _, err := AuthNormalizeScope(scope); err != nil {
+				s.APISendGeneralResp(w, APIERR, err.Error())
+				return
+			}
+		}
+		user, err := AuthCreateUser(r.Form.Get("username"), r.Form.Get("password"), role)
+		if err != nil {
+			s.APISendGeneralResp(w, APIERR, err.Error())
+			return
+		}
+		AuthSetScopes(&user, scopes)
+
+		resp := APIUserResp{}
+		resp.Status = APIOK
+		resp.User = user
+		s.JSONResponse(w, resp)
+	})).Methods("POST")
+
+	// Update the role and scopes of a user.
+	// Roles of SSO and LDAP users are updated from their groups when they login.
+	api.HandleFunc("/users/{id}", s.AuthRequire(PermManageUsers, func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r) // Parses the variable matched in the request URI.
+		r.ParseForm()       // r.Form isn't filled unless we first parse.
+
+		var user User
+		id, _ := strconv.ParseInt(vars["id"], 10, 64)
+		app.db.Where("id = ?", id).First(&user)
+		if user.ID == 0 {
+			s.APISendGeneralResp(w, APIERR, "User was not found.")
+			return
+		}
+
+		if role := r.Form.Get("role"); role != "" {
+			if !AuthValidRole(role) {
+				s.APISendGeneralResp(w, APIERR, "Invalid role "+role+".")
+				return
+			}
+			user.Role = role
+		}
+		// Only replace scopes if provided, an empty value removes all scopes.
+		if _, ok := r.Form["scopes"]; ok {
+			if err := AuthSetScopes(&user, APIFormList(r, "scopes")); err != nil {
+				s.APISendGeneralResp(w, APIERR, err.Error())
+				return
+			}
+		} else {
+			AuthLoadScopes(&user)
+		}
+		app.db.Save(&user)
+
+		resp := APIUserResp{}
+		resp.Status = APIOK
+		resp.User = user
+		s.JSONResponse(w, resp)
+	})).Methods("PUT")
+
+	// Set the password of a user.
+	api.HandleFunc("/users/{id}/password", s.AuthRequire(PermManageUsers, func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r) // Parses the variable matched in the request URI.
+		r.ParseForm()       // r.Form isn't filled unless we first parse.
+
+		var user User
+		id, _ := strconv.ParseInt(vars["id"], 10, 64)
+		app.db.Where("id = ?", id).First(&user)
+		if user.ID == 0 {
+			s.APISendGeneralResp(w, APIERR, "User was not found.")
+			return
+		}
+		// Users of an external directory login there, a password here would let them login without it.
+		if user.Source != UserSourceLocal {
+			s.APISendGeneralResp(w, APIERR, "The password of "+user.Username+" is managed by "+user.Source+".")
+			return
+		}
+
+		if err := AuthSetPassword(&user, r.Form.Get("password"), ""); err != nil {
+			s.APISendGeneralResp(w, APIERR, err.Error())
+			return
+		}
+		s.APISendGeneralResp(w, APIOK, "")
+	})).Methods("PUT")
+
+	// Delete a user.
+	api.HandleFunc("/users/{id}", s.AuthRequire(PermManageUsers, func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r) // Parses the variable matched in the request URI.
+
+		var user User
+		id, _ := strconv.ParseInt(vars["id"], 10, 64)
+		app.db.Where("id = ?", id).First(&user)
+		if user.ID == 0 {
+			s.APISendGeneralResp(w, APIERR, "User was not found.")
+			return
+		}
+		AuthDeleteUser(user)
+		s.APISendGeneralResp(w, APIOK, "")
+	})).Methods("DELETE")
+}
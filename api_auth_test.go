@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAPIChangePasswordEndsOtherSessions(t *testing.T) {
+	testApp(t)
+	config := *app.Config()
+	config.AuthEnabled = true
+	app.SetConfig(config)
+	handler := (&HTTPServer{}).AuthMiddleware(testRouter())
+
+	user, err := AuthCreateUser("alice", "old password", RoleReadOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := AuthCreateUser("bob", "password", RoleReadOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Start sessions, returning the session cookie and CSRF token of each.
+	login := func(user User) (*http.Cookie, string) {
+		w := httptest.NewRecorder()
+		session, err := AuthStartSession(w, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w.Result().Cookies()[0], session.CSRFToken
+	}
+	current, csrfToken := login(user)
+	stolen, _ := login(user)
+	otherUser, _ := login(other)
+	// Create an API token, returning the bearer token.
+	createToken := func(user User) string {
+		app.db.Create(&APIToken{UserID: user.ID, Name: "script", TokenHash: AuthHashToken("token of " + user.Username)})
+		return "token of " + user.Username
+	}
+	token := createToken(user)
+	otherToken := createToken(other)
+
+	form := url.Values{"current_password": {"old password"}, "password": {"new password"}}
+	req := httptest.NewRequest("PUT", "/api/auth/password", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(AuthCSRFHeader, csrfToken)
+	req.AddCookie(current)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if !strings.Contains(w.Body.String(), `"status":"ok"`) {
+		t.Fatalf("password change failed: %s", w.Body.String())
+	}
+
+	// API tokens of the user are revoked, while those of other users are still valid.
+	for bearer, valid := range map[string]bool{token: false, otherToken: true} {
+		req := httptest.NewRequest("GET", "/api/auth/tokens", nil)
+		req.Header.Set("Authorization", "Bearer "+bearer)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if (w.Code == http.StatusOK) != valid {
+			t.Errorf("token responded with %d, expected it to be valid: %t", w.Code, valid)
+		}
+	}
+
+	// Only the session which changed the password, and sessions of other users, are still valid.
+	for cookie, valid := range map[*http.Cookie]bool{current: true, stolen: false, otherUser: true} {
+		req := httptest.NewRequest("GET", "/api/auth/tokens", nil)
+		req.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if (w.Code == http.StatusOK) != valid {
+			t.Errorf("session responded with %d, expected it to be valid: %t", w.Code, valid)
+		}
+	}
+}
+
+func TestAPISetPasswordOfExternalUser(t *testing.T) {
+	testApp(t)
+	config := *app.Config()
+	config.AuthEnabled = true
+	app.SetConfig(config)
+	r := testRouter()
+
+	user, err := AuthLoginExternalUser("https://idp.example.com 1", "alice", UserSourceOIDC, RoleReadOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	form := url.Values{"password": {"password"}}
+	req := httptest.NewRequest("PUT", "/api/users/"+strconv.FormatInt(user.ID, 10)+"/password", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, testAsUser(req, &User{Role: RoleAdmin}))
+	if !strings.Contains(w.Body.String(), `"status":"error"`) {
+		t.Errorf("setting the password of an SSO user was not rejected: %s", w.Body.String())
+	}
+
+	// A password stored for a user of an external directory is not accepted.
+	hash, _ := AuthHashPassword("password")
+	app.db.Model(&user).Update("password_hash", hash)
+	if _, ok := AuthCheckPassword("alice", "password"); ok {
+		t.Error("an SSO user logged in with a local password")
+	}
+}
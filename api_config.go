@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Response with the result of reloading the configuration.
+type APIConfigReloadResp struct {
+	APIGeneralResp
+	Reload ConfigReloadStatus `json:"reload"`
+}
+
+// Setup HTTP router with routes for reloading the configuration.
+func (s *HTTPServer) RegisterConfigRoutes(api *mux.Router) {
+	// Result of the last reload of the configuration, and settings which need a restart.
+	api.HandleFunc("/config/reload", s.AuthRequire(PermManageConfig, func(w http.ResponseWriter, r *http.Request) {
+		resp := APIConfigReloadResp{}
+		resp.Status = APIOK
+		resp.Reload = ConfigGetReloadStatus()
+		s.JSONResponse(w, resp)
+	})).Methods("GET")
+
+	// Reload the configuration file, applying settings which are safe to change while running.
+	api.HandleFunc("/config/reload", s.AuthRequire(PermManageConfig, func(w http.ResponseWriter, r *http.Request) {
+		resp := APIConfigReloadResp{}
+		resp.Status = APIOK
+		status, err := ConfigReload(ConfigReloadAPI)
+		if err != nil {
+			resp.Status = APIERR
+			resp.Error = err.Error()
+		}
+		resp.Reload = status
+		s.JSONResponse(w, resp)
+	})).Methods("POST")
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Response with the result of erasing everything involving an address.
+type APIDataSubjectEraseResp struct {
+	APIGeneralResp
+	DataSubjectErasure
+}
+
+// Send a ZIP file with everything involving the address of a request.
+func APIDataSubjectExport(w http.ResponseWriter, r *http.Request, address string) {
+	records := DataSubjectFind(address, AuthRequestUser(r))
+	fileName := "data-subject-" + address + "-" + time.Now().Format("20060102-150405") + ".zip"
+	w.Header().Set("Content-Type", "application/zip")
+	APIAttachmentHeader(w, fileName)
+	DataSubjectExport(r, w, records)
+}
+
+// Setup HTTP router with routes for data subject requests.
+func (s *HTTPServer) RegisterDataSubjectRoutes(api *mux.Router) {
+	// Download a ZIP file with every message and syslog message involving an address, along with a manifest.
+	api.HandleFunc("/data_subject/export", func(w http.ResponseWriter, r *http.Request) {
+		if !s.APICanChange(w, r, PermDataSubject, AuditActionExport, "") {
+			return
+		}
+		r.ParseForm() // r.Form isn't filled unless we first parse.
+		address, err := DataSubjectNormalize(r.Form.Get("address"))
+		if err != nil {
+			s.APISendGeneralResp(w, APIERR, err.Error())
+			return
+		}
+		APIDataSubjectExport(w, r, address)
+	}).Methods("GET")
+
+	// Erase every message and syslog message involving an address, except those under legal hold.
+	api.HandleFunc("/data_subject/erase", func(w http.ResponseWriter, r *http.Request) {
+		if !s.APICanChange(w, r, PermDataSubject, AuditActionDelete, "") || !s.APICanChange(w, r, PermDeleteMessages, AuditActionDelete, "") {
+			return
+		}
+		r.ParseForm() // r.Form isn't filled unless we first parse.
+		address, err := DataSubjectNormalize(r.Form.Get("address"))
+		if err != nil {
+			s.APISendGeneralResp(w, APIERR, err.Error())
+			return
+		}
+
+		resp := APIDataSubjectEraseResp{}
+		resp.Status = APIOK
+		resp.DataSubjectErasure = DataSubjectErase(r, DataSubjectFind(address, AuthRequestUser(r)))
+		app.httpServer.wsInterface.sendMessageCount()
+		s.JSONResponse(w, resp)
+	}).Methods("POST")
+}
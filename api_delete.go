@@ -0,0 +1,196 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Commonly used strings.
+const (
+	APIDeleteNoQuery   = "A search query with at least one word is required to delete messages."
+	APIRedactionFailed = "Unable to redact message."
+)
+
+// Response with the number of messages deleted.
+type APIMessageDeleteResp struct {
+	APIGeneralResp
+	Deleted int `json:"deleted"`
+	Held    int `json:"held"` // Number of matching messages kept as they are under legal hold.
+}
+
+// Check that the user of a request has a permission to change messages. Denied requests are recorded in the audit log.
+func (s *HTTPServer) APICanChange(w http.ResponseWriter, r *http.Request, perm, action, UUID string) bool {
+	if !AuthHasPermission(AuthRequestUser(r), perm) {
+		AuditRecord(r, action, UUID, "", AuditOutcomeDenied)
+		s.APIErrorResponse(w, r, http.StatusForbidden, AuthPermissionDenied)
+		return false
+	}
+	return true
+}
+
+// Delete a message visible to the user of a request, recording it in the audit log.
+// Returns false if the message was not found, and an error if it is under legal hold.
+func APIDeleteMessage(r *http.Request, UUID string) (bool, error) {
+	messageEntry := AuthFindMessage(r, UUID)
+	if messageEntry.UUID == "" {
+		AuditRecord(r, AuditActionDelete, UUID, "", AuditOutcomeNotFound)
+		return false, nil
+	}
+	if messageEntry.Hold {
+		AuditRecord(r, AuditActionDelete, UUID, "held", AuditOutcomeDenied)
+		return true, ErrMailHeld
+	}
+	MailDeleteMessage(messageEntry.UUID, messageEntry.MessageID)
+	AuditRecord(r, AuditActionDelete, UUID, "", AuditOutcomeSuccess)
+	app.httpServer.wsInterface.sendMessageCount()
+	return true, nil
+}
+
+// Delete all messages matching a search query which are visible to the user of a request.
+// Each message deleted is recorded in the audit log with the query. Messages under legal hold are counted, but kept.
+func APIDeleteMessageLog(r *http.Request, query string) (deleted int, held int) {
+	// We want to just pull UUID and message id of the messages to be deleted.
+	var messageIDs []struct {
+		UUID      string
+		MessageID string
+	}
+	db := APIMessageLogSearch(AuthScopeFilter(app.db, AuthRequestUser(r)), query)
+	db.Table("message_logs").Where("hold = ?", true).Count(&held)
+	db.Table("message_logs").Select("uuid,message_id").Where("hold = ?", false).Scan(&messageIDs)
+
+	for _, message := range messageIDs {
+		MailDeleteMessage(message.UUID, message.MessageID)
+		AuditRecord(r, AuditActionDelete, message.UUID, "query: "+query, AuditOutcomeSuccess)
+		deleted++
+	}
+	app.httpServer.wsInterface.sendMessageCount()
+	return
+}
+
+// Redact a message visible to the user of a request, recording it in the audit log.
+// Returns the updated message log entry, which is blank if the message was not found.
+func APIRedactMessage(r *http.Request, UUID string, reason string) (messageEntry MessageLog, err error) {
+	messageEntry = AuthFindMessage(r, UUID)
+	if messageEntry.UUID == "" {
+		AuditRecord(r, AuditActionRedact, UUID, reason, AuditOutcomeNotFound)
+		return
+	}
+
+	username := "anonymous"
+	if user := AuthRequestUser(r); user != nil {
+		username = user.Username
+	}
+	if err = MailRedactMessage(&messageEntry, username, reason); err != nil {
+		AuditRecord(r, AuditActionRedact, UUID, reason, AuditOutcomeError)
+		return
+	}
+	AuditRecord(r, AuditActionRedact, UUID, reason, AuditOutcomeSuccess)
+	return
+}
+
+// Place or release a legal hold on a message visible to the user of a request, recording it in the audit log.
+// Returns the updated message log entry, which is blank if the message was not found.
+func APIHoldMessage(r *http.Request, UUID string, hold bool) (messageEntry MessageLog) {
+	detail := "placed"
+	if !hold {
+		detail = "released"
+	}
+	messageEntry = AuthFindMessage(r, UUID)
+	if messageEntry.UUID == "" {
+		AuditRecord(r, AuditActionHold, UUID, detail, AuditOutcomeNotFound)
+		return
+	}
+	app.db.Model(&MessageLog{}).Where("uuid = ?", UUID).Update("hold", hold)
+	messageEntry.Hold = hold
+	AuditRecord(r, AuditActionHold, UUID, detail, AuditOutcomeSuccess)
+	return
+}
+
+// Setup HTTP router with routes for deleting, redacting and holding messages.
+// These must be registered before the message routes, which accept any method.
+func (s *HTTPServer) RegisterDeleteRoutes(api *mux.Router) {
+	// Delete a message, its stored body and related syslog messages.
+	api.HandleFunc("/message/{id}", func(w http.ResponseWriter, r *http.Request) {
+		UUID := mux.Vars(r)["id"]
+		if !s.APICanChange(w, r, PermDeleteMessages, AuditActionDelete, UUID) {
+			return
+		}
+		found, err := APIDeleteMessage(r, UUID)
+		if !found {
+			s.APISendGeneralResp(w, APIERR, APINoMessage)
+			return
+		}
+		if err != nil {
+			s.APISendGeneralResp(w, APIERR, err.Error())
+			return
+		}
+		s.JSONResponse(w, APIMessageDeleteResp{APIGeneralResp: APIGeneralResp{Status: APIOK}, Deleted: 1})
+	}).Methods("DELETE")
+
+	// Delete all messages matching a search query.
+	api.HandleFunc("/message_log", func(w http.ResponseWriter, r *http.Request) {
+		if !s.APICanChange(w, r, PermDeleteMessages, AuditActionDelete, "") {
+			return
+		}
+		r.ParseForm() // r.Form isn't filled unless we first parse.
+		query := r.Form.Get("q")
+		if len(APISearchTerms(query)) == 0 {
+			s.APISendGeneralResp(w, APIERR, APIDeleteNoQuery)
+			return
+		}
+		resp := APIMessageDeleteResp{}
+		resp.Status = APIOK
+		resp.Deleted, resp.Held = APIDeleteMessageLog(r, query)
+		s.JSONResponse(w, resp)
+	}).Methods("DELETE")
+
+	// Replace the body and attachments of a message with a notice, keeping its metadata.
+	api.HandleFunc("/message/{id}/redact", func(w http.ResponseWriter, r *http.Request) {
+		UUID := mux.Vars(r)["id"]
+		if !s.APICanChange(w, r, PermDeleteMessages, AuditActionRedact, UUID) {
+			return
+		}
+		r.ParseForm() // r.Form isn't filled unless we first parse.
+
+		messageEntry, err := APIRedactMessage(r, UUID, r.Form.Get("reason"))
+		if messageEntry.UUID == "" {
+			s.APISendGeneralResp(w, APIERR, APINoMessage)
+			return
+		}
+		if err == ErrMailHeld {
+			s.APISendGeneralResp(w, APIERR, err.Error())
+			return
+		} else if err != nil {
+			s.APISendGeneralResp(w, APIERR, APIRedactionFailed)
+			return
+		}
+
+		resp := APIMessageEntryResp{}
+		resp.Status = APIOK
+		resp.Messages = messageEntry
+		s.JSONResponse(w, resp)
+	}).Methods("PUT")
+
+	// Place or release a legal hold on a message. Messages under legal hold are not removed by cleanup, deletion or erasure, or redacted.
+	holdHandler := func(hold bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			UUID := mux.Vars(r)["id"]
+			if !s.APICanChange(w, r, PermHoldMessages, AuditActionHold, UUID) {
+				return
+			}
+			messageEntry := APIHoldMessage(r, UUID, hold)
+			if messageEntry.UUID == "" {
+				s.APISendGeneralResp(w, APIERR, APINoMessage)
+				return
+			}
+
+			resp := APIMessageEntryResp{}
+			resp.Status = APIOK
+			resp.Messages = messageEntry
+			s.JSONResponse(w, resp)
+		}
+	}
+	api.HandleFunc("/message/{id}/hold", holdHandler(true)).Methods("PUT")
+	api.HandleFunc("/message/{id}/hold", holdHandler(false)).Methods("DELETE")
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Commonly used strings.
+const (
+	APINoExportJob       = "Export job was not found."
+	APIExportNotComplete = "Export is not complete."
+)
+
+// Response with an export job.
+type APIExportJobResp struct {
+	APIGeneralResp
+	Job ExportJob `json:"job"`
+}
+
+// Response with the export jobs of a user.
+type APIExportJobsResp struct {
+	APIGeneralResp
+	Jobs []ExportJob `json:"jobs"`
+}
+
+// Set headers to download an export file.
+func APIExportHeaders(w http.ResponseWriter, format string, created time.Time) {
+	fileName := "export-" + created.Format("20060102-150405") + ExportFormats[format].Extension
+	w.Header().Set("Content-Type", ExportFormats[format].ContentType)
+	APIAttachmentHeader(w, fileName)
+}
+
+// Stream every message matching a search query, which is visible to the user of a request, in an export format.
+// Each message exported is recorded in the audit log, and nothing is sent if the search can't be recorded.
+func APIExportMessages(w http.ResponseWriter, r *http.Request, query string, format string) {
+	// Users limited to addresses or domains may only export messages matching their scopes.
+	db := AuthScopeFilter(app.db, AuthRequestUser(r))
+	if query != "" {
+		if AuditRecordSearch(r, query) != nil {
+			http.Error(w, AuditNotRecorded, http.StatusInternalServerError)
+			return
+		}
+		db = APIMessageLogSearch(db, query)
+	}
+
+	APIExportHeaders(w, format, time.Now())
+	detail := "query: " + query + ": " + format
+	err := ExportMessages(r.Context(), db, format, w, func(message MessageLog) {
+		AuditRecord(r, AuditActionExport, message.UUID, detail, AuditOutcomeSuccess)
+	})
+	// Headers are already sent, so all we can do is log the error.
+	if err != nil && err != ErrExportCancelled {
+		LogRequest(logExport, r).Error("Export failed", "error", err)
+	}
+}
+
+// Find an export job of the user of a request by the ID in the route.
+func APIFindExportJob(r *http.Request) (ExportJob, bool) {
+	ID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return ExportJob{}, false
+	}
+	return ExportGetJob(AuthRequestUser(r), ID)
+}
+
+// Send the file of a complete export job.
+func APIExportDownload(w http.ResponseWriter, job ExportJob) error {
+	fp, err := ExportOpenJob(job)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	APIExportHeaders(w, job.Format, job.Created)
+	w.Header().Set("Content-Length", strconv.FormatInt(job.Size, 10))
+	io.Copy(w, fp)
+	return nil
+}
+
+// Setup HTTP router with routes for exporting messages.
+// These must be registered before the message routes, which accept any method.
+func (s *HTTPServer) RegisterExportRoutes(api *mux.Router) {
+	// Download every message matching a search query as mbox, a ZIP of EML files, or a Maildir tarball.
+	api.HandleFunc("/message_log/export", func(w http.ResponseWriter, r *http.Request) {
+		if !s.APICanChange(w, r, PermExportMessages, AuditActionExport, "") {
+			return
+		}
+		r.ParseForm() // r.Form isn't filled unless we first parse.
+		format := r.Form.Get("format")
+		if err := ExportValidFormat(format); err != nil {
+			s.APISendGeneralResp(w, APIERR, err.Error())
+			return
+		}
+		APIExportMessages(w, r, r.Form.Get("q"), format)
+	}).Methods("GET")
+
+	// Start an export in the background, for large numbers of messages.
+	api.HandleFunc("/export_jobs", func(w http.ResponseWriter, r *http.Request) {
+		if !s.APICanChange(w, r, PermExportMessages, AuditActionExport, "") {
+			return
+		}
+		r.ParseForm() // r.Form isn't filled unless we first parse.
+		query := r.Form.Get("q")
+		if query != "" && AuditRecordSearch(r, query) != nil {
+			s.APISendGeneralResp(w, APIERR, AuditNotRecorded)
+			return
+		}
+		job, err := ExportStartJob(AuthRequestUser(r), AuditSourceIP(r), query, r.Form.Get("format"))
+		if err != nil {
+			s.APISendGeneralResp(w, APIERR, err.Error())
+			return
+		}
+
+		resp := APIExportJobResp{}
+		resp.Status = APIOK
+		resp.Job = job
+		s.JSONResponse(w, resp)
+	}).Methods("POST")
+
+	// List export jobs with their progress.
+	api.HandleFunc("/export_jobs", func(w http.ResponseWriter, r *http.Request) {
+		if !s.APICanChange(w, r, PermExportMessages, AuditActionExport, "") {
+			return
+		}
+		resp := APIExportJobsResp{}
+		resp.Status = APIOK
+		resp.Jobs = ExportListJobs(AuthRequestUser(r))
+		s.JSONResponse(w, resp)
+	}).Methods("GET")
+
+	// Get the progress of an export job.
+	api.HandleFunc("/export_jobs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if !s.APICanChange(w, r, PermExportMessages, AuditActionExport, "") {
+			return
+		}
+		job, ok := APIFindExportJob(r)
+		if !ok {
+			s.APISendGeneralResp(w, APIERR, APINoExportJob)
+			return
+		}
+
+		resp := APIExportJobResp{}
+		resp.Status = APIOK
+		resp.Job = job
+		s.JSONResponse(w, resp)
+	}).Methods("GET")
+
+	// Download the file of a complete export job.
+	api.HandleFunc("/export_jobs/{id}/download", func(w http.ResponseWriter, r *http.Request) {
+		if !s.APICanChange(w, r, PermExportMessages, AuditActionExport, "") {
+			return
+		}
+		job, ok := APIFindExportJob(r)
+		if !ok {
+			s.APISendGeneralResp(w, APIERR, APINoExportJob)
+			return
+		}
+		if APIExportDownload(w, job) != nil {
+			s.APISendGeneralResp(w, APIERR, APIExportNotComplete)
+		}
+	}).Methods("GET")
+
+	// Cancel a running export job, or remove a finished one and its file.
+	api.HandleFunc("/export_jobs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if !s.APICanChange(w, r, PermExportMessages, AuditActionExport, "") {
+			return
+		}
+		job, ok := APIFindExportJob(r)
+		if !ok || !ExportRemoveJob(AuthRequestUser(r), job.ID) {
+			s.APISendGeneralResp(w, APIERR, APINoExportJob)
+			return
+		}
+		s.APISendGeneralResp(w, APIOK, "")
+	}).Methods("DELETE")
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// Response with statistics of messages received.
+type APIStatsResp struct {
+	APIGeneralResp
+	Stats Stats `json:"stats"`
+}
+
+// Read statistics filters from a request, with defaults filled in.
+func APIStatsFilter(r *http.Request) (filter StatsFilter, err error) {
+	r.ParseForm() // r.Form isn't filled unless we first parse.
+	filter.Interval = r.Form.Get("interval")
+	filter.Query = r.Form.Get("q")
+	if value := r.Form.Get("top"); value != "" {
+		if filter.Top, err = strconv.Atoi(value); err != nil || filter.Top <= 0 {
+			err = fmt.Errorf("Top must be between 1 and %d.", statsMaxTop)
+			return
+		}
+	}
+	if filter.Since, err = APIParseTime(r.Form.Get("since")); err != nil {
+		return
+	}
+	if filter.Until, err = APIParseTime(r.Form.Get("until")); err != nil {
+		return
+	}
+	err = StatsValidateFilter(&filter)
+	return
+}
+
+// Setup HTTP router with routes for statistics of messages received.
+func (s *HTTPServer) RegisterStatsRoutes(api *mux.Router) {
+	// Statistics of messages received over a time range, for charts.
+	api.HandleFunc("/stats", s.AuthRequire(PermReadMessages, func(w http.ResponseWriter, r *http.Request) {
+		filter, err := APIStatsFilter(r)
+		if err != nil {
+			s.APISendGeneralResp(w, APIERR, err.Error())
+			return
+		}
+		// Search queries are recorded in the audit log, as with a message log search.
+		if filter.Query != "" && AuditRecordSearch(r, filter.Query) != nil {
+			s.APISendGeneralResp(w, APIERR, AuditNotRecorded)
+			return
+		}
+		stats, err := StatsCollect(filter, AuthRequestUser(r))
+		if err != nil {
+			s.APISendGeneralResp(w, APIERR, err.Error())
+			return
+		}
+		resp := APIStatsResp{}
+		resp.Status = APIOK
+		resp.Stats = stats
+		s.JSONResponse(w, resp)
+	})).Methods("GET")
+}
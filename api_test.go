@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/configor"
+	"github.com/jinzhu/gorm"
+)
+
+// Set up the application with the default configuration and an empty database in memory.
+func testApp(t *testing.T) {
+	app = new(App)
+	config := Config{}
+	if err := configor.Load(&config); err != nil {
+		t.Fatal(err)
+	}
+	app.SetConfig(config)
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each connection to a database in memory has its own database.
+	db.DB().SetMaxOpenConns(1)
+	initDB(db)
+	app.db = db
+	app.sysLogMailUpdateQueue = make(map[string]bool)
+	t.Cleanup(func() { db.Close() })
+}
+
+// Create a router with the API routes, as used by the HTTP server.
+func testRouter() *mux.Router {
+	s := &HTTPServer{}
+	r := mux.NewRouter()
+	s.RegisterAPIRoutes(r)
+	return r
+}
+
+// Make a request as a user, as the authentication middleware does once they are logged in.
+func testAsUser(req *http.Request, user *User) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), authUserKey, user))
+}
+
+func TestAPISearchTerms(t *testing.T) {
+	for _, query := range []string{"", " ", "\t \n", "%", "%%", "_", "% _ !"} {
+		if patterns := APISearchTerms(query); len(patterns) != 0 {
+			t.Errorf("query %q has patterns %q, expected none", query, patterns)
+		}
+	}
+	patterns := APISearchTerms("  50%  off_ ")
+	if len(patterns) != 2 || patterns[0] != "%50!%%" || patterns[1] != "%off!_%" {
+		t.Errorf("unexpected patterns %q", patterns)
+	}
+}
+
+func TestAPIMessageLogSearchWildcards(t *testing.T) {
+	testApp(t)
+	app.db.Create(&MessageLog{UUID: "1", Subject: "50% off", Status: "sent"})
+	app.db.Create(&MessageLog{UUID: "2", Subject: "Weekly report", Status: "sent"})
+
+	for query, expected := range map[string]int{"%": 0, " ": 0, "50%": 1, "_": 0, "report": 1, "sent": 2} {
+		var count int
+		APIMessageLogSearch(app.db.Model(&MessageLog{}), query).Count(&count)
+		if count != expected {
+			t.Errorf("query %q matched %d messages, expected %d", query, count, expected)
+		}
+	}
+}
+
+func TestAPIDeleteRequiresSearchTerms(t *testing.T) {
+	testApp(t)
+	app.db.Create(&MessageLog{UUID: "1", Subject: "50% off", Status: "sent"})
+	app.db.Create(&MessageLog{UUID: "2", Subject: "Weekly report", Status: "sent"})
+	r := testRouter()
+
+	for _, query := range []string{"%20", "%09%20", "%25", "%25%25%20_"} {
+		for _, path := range []string{"/api/message_log", "/api/v2/messages"} {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, testAsUser(httptest.NewRequest("DELETE", path+"?q="+query, nil), &User{Role: RoleAdmin}))
+
+			resp := APIGeneralResp{}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			if path == "/api/message_log" && resp.Status != APIERR {
+				t.Errorf("%s with query %q was not rejected: %s", path, query, w.Body.String())
+			}
+			if path == "/api/v2/messages" && w.Code != http.StatusBadRequest {
+				t.Errorf("%s with query %q responded with %d, expected %d", path, query, w.Code, http.StatusBadRequest)
+			}
+		}
+	}
+
+	var count int
+	app.db.Model(&MessageLog{}).Count(&count)
+	if count != 2 {
+		t.Errorf("%d messages are left, expected 2", count)
+	}
+}
+
+func TestAPIDestructiveRequiresLogin(t *testing.T) {
+	testApp(t)
+	app.db.Create(&MessageLog{UUID: "1", Subject: "Weekly report", From: "a@example.com", Status: "sent"})
+	r := testRouter()
+
+	requests := []struct {
+		method string
+		path   string
+	}{
+		{"DELETE", "/api/message/1"},
+		{"DELETE", "/api/message_log?q=report"},
+		{"PUT", "/api/message/1/redact"},
+		{"PUT", "/api/message/1/hold"},
+		{"GET", "/api/data_subject/export?address=a@example.com"},
+		{"POST", "/api/data_subject/erase?address=a@example.com"},
+		{"POST", "/api/config/reload"},
+		{"DELETE", "/api/v2/messages/1"},
+		{"DELETE", "/api/v2/messages?q=report"},
+		{"POST", "/api/v2/messages/1/redact"},
+		{"POST", "/api/v2/messages/1/hold"},
+		{"GET", "/api/v2/data_subject/export?address=a@example.com"},
+		{"POST", "/api/v2/data_subject/erase?address=a@example.com"},
+		{"POST", "/api/v2/config/reload"},
+	}
+	for _, req := range requests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(req.method, req.path, nil))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s %s without authentication responded with %d, expected %d", req.method, req.path, w.Code, http.StatusForbidden)
+		}
+	}
+
+	var entry MessageLog
+	app.db.Where("uuid = ?", "1").First(&entry)
+	if entry.UUID == "" || entry.Hold || entry.Redacted {
+		t.Errorf("message was changed without authentication: %+v", entry)
+	}
+}
+
+func TestAPISearchRequiresAudit(t *testing.T) {
+	testApp(t)
+	app.db.Create(&MessageLog{UUID: "1", Subject: "Weekly report", Status: "sent"})
+	// Without the audit log table, no search can be recorded.
+	app.db.DropTable(&AuditLog{})
+	r := testRouter()
+
+	requests := []struct {
+		method string
+		path   string
+	}{
+		{"GET", "/api/message_log?q=report"},
+		{"GET", "/api/message_log/export?q=report&format=mbox"},
+		{"POST", "/api/export_jobs?q=report&format=mbox"},
+		{"GET", "/api/stats?q=report"},
+		{"GET", "/api/v2/messages?q=report"},
+		{"GET", "/api/v2/messages/export?q=report&format=mbox"},
+		{"POST", "/api/v2/exports?q=report&format=mbox"},
+		{"GET", "/api/v2/stats?q=report"},
+	}
+	for _, req := range requests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, testAsUser(httptest.NewRequest(req.method, req.path, nil), &User{Role: RoleAdmin}))
+
+		resp := APIGeneralResp{}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if (w.Code != http.StatusInternalServerError && resp.Error != AuditNotRecorded) || strings.Contains(w.Body.String(), "Weekly report") {
+			t.Errorf("%s %s responded with %d: %s", req.method, req.path, w.Code, w.Body.String())
+		}
+	}
+
+	var count int
+	app.db.Model(&ExportJob{}).Count(&count)
+	if count != 0 {
+		t.Errorf("%d export jobs were started, expected none", count)
+	}
+}
+
+func TestAPIAttachmentHeader(t *testing.T) {
+	testApp(t)
+	r := testRouter()
+
+	// The address is part of the file name, and may include characters which end a quoted string or parameter.
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, testAsUser(httptest.NewRequest("GET", "/api/data_subject/export?address=a%22%3Bb%3Dc%40example.com", nil), &User{Role: RoleAdmin}))
+	disposition, params, err := mime.ParseMediaType(w.Header().Get("Content-Disposition"))
+	if err != nil || disposition != "attachment" || !strings.HasPrefix(params["filename"], "data-subject-a\";b=c@example.com-") || len(params) != 1 {
+		t.Errorf("header %q has parameters %q", w.Header().Get("Content-Disposition"), params)
+	}
+
+	for _, fileName := range []string{"export.mbox", "a\"b\\c;d.zip", "réponse.eml"} {
+		w := httptest.NewRecorder()
+		APIAttachmentHeader(w, fileName)
+		if _, params, err := mime.ParseMediaType(w.Header().Get("Content-Disposition")); err != nil || params["filename"] != fileName || len(params) != 1 {
+			t.Errorf("header %q for %q has parameters %q", w.Header().Get("Content-Disposition"), fileName, params)
+		}
+	}
+}
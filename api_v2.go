@@ -0,0 +1,658 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Commonly used strings.
+const (
+	APIV2NoMessage = "Message was not found."
+	APIV2BadCursor = "Invalid cursor."
+)
+
+// Details of an error in the v2 API.
+type APIV2Error struct {
+	Status  int    `json:"status"`  // The HTTP status code.
+	Code    string `json:"code"`    // Machine readable code, derived from the HTTP status.
+	Message string `json:"message"` // Human readable message.
+}
+
+// Every error in the v2 API is sent in this envelope, with a matching HTTP status code.
+type APIV2ErrorResp struct {
+	Error APIV2Error `json:"error"`
+}
+
+// Pagination information included in list responses.
+type APIV2Page struct {
+	Total      int    `json:"total"`       // Total number of entries matching the request.
+	NextCursor string `json:"next_cursor"` // Provide as the cursor parameter to get the next page, empty on the last page.
+}
+
+// Response with configuration.
+type APIV2ConfigResp struct {
+	CustomBrand          string `json:"custom_brand"`
+	DisableSpamReporting bool   `json:"disable_spam_reporting"`
+	DisableLogs          bool   `json:"disable_logs"`
+	MessageCount         uint   `json:"message_count"`
+}
+
+// Response with message log entries.
+type APIV2MessagesResp struct {
+	APIV2Page
+	Messages []MessageLog `json:"messages"`
+}
+
+// Response with a message log entry.
+type APIV2MessageResp struct {
+	Message MessageLog `json:"message"`
+}
+
+// A syslog message of a message.
+type APIV2LogLine struct {
+	Timestamp time.Time `json:"timestamp"`
+	Hostname  string    `json:"hostname"`
+	Tag       string    `json:"tag"`
+	SID       string    `json:"sid"`
+	Content   string    `json:"content"`
+}
+
+// Response with syslog messages of a message.
+type APIV2LogsResp struct {
+	Logs []APIV2LogLine `json:"logs"`
+}
+
+// Response with a timeline of delivery events for a message.
+type APIV2TimelineResp struct {
+	DeliveryStatus string                `json:"delivery_status"`
+	TotalDelay     float64               `json:"total_delay"` // Seconds from the first to the last event.
+	Events         []SysLogTimelineEvent `json:"events"`
+}
+
+// Response to spam report requests.
+type APIV2ReportResp struct {
+	Requests []map[string]string `json:"requests"`
+}
+
+// Response with the number of messages deleted.
+type APIV2DeleteResp struct {
+	Deleted int `json:"deleted"`
+	Held    int `json:"held"` // Number of matching messages kept as they are under legal hold.
+}
+
+// Response with an export job.
+type APIV2ExportResp struct {
+	Export ExportJob `json:"export"`
+}
+
+// Response with the export jobs of a user.
+type APIV2ExportsResp struct {
+	Exports []ExportJob `json:"exports"`
+}
+
+// Response with unmatched syslog messages.
+type APIV2SysLogUnmatchedResp struct {
+	APIV2Page
+	Entries []SysLogUnmatched `json:"entries"`
+	Drops   map[string]uint64 `json:"drops"`
+}
+
+// Response with audit log entries.
+type APIV2AuditResp struct {
+	APIV2Page
+	Entries []AuditLog `json:"entries"`
+}
+
+// Response with the result of reloading the configuration.
+type APIV2ConfigReloadResp struct {
+	Reload ConfigReloadStatus `json:"reload"`
+}
+
+// Response with statistics of messages received.
+type APIV2StatsResp struct {
+	Stats Stats `json:"stats"`
+}
+
+// Check if a request is to the v2 API.
+func APIIsV2(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api/v2/")
+}
+
+// Send an error in the v2 envelope.
+func (s *HTTPServer) APIV2Error(w http.ResponseWriter, status int, message string) {
+	resp := APIV2ErrorResp{}
+	resp.Error.Status = status
+	resp.Error.Code = strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+	resp.Error.Message = message
+	s.JSONResponseCode(w, status, resp)
+}
+
+// Send an error in the envelope of the API version requested.
+func (s *HTTPServer) APIErrorResponse(w http.ResponseWriter, r *http.Request, status int, message string) {
+	if APIIsV2(r) {
+		s.APIV2Error(w, status, message)
+		return
+	}
+	s.JSONResponseCode(w, status, APIGeneralResp{Status: APIERR, Error: message})
+}
+
+// Read the page size and cursor of a list request.
+func APIV2Pagination(r *http.Request) (limit int, cursor string, err error) {
+	limit = app.Config().MessagesPerPage
+	if value := r.Form.Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > app.Config().APIMaxPageSize {
+			err = fmt.Errorf("Limit must be between 1 and %d.", app.Config().APIMaxPageSize)
+			return
+		}
+	}
+	cursor = r.Form.Get("cursor")
+	return
+}
+
+// Setup HTTP router with routes for the v2 API.
+// Errors use HTTP status codes with a uniform envelope, and list responses include pagination information.
+func (s *HTTPServer) RegisterAPIV2Routes(r *mux.Router) {
+	api := r.PathPrefix("/api/v2").Subrouter()
+
+	// Just a test call.
+	api.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+		s.JSONResponse(w, struct{}{})
+	}).Methods("GET")
+
+	// Retrieve the configuration.
+	api.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		resp := APIV2ConfigResp{}
+		resp.CustomBrand = app.Config().UICustomBrand
+		resp.DisableSpamReporting = app.Config().UIDisableSpamReporting
+		resp.DisableLogs = app.Config().UIDisableLogs
+		resp.MessageCount = AuthMessageCount(AuthRequestUser(r))
+		s.JSONResponse(w, resp)
+	}).Methods("GET")
+
+	// Retrieve message logs matching the query provided, newest first.
+	api.HandleFunc("/messages", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm() // r.Form isn't filled unless we first parse.
+		limit, cursor, err := APIV2Pagination(r)
+		if err != nil {
+			s.APIV2Error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		// Users limited to addresses or domains may only see messages matching their scopes.
+		db := AuthScopeFilter(app.db.Model(&MessageLog{}), AuthRequestUser(r))
+		if query := r.Form.Get("q"); query != "" {
+			if AuditRecordSearch(r, query) != nil {
+				s.APIV2Error(w, http.StatusInternalServerError, AuditNotRecorded)
+				return
+			}
+			db = APIMessageLogSearch(db, query)
+		}
+
+		resp := APIV2MessagesResp{}
+		db.Count(&resp.Total)
+		resp.Messages, resp.NextCursor, err = APIMessageLogPage(db, cursor, limit)
+		if err != nil {
+			s.APIV2Error(w, http.StatusBadRequest, APIV2BadCursor)
+			return
+		}
+		if resp.Messages == nil {
+			resp.Messages = []MessageLog{}
+		}
+		s.JSONResponse(w, resp)
+	}).Methods("GET")
+
+	// Download every message matching the query provided as mbox, a ZIP of EML files, or a Maildir tarball.
+	// This is registered before the message routes, so export is not taken as a message id.
+	api.HandleFunc("/messages/export", func(w http.ResponseWriter, r *http.Request) {
+		if !s.APICanChange(w, r, PermExportMessages, AuditActionExport, "") {
+			return
+		}
+		r.ParseForm() // r.Form isn't filled unless we first parse.
+		format := r.Form.Get("format")
+		if err := ExportValidFormat(format); err != nil {
+			s.APIV2Error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		APIExportMessages(w, r, r.Form.Get("q"), format)
+	}).Methods("GET")
+
+	// Pull a message entry.
+	api.HandleFunc("/messages/{id}", func(w http.ResponseWriter, r *http.Request) {
+		UUID := mux.Vars(r)["id"]
+		messageEntry := AuthFindMessage(r, UUID)
+		if messageEntry.UUID == "" {
+			AuditRecord(r, AuditActionRead, UUID, "metadata", AuditOutcomeNotFound)
+			s.APIV2Error(w, http.StatusNotFound, APIV2NoMessage)
+			return
+		}
+		if AuditRecord(r, AuditActionRead, UUID, "metadata", AuditOutcomeSuccess) != nil {
+			s.APIV2Error(w, http.StatusInternalServerError, AuditNotRecorded)
+			return
+		}
+		s.JSONResponse(w, APIV2MessageResp{Message: messageEntry})
+	}).Methods("GET")
+
+	// Pull syslog messages from every host the message passed through.
+	api.HandleFunc("/messages/{id}/logs", func(w http.ResponseWriter, r *http.Request) {
+		UUID := mux.Vars(r)["id"]
+		messageEntry := AuthFindMessage(r, UUID)
+		if messageEntry.UUID == "" {
+			AuditRecord(r, AuditActionRead, UUID, "log", AuditOutcomeNotFound)
+			s.APIV2Error(w, http.StatusNotFound, APIV2NoMessage)
+			return
+		}
+		if AuditRecord(r, AuditActionRead, UUID, "log", AuditOutcomeSuccess) != nil {
+			s.APIV2Error(w, http.StatusInternalServerError, AuditNotRecorded)
+			return
+		}
+
+		resp := APIV2LogsResp{Logs: []APIV2LogLine{}}
+		for _, message := range SysLogMessageLogs(messageEntry.MessageID) {
+			resp.Logs = append(resp.Logs, APIV2LogLine{
+				Timestamp: message.Timestamp,
+				Hostname:  message.Hostname,
+				Tag:       message.Tag,
+				SID:       message.SID,
+				Content:   message.Content,
+			})
+		}
+		s.JSONResponse(w, resp)
+	}).Methods("GET")
+
+	// Pull a timeline of delivery events for a message.
+	api.HandleFunc("/messages/{id}/timeline", func(w http.ResponseWriter, r *http.Request) {
+		UUID := mux.Vars(r)["id"]
+		messageEntry := AuthFindMessage(r, UUID)
+		if messageEntry.UUID == "" {
+			AuditRecord(r, AuditActionRead, UUID, "timeline", AuditOutcomeNotFound)
+			s.APIV2Error(w, http.StatusNotFound, APIV2NoMessage)
+			return
+		}
+		if AuditRecord(r, AuditActionRead, UUID, "timeline", AuditOutcomeSuccess) != nil {
+			s.APIV2Error(w, http.StatusInternalServerError, AuditNotRecorded)
+			return
+		}
+
+		resp := APIV2TimelineResp{}
+		resp.DeliveryStatus = messageEntry.Status
+		resp.Events = SysLogMessageTimeline(messageEntry.MessageID)
+		if len(resp.Events) != 0 {
+			resp.TotalDelay = resp.Events[len(resp.Events)-1].Elapsed
+		}
+		s.JSONResponse(w, resp)
+	}).Methods("GET")
+
+	// Pull the original source, plain text body or HTML body of a message.
+	api.HandleFunc("/messages/{id}/{format:source|text|html}", func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r) // Parses the variable matched in the request URI.
+		UUID := vars["id"]
+		format := vars["format"]
+
+		// Downloading the original source is recorded separately from reading in the audit log.
+		auditAction, auditDetail := AuditActionRead, map[string]string{"source": "eml", "text": "txt", "html": "html"}[format]
+		if format == "source" {
+			auditAction = AuditActionDownload
+		}
+
+		if AuthFindMessage(r, UUID).UUID == "" {
+			AuditRecord(r, auditAction, UUID, auditDetail, AuditOutcomeNotFound)
+			s.APIV2Error(w, http.StatusNotFound, APIV2NoMessage)
+			return
+		}
+		reader, err := MailGetMessageData(UUID)
+		if err != nil {
+			AuditRecord(r, auditAction, UUID, auditDetail, AuditOutcomeNotFound)
+			s.APIV2Error(w, http.StatusNotFound, APIV2NoMessage)
+			return
+		}
+		// If we need to close after reading, defer the close to after this function call.
+		if x, ok := reader.(io.Closer); ok {
+			defer x.Close()
+		}
+
+		// Decode the body, unless the original source was requested.
+		contentType := "message/rfc822"
+		if format != "source" {
+			reader, err = APIMessageBody(reader, format == "html")
+			if err != nil {
+				AuditRecord(r, auditAction, UUID, auditDetail, AuditOutcomeError)
+				s.APIV2Error(w, http.StatusUnprocessableEntity, APIReadMessage)
+				return
+			}
+			contentType = "text/plain"
+			if format == "html" {
+				contentType = "text/html"
+			}
+		}
+		if AuditRecord(r, auditAction, UUID, auditDetail, AuditOutcomeSuccess) != nil {
+			s.APIV2Error(w, http.StatusInternalServerError, AuditNotRecorded)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		if format == "source" {
+			APIAttachmentHeader(w, UUID+".eml")
+		}
+		io.Copy(w, reader)
+	}).Methods("GET")
+
+	// Report a message as spam or ham.
+	api.HandleFunc("/messages/{id}/report/{type:spam|ham}", func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r) // Parses the variable matched in the request URI.
+		UUID := vars["id"]
+		reportType := vars["type"]
+
+		if !AuthHasPermission(AuthRequestUser(r), PermReportSpam) {
+			AuditRecord(r, AuditActionReport, UUID, reportType, AuditOutcomeDenied)
+			s.APIV2Error(w, http.StatusForbidden, AuthPermissionDenied)
+			return
+		}
+		if AuthFindMessage(r, UUID).UUID == "" {
+			AuditRecord(r, AuditActionReport, UUID, reportType, AuditOutcomeNotFound)
+			s.APIV2Error(w, http.StatusNotFound, APIV2NoMessage)
+			return
+		}
+
+		requests, anySuccess, err := SpamReportMessage(UUID, reportType)
+		if err == ErrSpamReportNoMessage {
+			AuditRecord(r, AuditActionReport, UUID, reportType, AuditOutcomeNotFound)
+			s.APIV2Error(w, http.StatusNotFound, APIV2NoMessage)
+			return
+		} else if err != nil {
+			AuditRecord(r, AuditActionReport, UUID, reportType, AuditOutcomeError)
+			s.APIV2Error(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		// If none of the spam reporting tools accepted the report, the upstream failed.
+		if !anySuccess {
+			AuditRecord(r, AuditActionReport, UUID, reportType, AuditOutcomeError)
+			s.APIV2Error(w, http.StatusBadGateway, "No successful request was made.")
+			return
+		}
+		AuditRecord(r, AuditActionReport, UUID, reportType, AuditOutcomeSuccess)
+		s.JSONResponse(w, APIV2ReportResp{Requests: requests})
+	}).Methods("POST")
+
+	// Delete a message, its stored body and related syslog messages.
+	api.HandleFunc("/messages/{id}", func(w http.ResponseWriter, r *http.Request) {
+		UUID := mux.Vars(r)["id"]
+		if !s.APICanChange(w, r, PermDeleteMessages, AuditActionDelete, UUID) {
+			return
+		}
+		found, err := APIDeleteMessage(r, UUID)
+		if !found {
+			s.APIV2Error(w, http.StatusNotFound, APIV2NoMessage)
+			return
+		}
+		if err != nil {
+			s.APIV2Error(w, http.StatusConflict, err.Error())
+			return
+		}
+		s.JSONResponse(w, APIV2DeleteResp{Deleted: 1})
+	}).Methods("DELETE")
+
+	// Delete all messages matching a search query.
+	api.HandleFunc("/messages", func(w http.ResponseWriter, r *http.Request) {
+		if !s.APICanChange(w, r, PermDeleteMessages, AuditActionDelete, "") {
+			return
+		}
+		r.ParseForm() // r.Form isn't filled unless we first parse.
+		query := r.Form.Get("q")
+		if len(APISearchTerms(query)) == 0 {
+			s.APIV2Error(w, http.StatusBadRequest, APIDeleteNoQuery)
+			return
+		}
+		resp := APIV2DeleteResp{}
+		resp.Deleted, resp.Held = APIDeleteMessageLog(r, query)
+		s.JSONResponse(w, resp)
+	}).Methods("DELETE")
+
+	// Replace the body and attachments of a message with a notice, keeping its metadata.
+	api.HandleFunc("/messages/{id}/redact", func(w http.ResponseWriter, r *http.Request) {
+		UUID := mux.Vars(r)["id"]
+		if !s.APICanChange(w, r, PermDeleteMessages, AuditActionRedact, UUID) {
+			return
+		}
+		r.ParseForm() // r.Form isn't filled unless we first parse.
+
+		messageEntry, err := APIRedactMessage(r, UUID, r.Form.Get("reason"))
+		if messageEntry.UUID == "" {
+			s.APIV2Error(w, http.StatusNotFound, APIV2NoMessage)
+			return
+		}
+		if err == ErrMailHeld {
+			s.APIV2Error(w, http.StatusConflict, err.Error())
+			return
+		} else if err != nil {
+			s.APIV2Error(w, http.StatusInternalServerError, APIRedactionFailed)
+			return
+		}
+		s.JSONResponse(w, APIV2MessageResp{Message: messageEntry})
+	}).Methods("POST")
+
+	// Place or release a legal hold on a message.
+	holdHandler := func(hold bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			UUID := mux.Vars(r)["id"]
+			if !s.APICanChange(w, r, PermHoldMessages, AuditActionHold, UUID) {
+				return
+			}
+			messageEntry := APIHoldMessage(r, UUID, hold)
+			if messageEntry.UUID == "" {
+				s.APIV2Error(w, http.StatusNotFound, APIV2NoMessage)
+				return
+			}
+			s.JSONResponse(w, APIV2MessageResp{Message: messageEntry})
+		}
+	}
+	api.HandleFunc("/messages/{id}/hold", holdHandler(true)).Methods("POST")
+	api.HandleFunc("/messages/{id}/hold", holdHandler(false)).Methods("DELETE")
+
+	// Download a ZIP file with every message and syslog message involving an address, along with a manifest.
+	api.HandleFunc("/data_subject/export", func(w http.ResponseWriter, r *http.Request) {
+		if !s.APICanChange(w, r, PermDataSubject, AuditActionExport, "") {
+			return
+		}
+		r.ParseForm() // r.Form isn't filled unless we first parse.
+		address, err := DataSubjectNormalize(r.Form.Get("address"))
+		if err != nil {
+			s.APIV2Error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		APIDataSubjectExport(w, r, address)
+	}).Methods("GET")
+
+	// Erase every message and syslog message involving an address, except those under legal hold.
+	api.HandleFunc("/data_subject/erase", func(w http.ResponseWriter, r *http.Request) {
+		if !s.APICanChange(w, r, PermDataSubject, AuditActionDelete, "") || !s.APICanChange(w, r, PermDeleteMessages, AuditActionDelete, "") {
+			return
+		}
+		r.ParseForm() // r.Form isn't filled unless we first parse.
+		address, err := DataSubjectNormalize(r.Form.Get("address"))
+		if err != nil {
+			s.APIV2Error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		result := DataSubjectErase(r, DataSubjectFind(address, AuthRequestUser(r)))
+		app.httpServer.wsInterface.sendMessageCount()
+		s.JSONResponse(w, result)
+	}).Methods("POST")
+
+	// Start an export in the background, for large numbers of messages.
+	api.HandleFunc("/exports", func(w http.ResponseWriter, r *http.Request) {
+		if !s.APICanChange(w, r, PermExportMessages, AuditActionExport, "") {
+			return
+		}
+		r.ParseForm() // r.Form isn't filled unless we first parse.
+		query := r.Form.Get("q")
+		if err := ExportValidFormat(r.Form.Get("format")); err != nil {
+			s.APIV2Error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if query != "" && AuditRecordSearch(r, query) != nil {
+			s.APIV2Error(w, http.StatusInternalServerError, AuditNotRecorded)
+			return
+		}
+		job, err := ExportStartJob(AuthRequestUser(r), AuditSourceIP(r), query, r.Form.Get("format"))
+		if err != nil {
+			s.APIV2Error(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		s.JSONResponse(w, APIV2ExportResp{Export: job})
+	}).Methods("POST")
+
+	// List export jobs with their progress.
+	api.HandleFunc("/exports", func(w http.ResponseWriter, r *http.Request) {
+		if !s.APICanChange(w, r, PermExportMessages, AuditActionExport, "") {
+			return
+		}
+		resp := APIV2ExportsResp{Exports: ExportListJobs(AuthRequestUser(r))}
+		if resp.Exports == nil {
+			resp.Exports = []ExportJob{}
+		}
+		s.JSONResponse(w, resp)
+	}).Methods("GET")
+
+	// Get the progress of an export job.
+	api.HandleFunc("/exports/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if !s.APICanChange(w, r, PermExportMessages, AuditActionExport, "") {
+			return
+		}
+		job, ok := APIFindExportJob(r)
+		if !ok {
+			s.APIV2Error(w, http.StatusNotFound, APINoExportJob)
+			return
+		}
+		s.JSONResponse(w, APIV2ExportResp{Export: job})
+	}).Methods("GET")
+
+	// Download the file of a complete export job.
+	api.HandleFunc("/exports/{id}/download", func(w http.ResponseWriter, r *http.Request) {
+		if !s.APICanChange(w, r, PermExportMessages, AuditActionExport, "") {
+			return
+		}
+		job, ok := APIFindExportJob(r)
+		if !ok {
+			s.APIV2Error(w, http.StatusNotFound, APINoExportJob)
+			return
+		}
+		if APIExportDownload(w, job) != nil {
+			s.APIV2Error(w, http.StatusConflict, APIExportNotComplete)
+		}
+	}).Methods("GET")
+
+	// Cancel a running export job, or remove a finished one and its file.
+	api.HandleFunc("/exports/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if !s.APICanChange(w, r, PermExportMessages, AuditActionExport, "") {
+			return
+		}
+		job, ok := APIFindExportJob(r)
+		if !ok || !ExportRemoveJob(AuthRequestUser(r), job.ID) {
+			s.APIV2Error(w, http.StatusNotFound, APINoExportJob)
+			return
+		}
+		s.JSONResponse(w, struct{}{})
+	}).Methods("DELETE")
+
+	// Retrieve syslog messages which could not be associated with a message, newest first.
+	api.HandleFunc("/syslog/unmatched", s.AuthRequire(PermViewDiagnostics, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm() // r.Form isn't filled unless we first parse.
+		limit, cursor, err := APIV2Pagination(r)
+		if err != nil {
+			s.APIV2Error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		db := SysLogUnmatchedQuery(r.Form.Get("q"), r.Form.Get("reason"))
+		resp := APIV2SysLogUnmatchedResp{Entries: []SysLogUnmatched{}}
+		db.Count(&resp.Total)
+		if db, err = APIIDCursorFilter(db, cursor); err != nil {
+			s.APIV2Error(w, http.StatusBadRequest, APIV2BadCursor)
+			return
+		}
+		// Pull one extra entry to find if there is another page.
+		db.Order("id desc").Limit(limit + 1).Find(&resp.Entries)
+		if len(resp.Entries) > limit {
+			resp.Entries = resp.Entries[:limit]
+			resp.NextCursor = APIEncodeCursor(strconv.FormatInt(resp.Entries[limit-1].ID, 10))
+		}
+		resp.Drops = SysLogDropCounts()
+		s.JSONResponse(w, resp)
+	})).Methods("GET")
+
+	// Query the audit log, newest first.
+	api.HandleFunc("/audit", s.AuthRequire(PermViewAudit, func(w http.ResponseWriter, r *http.Request) {
+		filter, err := APIAuditFilter(r)
+		if err != nil {
+			s.APIV2Error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		limit, cursor, err := APIV2Pagination(r)
+		if err != nil {
+			s.APIV2Error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		db := AuditFilterQuery(filter)
+		resp := APIV2AuditResp{Entries: []AuditLog{}}
+		db.Count(&resp.Total)
+		if db, err = APIIDCursorFilter(db, cursor); err != nil {
+			s.APIV2Error(w, http.StatusBadRequest, APIV2BadCursor)
+			return
+		}
+		// Pull one extra entry to find if there is another page.
+		db.Order("id desc").Limit(limit + 1).Find(&resp.Entries)
+		if len(resp.Entries) > limit {
+			resp.Entries = resp.Entries[:limit]
+			resp.NextCursor = APIEncodeCursor(strconv.FormatInt(resp.Entries[limit-1].ID, 10))
+		}
+		s.JSONResponse(w, resp)
+	})).Methods("GET")
+
+	// Result of the last reload of the configuration, and settings which need a restart.
+	api.HandleFunc("/config/reload", s.AuthRequire(PermManageConfig, func(w http.ResponseWriter, r *http.Request) {
+		s.JSONResponse(w, APIV2ConfigReloadResp{Reload: ConfigGetReloadStatus()})
+	})).Methods("GET")
+
+	// Reload the configuration file, applying settings which are safe to change while running.
+	api.HandleFunc("/config/reload", s.AuthRequire(PermManageConfig, func(w http.ResponseWriter, r *http.Request) {
+		status, err := ConfigReload(ConfigReloadAPI)
+		if err != nil {
+			s.APIV2Error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		s.JSONResponse(w, APIV2ConfigReloadResp{Reload: status})
+	})).Methods("POST")
+
+	// Statistics of messages received over a time range, for charts.
+	api.HandleFunc("/stats", s.AuthRequire(PermReadMessages, func(w http.ResponseWriter, r *http.Request) {
+		filter, err := APIStatsFilter(r)
+		if err != nil {
+			s.APIV2Error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		// Search queries are recorded in the audit log, as with a message log search.
+		if filter.Query != "" && AuditRecordSearch(r, filter.Query) != nil {
+			s.APIV2Error(w, http.StatusInternalServerError, AuditNotRecorded)
+			return
+		}
+		stats, err := StatsCollect(filter, AuthRequestUser(r))
+		if err != nil {
+			s.APIV2Error(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		s.JSONResponse(w, APIV2StatsResp{Stats: stats})
+	})).Methods("GET")
+
+	// If nothing else, we return a not found response.
+	api.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.APIV2Error(w, http.StatusNotFound, APINoEndpoint)
+	})
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Actions recorded in the audit log.
+const (
+	AuditActionRead     = "read"
+	AuditActionDownload = "download"
+	AuditActionSearch   = "search"
+	AuditActionReport   = "report"
+	AuditActionHold     = "hold"
+	AuditActionDelete   = "delete"
+	AuditActionRedact   = "redact"
+	AuditActionExport   = "export"
+)
+
+// Error when access could not be recorded, mail is not served without a record.
+const AuditNotRecorded = "Unable to record access in the audit log."
+
+// Recorded as the user of actions taken with a command, rather than through the API.
+const AuditCommandUser = "(command)"
+
+// Outcomes of audited actions.
+const (
+	AuditOutcomeSuccess  = "success"
+	AuditOutcomeNotFound = "not_found" // Also recorded when the message is outside of the user's scopes.
+	AuditOutcomeDenied   = "denied"
+	AuditOutcomeError    = "error"
+)
+
+// Times an entry is appended when another process appended an entry at the same time.
+const auditAppendAttempts = 5
+
+// The end of the audit log, kept so that the last entry does not need to be read before each append.
+// Entries are chained, so appends by this process are made in order.
+type AuditChain struct {
+	sync.Mutex
+	lastHash string
+	loaded   bool
+}
+
+// Compute the hash of an audit log entry, which includes the hash of the entry before it.
+func AuditHash(prevHash string, entry AuditLog) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%d|%s|%s|%s|%s|%s|%s|%s",
+		prevHash,
+		entry.Time.UTC().Format(time.RFC3339),
+		entry.UserID,
+		entry.Username,
+		entry.Action,
+		entry.MessageUUID,
+		entry.Query,
+		entry.SourceIP,
+		entry.Outcome,
+		entry.Detail,
+	)))
+	return hex.EncodeToString(sum[:])
+}
+
+// Get the source IP of a request.
+func AuditSourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Append an entry to the audit log. The error is logged, and returned so that mail which is not recorded is not served.
+// Only one entry may follow each entry, so if another process appended an entry first the append is retried.
+func AuditAppend(entry AuditLog) (err error) {
+	app.audit.Lock()
+	defer app.audit.Unlock()
+
+	// Times are stored to the second, as not all databases store fractions of a second.
+	entry.Time = time.Now().UTC().Truncate(time.Second)
+	for attempt := 0; attempt < auditAppendAttempts; attempt++ {
+		// Commands append from another process, so the last entry is read again after a failed append.
+		if !app.audit.loaded {
+			var last AuditLog
+			app.db.Select("hash").Order("id desc").First(&last)
+			app.audit.lastHash, app.audit.loaded = last.Hash, true
+		}
+		entry.ID = 0
+		entry.PrevHash = app.audit.lastHash
+		entry.Hash = AuditHash(app.audit.lastHash, entry)
+		if err = app.db.Create(&entry).Error; err == nil {
+			app.audit.lastHash = entry.Hash
+			return
+		}
+		app.audit.loaded = false
+	}
+	logAPI.Error("Unable to write audit log", "error", err)
+	return
+}
+
+// Record an action taken by the user of a request, or with a command if there is no request.
+func AuditRecord(r *http.Request, action, messageUUID, detail, outcome string) error {
+	if r == nil { // Actions taken with a command have no request.
+		return AuditRecordUser(nil, "", action, messageUUID, detail, outcome)
+	}
+	return AuditRecordUser(AuthRequestUser(r), AuditSourceIP(r), action, messageUUID, detail, outcome)
+}
+
+// Record an action taken by a user, for actions which continue after their request such as export jobs.
+// Without a user or source IP, the action is recorded as taken with a command.
+func AuditRecordUser(user *User, sourceIP, action, messageUUID, detail, outcome string) error {
+	entry := AuditLog{}
+	if user != nil {
+		entry.UserID = user.ID
+		entry.Username = user.Username
+	} else if sourceIP == "" {
+		entry.Username = AuditCommandUser
+	}
+	entry.SourceIP = sourceIP
+	entry.Action = action
+	entry.MessageUUID = messageUUID
+	entry.Outcome = outcome
+	entry.Detail = detail
+	return AuditAppend(entry)
+}
+
+// Record a search query made by the user of a request.
+func AuditRecordSearch(r *http.Request, query string) error {
+	entry := AuditLog{}
+	if user := AuthRequestUser(r); user != nil {
+		entry.UserID = user.ID
+		entry.Username = user.Username
+	}
+	entry.Action = AuditActionSearch
+	entry.Query = query
+	entry.SourceIP = AuditSourceIP(r)
+	entry.Outcome = AuditOutcomeSuccess
+	return AuditAppend(entry)
+}
+
+// Filters for finding audit log entries.
+type AuditFilter struct {
+	Username    string
+	Action      string
+	MessageUUID string
+	Outcome     string
+	Since       time.Time
+	Until       time.Time
+}
+
+// Apply audit log filters to a query.
+func AuditFilterQuery(filter AuditFilter) *gorm.DB {
+	db := app.db.Model(&AuditLog{})
+	if filter.Username != "" {
+		db = db.Where("username = ?", filter.Username)
+	}
+	if filter.Action != "" {
+		db = db.Where("action = ?", filter.Action)
+	}
+	if filter.MessageUUID != "" {
+		db = db.Where("message_uuid = ?", filter.MessageUUID)
+	}
+	if filter.Outcome != "" {
+		db = db.Where("outcome = ?", filter.Outcome)
+	}
+	if !filter.Since.IsZero() {
+		db = db.Where("time >= ?", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		db = db.Where("time < ?", filter.Until)
+	}
+	return db
+}
+
+// Verify the hash chain of the audit log. Returns the ID of the first entry which does not match, or 0 if all match.
+func AuditVerify() (brokenID int64, checked int) {
+	rows, err := app.db.Model(&AuditLog{}).Order("id").Rows()
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	prevHash := ""
+	for rows.Next() {
+		var entry AuditLog
+		app.db.ScanRows(rows, &entry)
+		checked++
+		if AuditHash(prevHash, entry) != entry.Hash {
+			brokenID = entry.ID
+			return
+		}
+		prevHash = entry.Hash
+	}
+	return
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAuditVerify(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(entries []AuditLog)
+		broken int // Index of the first entry expected to not match, or -1 if all match.
+	}{
+		{"clean chain", func(entries []AuditLog) {}, -1},
+		{"modified entry", func(entries []AuditLog) {
+			app.db.Model(&entries[1]).UpdateColumn("username", "someone else")
+		}, 1},
+		{"deleted entry", func(entries []AuditLog) {
+			app.db.Delete(&entries[1])
+		}, 2},
+		{"appended by another process", func(entries []AuditLog) {
+			// Another process appends after the last entry this process knows of, so the next append must follow it.
+			other := AuditLog{Time: time.Now().UTC().Truncate(time.Second), Username: AuditCommandUser, Action: AuditActionDownload}
+			other.PrevHash = entries[2].Hash
+			other.Hash = AuditHash(other.PrevHash, other)
+			app.db.Create(&other)
+			if err := AuditRecordUser(nil, "", AuditActionRead, "4", "", AuditOutcomeSuccess); err != nil {
+				t.Fatal(err)
+			}
+		}, -1},
+	}
+	for _, test := range tests {
+		testApp(t)
+		for _, uuid := range []string{"1", "2", "3"} {
+			if err := AuditRecordUser(&User{ID: 1, Username: "auditor"}, "192.0.2.1", AuditActionRead, uuid, "eml", AuditOutcomeSuccess); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var entries []AuditLog
+		app.db.Order("id").Find(&entries)
+		test.change(entries)
+
+		brokenID, _ := AuditVerify()
+		expected := int64(0)
+		if test.broken != -1 {
+			expected = entries[test.broken].ID
+		}
+		if brokenID != expected {
+			t.Errorf("%s: verify found entry %d broken, expected %d", test.name, brokenID, expected)
+		}
+	}
+}
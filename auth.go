@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Name of the session cookie.
+const AuthSessionCookie = "mail_archive_session"
+
+// Header the web interface sends the CSRF token in.
+const AuthCSRFHeader = "X-CSRF-Token"
+
+// Commonly used strings.
+const (
+	AuthRequired         = "Authentication required."
+	AuthInvalidLogin     = "Invalid username or password."
+	AuthInvalidCSRF      = "Invalid CSRF token."
+	AuthNotEnabled       = "Authentication is not enabled."
+	AuthPasswordNotSaved = "Unable to save password."
+)
+
+// Where a user authenticates.
+const (
+	UserSourceLocal = "local"
+	UserSourceOIDC  = "oidc"
+	UserSourceLDAP  = "ldap"
+)
+
+// Key used to store the authenticated user in the request context.
+type authContextKey int
+
+const authUserKey authContextKey = 0
+
+// Hash compared against when a user does not exist.
+var authDummyHash, _ = bcrypt.GenerateFromPassword([]byte("mail-archive"), bcrypt.DefaultCost)
+
+// Generate a random token encoded for use in cookies and headers.
+func AuthGenerateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Hash a token for storage, tokens are never stored in plain text.
+func AuthHashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Hash a password for storage.
+func AuthHashPassword(password string) (string, error) {
+	if password == "" {
+		return "", fmt.Errorf("Password cannot be blank.")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// Find or create a user which authenticates with an external directory, updating their role.
+// If the directory provides an external ID, the user is found by it, and the username is only for display.
+func AuthLoginExternalUser(externalID, username, source, role string) (user User, err error) {
+	if externalID != "" {
+		app.db.Where("source = ? AND external_id = ?", source, externalID).First(&user)
+	} else {
+		app.db.Where("username = ?", username).First(&user)
+	}
+
+	// Usernames are unique, so a new username must not belong to another user.
+	var existing User
+	if user.Username != username {
+		app.db.Where("username = ?", username).First(&existing)
+	}
+
+	if user.ID != 0 {
+		// Do not allow an external directory to take over a user from another source.
+		if user.Source != source {
+			err = fmt.Errorf("User %s does not login with %s.", username, source)
+			return
+		}
+		// Follow a change of username in the directory, unless another user has it.
+		if user.Username != username {
+			if existing.ID == 0 {
+				user.Username = username
+			} else {
+				logAuth.Warn("Username changed in the directory to one which is taken, keeping the previous username", "username", user.Username, "new_username", username)
+			}
+		}
+		user.Role = role
+		err = app.db.Save(&user).Error
+		return
+	}
+
+	// A user with the same username which is not linked to this identity is not taken over.
+	if existing.ID != 0 {
+		if existing.Source != source {
+			err = fmt.Errorf("User %s does not login with %s.", username, source)
+		} else {
+			err = fmt.Errorf("User %s belongs to another %s account.", username, source)
+		}
+		return
+	}
+
+	user.Username = username
+	user.Role = role
+	user.Source = source
+	user.ExternalID = externalID
+	err = app.db.Create(&user).Error
+	return
+}
+
+// Create a local user with the password and role provided.
+func AuthCreateUser(username, password, role string) (user User, err error) {
+	if username == "" {
+		err = fmt.Errorf("Username cannot be blank.")
+		return
+	}
+	if !AuthValidRole(role) {
+		err = fmt.Errorf("Invalid role %s.", role)
+		return
+	}
+	// Usernames must be unique.
+	var existing User
+	app.db.Where("username = ?", username).First(&existing)
+	if existing.ID != 0 {
+		err = fmt.Errorf("User %s already exists.", username)
+		return
+	}
+
+	user.Username = username
+	user.Role = role
+	user.Source = UserSourceLocal
+	user.PasswordHash, err = AuthHashPassword(password)
+	if err != nil {
+		return
+	}
+	err = app.db.Create(&user).Error
+	return
+}
+
+// Delete a user along with their sessions, API tokens and scopes.
+func AuthDeleteUser(user User) {
+	app.db.Where("user_id = ?", user.ID).Delete(Session{})
+	app.db.Where("user_id = ?", user.ID).Delete(UserScope{})
+	app.db.Where("user_id = ?", user.ID).Delete(APIToken{})
+	app.db.Delete(&user)
+}
+
+// Change the password of a local user. Their sessions, other than the session making the change if any,
+// are ended and their API tokens revoked, as they may have been started or created by someone who knew the old password.
+func AuthSetPassword(user *User, password string, keepSessionHash string) error {
+	hash, err := AuthHashPassword(password)
+	if err != nil {
+		return err
+	}
+	user.PasswordHash = hash
+	if err := app.db.Save(user).Error; err != nil {
+		logAuth.Error("Unable to save password", "username", user.Username, "error", err)
+		return fmt.Errorf(AuthPasswordNotSaved)
+	}
+	app.db.Where("user_id = ? AND token_hash <> ?", user.ID, keepSessionHash).Delete(Session{})
+	app.db.Where("user_id = ?", user.ID).Delete(APIToken{})
+	return nil
+}
+
+// Check the login of a user, returning the user on success.
+// Users which are not local are checked against LDAP if it is enabled.
+func AuthCheckPassword(username, password string) (user User, ok bool) {
+	app.db.Where("username = ?", username).First(&user)
+	if LDAPEnabled() && (user.ID == 0 || user.Source == UserSourceLDAP) {
+		return LDAPCheckPassword(username, password)
+	}
+	// Only local users login with a password stored here, others login with their directory.
+	if user.ID == 0 || user.Source != UserSourceLocal || user.PasswordHash == "" {
+		// Compare against a dummy hash so the response time does not reveal if the user exists.
+		bcrypt.CompareHashAndPassword(authDummyHash, []byte(password))
+		return
+	}
+	ok = bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) == nil
+	return
+}
+
+// Create the admin user from the configuration if it does not exist.
+func AuthInitAdmin() {
+	if app.Config().AuthAdminUsername == "" {
+		return
+	}
+	var existing User
+	app.db.Where("username = ?", app.Config().AuthAdminUsername).First(&existing)
+	if existing.ID != 0 {
+		return
+	}
+	if _, err := AuthCreateUser(app.Config().AuthAdminUsername, app.Config().AuthAdminPassword, RoleAdmin); err != nil {
+		logAuth.Error("Unable to create admin user", "username", app.Config().AuthAdminUsername, "error", err)
+		return
+	}
+	logAuth.Info("Created admin user", "username", app.Config().AuthAdminUsername)
+}
+
+// Start a new session for a user, setting the session cookie.
+func AuthStartSession(w http.ResponseWriter, user User) (session Session, err error) {
+	token, err := AuthGenerateToken()
+	if err != nil {
+		return
+	}
+	session.CSRFToken, err = AuthGenerateToken()
+	if err != nil {
+		return
+	}
+	session.TokenHash = AuthHashToken(token)
+	session.UserID = user.ID
+	session.Expires = time.Now().Add(app.Config().AuthSessionTimeout * time.Second)
+	if err = app.db.Create(&session).Error; err != nil {
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     AuthSessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  session.Expires,
+		HttpOnly: true,
+		Secure:   app.Config().AuthSecureCookie,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return
+}
+
+// End the session of a request, clearing the session cookie.
+func AuthEndSession(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(AuthSessionCookie); err == nil {
+		app.db.Where("token_hash = ?", AuthHashToken(cookie.Value)).Delete(Session{})
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     AuthSessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   app.Config().AuthSecureCookie,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Find the session of a request, if any.
+func AuthRequestSession(r *http.Request) (session Session) {
+	cookie, err := r.Cookie(AuthSessionCookie)
+	if err != nil || cookie.Value == "" {
+		return
+	}
+	app.db.Where("token_hash = ? AND expires > ?", AuthHashToken(cookie.Value), time.Now()).First(&session)
+	return
+}
+
+// Authenticate a request by bearer API token or session cookie.
+// Returns the session if the request was authenticated with a session cookie.
+func AuthAuthenticate(r *http.Request) (user User, session Session) {
+	// Scripts provide an API token in the authorization header.
+	authorization := r.Header.Get("Authorization")
+	if strings.HasPrefix(authorization, "Bearer ") {
+		var token APIToken
+		app.db.Where("token_hash = ?", AuthHashToken(strings.TrimPrefix(authorization, "Bearer "))).First(&token)
+		if token.ID == 0 {
+			return
+		}
+		app.db.Where("id = ?", token.UserID).First(&user)
+		AuthLoadScopes(&user)
+		// Keep track of when the token was last used.
+		app.db.Model(&token).UpdateColumn("last_used", time.Now())
+		return
+	}
+
+	// The web interface uses a session cookie.
+	session = AuthRequestSession(r)
+	if session.TokenHash == "" {
+		return
+	}
+	app.db.Where("id = ?", session.UserID).First(&user)
+	AuthLoadScopes(&user)
+	return
+}
+
+// Hash of the API token or session cookie a request was authenticated with, to check later if it is still valid.
+func AuthRequestCredential(r *http.Request) string {
+	authorization := r.Header.Get("Authorization")
+	if strings.HasPrefix(authorization, "Bearer ") {
+		return AuthHashToken(strings.TrimPrefix(authorization, "Bearer "))
+	}
+	if cookie, err := r.Cookie(AuthSessionCookie); err == nil && cookie.Value != "" {
+		return AuthHashToken(cookie.Value)
+	}
+	return ""
+}
+
+// Find the users of the sessions and API tokens with the hashes provided which are still valid, with their scopes loaded.
+// Used to check websocket clients are still logged in without a query for each client.
+func AuthCredentialUsers(hashes []string) (map[string]*User, error) {
+	credentials := make(map[string]*User)
+	if len(hashes) == 0 {
+		return credentials, nil
+	}
+	userIDs := make(map[string]int64)
+	var sessions []Session
+	if err := app.db.Where("token_hash IN (?) AND expires > ?", hashes, time.Now()).Find(&sessions).Error; err != nil {
+		return nil, err
+	}
+	for _, session := range sessions {
+		userIDs[session.TokenHash] = session.UserID
+	}
+	var tokens []APIToken
+	if err := app.db.Where("token_hash IN (?)", hashes).Find(&tokens).Error; err != nil {
+		return nil, err
+	}
+	for _, token := range tokens {
+		userIDs[token.TokenHash] = token.UserID
+	}
+	if len(userIDs) == 0 {
+		return credentials, nil
+	}
+
+	var IDs []int64
+	for _, ID := range userIDs {
+		IDs = append(IDs, ID)
+	}
+	var users []User
+	if err := app.db.Where("id IN (?)", IDs).Find(&users).Error; err != nil {
+		return nil, err
+	}
+	byID := make(map[int64]*User)
+	for i := range users {
+		users[i].Scopes = []string{}
+		byID[users[i].ID] = &users[i]
+	}
+	var scopes []UserScope
+	if err := app.db.Where("user_id IN (?)", IDs).Order("scope").Find(&scopes).Error; err != nil {
+		return nil, err
+	}
+	for _, scope := range scopes {
+		if user, ok := byID[scope.UserID]; ok {
+			user.Scopes = append(user.Scopes, scope.Scope)
+		}
+	}
+	for hash, ID := range userIDs {
+		if user, ok := byID[ID]; ok {
+			credentials[hash] = user
+		}
+	}
+	return credentials, nil
+}
+
+// Get the authenticated user of a request. Returns nil if authentication is not enabled.
+func AuthRequestUser(r *http.Request) *User {
+	user, _ := r.Context().Value(authUserKey).(*User)
+	return user
+}
+
+// Static content does not contain mail, and is needed for the login page.
+func AuthIsStaticPath(path string) bool {
+	return !strings.HasPrefix(path, "/api/") && path != "/ws"
+}
+
+// API paths which do not require authentication.
+func AuthIsPublicPath(path string) bool {
+	switch path {
+	case "/api/ping", "/api/v2/ping", OpenAPIPath, "/api/auth/login", "/api/auth/me", "/api/auth/oidc/login", "/api/auth/oidc/callback":
+		return true
+	}
+	return false
+}
+
+// Methods which change state, and therefore require a CSRF token when using a session.
+func AuthIsUnsafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// Middleware which requires authentication for the API and websocket.
+func (s *HTTPServer) AuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// If authentication is not enabled, or this is static content, there is nothing to check.
+		if !app.Config().AuthEnabled || AuthIsStaticPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Authenticate the request, even for public paths so they know who is logged in.
+		user, session := AuthAuthenticate(r)
+		if user.ID == 0 {
+			if AuthIsPublicPath(r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			s.APIErrorResponse(w, r, http.StatusUnauthorized, AuthRequired)
+			return
+		}
+
+		// Requests made with a session must provide the CSRF token to change state.
+		if session.TokenHash != "" && AuthIsUnsafeMethod(r.Method) && r.URL.Path != "/api/auth/login" {
+			csrfToken := r.Header.Get(AuthCSRFHeader)
+			if subtle.ConstantTimeCompare([]byte(csrfToken), []byte(session.CSRFToken)) != 1 {
+				s.APIErrorResponse(w, r, http.StatusForbidden, AuthInvalidCSRF)
+				return
+			}
+		}
+
+		// Pass the user along to the handlers.
+		ctx := context.WithValue(r.Context(), authUserKey, &user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// A successful LDAP login, cached so the directory is not queried on every login.
+type ldapCacheEntry struct {
+	PasswordHash []byte
+	Username     string
+	Groups       []string
+	Expires      time.Time
+}
+
+var (
+	ldapCache      = make(map[string]ldapCacheEntry)
+	ldapCacheMutex sync.Mutex
+	// Salt for the cached password hashes, which only need to be valid for the life of the process.
+	ldapCacheSalt = ldapGenerateSalt()
+)
+
+func ldapGenerateSalt() []byte {
+	salt := make([]byte, 32)
+	rand.Read(salt)
+	return salt
+}
+
+// Hash a password for the login cache.
+func ldapCacheHash(password string) []byte {
+	sum := sha256.Sum256(append(append([]byte{}, ldapCacheSalt...), password...))
+	return sum[:]
+}
+
+// Check if LDAP authentication is configured.
+func LDAPEnabled() bool {
+	return app.Config().AuthEnabled && app.Config().LDAPURL != "" && app.Config().LDAPBaseDN != ""
+}
+
+// Connect to the LDAP server.
+func LDAPConnect() (*ldap.Conn, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: app.Config().LDAPInsecureSkipVerify}
+	conn, err := ldap.DialURL(app.Config().LDAPURL, ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	if app.Config().LDAPStartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Names a group may be referred to by in the configuration, its DN and common name.
+func LDAPGroupNames(dn string) []string {
+	names := []string{dn}
+	parsed, err := ldap.ParseDN(dn)
+	if err == nil && len(parsed.RDNs) != 0 && len(parsed.RDNs[0].Attributes) != 0 {
+		names = append(names, parsed.RDNs[0].Attributes[0].Value)
+	}
+	return names
+}
+
+// Check if the user is in one of the allowed groups.
+func LDAPGroupAllowed(groups []string) bool {
+	if len(app.Config().LDAPAllowedGroups) == 0 {
+		return true
+	}
+	for _, allowed := range app.Config().LDAPAllowedGroups {
+		for _, group := range groups {
+			if strings.EqualFold(group, allowed) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Determine the role of a user from their LDAP groups. Group names are not case sensitive.
+func LDAPRoleForGroups(groups []string) string {
+	groupRoles := make(map[string]string)
+	for group, role := range app.Config().LDAPGroupRoles {
+		groupRoles[strings.ToLower(group)] = role
+	}
+	var lowerGroups []string
+	for _, group := range groups {
+		lowerGroups = append(lowerGroups, strings.ToLower(group))
+	}
+	return AuthRoleForGroups(lowerGroups, groupRoles, app.Config().LDAPDefaultRole)
+}
+
+// Authenticate a user against LDAP, returning their username as stored in the directory and their groups.
+func LDAPAuthenticate(username, password string) (canonical string, groups []string, err error) {
+	// The configuration is read once, so a reload does not change it part way through.
+	config := app.Config()
+
+	// An empty password is an unauthenticated bind, which most servers accept.
+	if username == "" || password == "" {
+		err = fmt.Errorf("Username and password are required.")
+		return
+	}
+
+	conn, err := LDAPConnect()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// Find the user with the service account.
+	if config.LDAPBindDN != "" {
+		if err = conn.Bind(config.LDAPBindDN, config.LDAPBindPassword); err != nil {
+			err = fmt.Errorf("Unable to bind with service account: %s", err)
+			return
+		}
+	}
+	search := ldap.NewSearchRequest(
+		config.LDAPBaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(config.LDAPUserFilter, ldap.EscapeFilter(username)),
+		[]string{"dn", config.LDAPUsernameAttribute, config.LDAPGroupAttribute},
+		nil,
+	)
+	result, err := conn.Search(search)
+	if err != nil {
+		return
+	}
+	if len(result.Entries) != 1 {
+		err = fmt.Errorf("Found %d users matching %s.", len(result.Entries), username)
+		return
+	}
+	entry := result.Entries[0]
+
+	// Verify the password by binding as the user.
+	if err = conn.Bind(entry.DN, password); err != nil {
+		return
+	}
+
+	canonical = entry.GetAttributeValue(config.LDAPUsernameAttribute)
+	if canonical == "" {
+		canonical = username
+	}
+	for _, group := range entry.GetAttributeValues(config.LDAPGroupAttribute) {
+		groups = append(groups, LDAPGroupNames(group)...)
+	}
+
+	// Search for groups which list the user as a member.
+	if config.LDAPGroupFilter != "" {
+		baseDN := config.LDAPGroupBaseDN
+		if baseDN == "" {
+			baseDN = config.LDAPBaseDN
+		}
+		// Rebind with the service account, as users may not be able to search groups.
+		if config.LDAPBindDN != "" {
+			if err = conn.Bind(config.LDAPBindDN, config.LDAPBindPassword); err != nil {
+				err = fmt.Errorf("Unable to bind with service account: %s", err)
+				return
+			}
+		}
+		search := ldap.NewSearchRequest(
+			baseDN,
+			ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+			fmt.Sprintf(config.LDAPGroupFilter, ldap.EscapeFilter(entry.DN)),
+			[]string{"dn"},
+			nil,
+		)
+		result, err = conn.Search(search)
+		if err != nil {
+			return
+		}
+		for _, group := range result.Entries {
+			groups = append(groups, LDAPGroupNames(group.DN)...)
+		}
+	}
+	return
+}
+
+// Check the login of a user against LDAP, using the cache if the login was recently successful.
+func LDAPCheckPassword(username, password string) (user User, ok bool) {
+	ldapCacheMutex.Lock()
+	entry, cached := ldapCache[username]
+	ldapCacheMutex.Unlock()
+
+	checked := !cached || time.Now().After(entry.Expires) || subtle.ConstantTimeCompare(entry.PasswordHash, ldapCacheHash(password)) != 1
+	if checked {
+		canonical, groups, err := LDAPAuthenticate(username, password)
+		if err != nil {
+			logAuth.Warn("LDAP login failed", "username", username, "error", err)
+			return
+		}
+		entry = ldapCacheEntry{
+			PasswordHash: ldapCacheHash(password),
+			Username:     canonical,
+			Groups:       groups,
+			Expires:      time.Now().Add(app.Config().LDAPCacheTTL * time.Second),
+		}
+	}
+
+	if !LDAPGroupAllowed(entry.Groups) {
+		logAuth.Warn("LDAP login denied as the user is not in an allowed group", "username", entry.Username)
+		return
+	}
+	// Only allowed logins are cached, so a user added to an allowed group can login straight away.
+	if checked && app.Config().LDAPCacheTTL != 0 {
+		ldapCacheMutex.Lock()
+		ldapCache[username] = entry
+		ldapCacheMutex.Unlock()
+	}
+	user, err := AuthLoginExternalUser("", entry.Username, UserSourceLDAP, LDAPRoleForGroups(entry.Groups))
+	if err != nil {
+		logAuth.Warn("LDAP login failed", "username", username, "error", err)
+		return
+	}
+	ok = true
+	return
+}
+
+// Remove expired logins from the cache.
+func LDAPPruneCache() {
+	ldapCacheMutex.Lock()
+	defer ldapCacheMutex.Unlock()
+	now := time.Now()
+	for username, entry := range ldapCache {
+		if now.After(entry.Expires) {
+			delete(ldapCache, username)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+// A directory with a single user, answering binds and searches as an LDAP server does.
+type testDirectory struct {
+	listener net.Listener
+	dn       string
+	password string
+
+	mutex  sync.Mutex
+	groups []string // DNs of the groups the user is a member of.
+	binds  int
+}
+
+func newTestDirectory(t *testing.T) *testDirectory {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := &testDirectory{listener: listener, dn: "uid=jdoe,ou=people,dc=example,dc=com", password: "secret"}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go dir.serve(conn)
+		}
+	}()
+	return dir
+}
+
+func (d *testDirectory) URL() string {
+	return "ldap://" + d.listener.Addr().String()
+}
+
+func (d *testDirectory) setGroups(groups ...string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.groups = groups
+}
+
+func (d *testDirectory) bindCount() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.binds
+}
+
+// Build a response to a request, with the result code and message.
+func testLDAPResult(messageID int64, tag ber.Tag, code int64) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, ""))
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	packet.AppendChild(result)
+	return packet
+}
+
+// Answer the requests of a connection until it is closed.
+func (d *testDirectory) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		messageID, _ := packet.Children[0].Value.(int64)
+		request := packet.Children[1]
+		switch request.Tag {
+		case 0: // Bind request, with the password of the user.
+			d.mutex.Lock()
+			d.binds++
+			d.mutex.Unlock()
+			code := int64(49) // Invalid credentials.
+			if request.Children[1].Value == d.dn && request.Children[2].Data.String() == d.password {
+				code = 0
+			}
+			conn.Write(testLDAPResult(messageID, 1, code).Bytes())
+		case 3: // Search request, which always finds the user.
+			d.mutex.Lock()
+			groups := append([]string{}, d.groups...)
+			d.mutex.Unlock()
+			packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+			packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, ""))
+			entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, 4, nil, "")
+			entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, d.dn, ""))
+			attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+			for name, values := range map[string][]string{"uid": {"jdoe"}, "memberOf": groups} {
+				attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+				attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+				set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+				for _, value := range values {
+					set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, ""))
+				}
+				attribute.AppendChild(set)
+				attributes.AppendChild(attribute)
+			}
+			entry.AppendChild(attributes)
+			packet.AppendChild(entry)
+			conn.Write(packet.Bytes())
+			conn.Write(testLDAPResult(messageID, 5, 0).Bytes())
+		case 2: // Unbind request.
+			return
+		}
+	}
+}
+
+func TestLDAPGroupNames(t *testing.T) {
+	tests := map[string][]string{
+		"cn=Mail Admins,ou=groups,dc=example,dc=com": {"cn=Mail Admins,ou=groups,dc=example,dc=com", "Mail Admins"},
+		"cn=a\\,b,dc=example,dc=com":                 {"cn=a\\,b,dc=example,dc=com", "a,b"},
+		"mail-admins":                                {"mail-admins"},
+		"":                                           {""},
+	}
+	for dn, expected := range tests {
+		names := LDAPGroupNames(dn)
+		if len(names) != len(expected) {
+			t.Errorf("%q has names %q, expected %q", dn, names, expected)
+			continue
+		}
+		for i := range names {
+			if names[i] != expected[i] {
+				t.Errorf("%q has names %q, expected %q", dn, names, expected)
+				break
+			}
+		}
+	}
+}
+
+func TestLDAPGroupAllowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		groups  []string
+		ok      bool
+	}{
+		{"no allowed groups configured", nil, nil, true},
+		{"member of an allowed group", []string{"mail-users"}, []string{"staff", "mail-users"}, true},
+		{"group names are not case sensitive", []string{"Mail-Users"}, []string{"mail-users"}, true},
+		{"allowed by DN", []string{"cn=mail-users,dc=example,dc=com"}, LDAPGroupNames("CN=mail-users,DC=example,DC=com"), true},
+		{"not in an allowed group", []string{"mail-users"}, []string{"staff"}, false},
+		{"in no groups", []string{"mail-users"}, nil, false},
+	}
+	testApp(t)
+	for _, test := range tests {
+		config := *app.Config()
+		config.LDAPAllowedGroups = test.allowed
+		app.SetConfig(config)
+		if ok := LDAPGroupAllowed(test.groups); ok != test.ok {
+			t.Errorf("%s: allowed is %v, expected %v", test.name, ok, test.ok)
+		}
+	}
+}
+
+func TestLDAPRoleForGroups(t *testing.T) {
+	testApp(t)
+	config := *app.Config()
+	config.LDAPGroupRoles = map[string]string{"Mail-Admins": RoleAdmin, "helpdesk": RoleHelpdesk, "cn=auditors,dc=example,dc=com": RoleAuditor}
+	config.LDAPDefaultRole = RoleReadOnly
+	app.SetConfig(config)
+
+	tests := []struct {
+		name   string
+		groups []string
+		role   string
+	}{
+		{"no groups", nil, RoleReadOnly},
+		{"unmapped group", []string{"staff"}, RoleReadOnly},
+		{"group names are not case sensitive", []string{"mail-admins"}, RoleAdmin},
+		{"most access of several groups", []string{"HELPDESK", "mail-admins"}, RoleAdmin},
+		{"mapped by DN", LDAPGroupNames("cn=Auditors,dc=example,dc=com"), RoleAuditor},
+	}
+	for _, test := range tests {
+		if role := LDAPRoleForGroups(test.groups); role != test.role {
+			t.Errorf("%s: role %q, expected %q", test.name, role, test.role)
+		}
+	}
+}
+
+func TestLDAPCheckPasswordCache(t *testing.T) {
+	testApp(t)
+	dir := newTestDirectory(t)
+	dir.setGroups("cn=mail-users,ou=groups,dc=example,dc=com")
+	config := *app.Config()
+	config.AuthEnabled = true
+	config.LDAPURL = dir.URL()
+	config.LDAPBaseDN = "dc=example,dc=com"
+	config.LDAPAllowedGroups = []string{"mail-users"}
+	config.LDAPCacheTTL = 300
+	app.SetConfig(config)
+	ldapCache = make(map[string]ldapCacheEntry)
+	t.Cleanup(func() { ldapCache = make(map[string]ldapCacheEntry) })
+
+	// Make a cached login expire, as if its time to live had passed.
+	expire := func() {
+		ldapCacheMutex.Lock()
+		defer ldapCacheMutex.Unlock()
+		entry := ldapCache["jdoe"]
+		entry.Expires = time.Now().Add(-time.Second)
+		ldapCache["jdoe"] = entry
+	}
+	tests := []struct {
+		name     string
+		change   func()
+		password string
+		ok       bool
+		binds    int // Binds made to the directory by the login.
+	}{
+		{"first login is checked with the directory", func() {}, "secret", true, 1},
+		{"login again is cached", func() {}, "secret", true, 0},
+		{"wrong password is checked with the directory", func() {}, "wrong", false, 1},
+		{"group removed while the login is cached", func() { dir.setGroups() }, "secret", true, 0},
+		{"group removed once the cached login expires", expire, "secret", false, 1},
+		{"denied login is not cached", func() {}, "secret", false, 1},
+		{"group added back", func() { dir.setGroups("cn=mail-users,ou=groups,dc=example,dc=com") }, "secret", true, 1},
+	}
+	for _, test := range tests {
+		test.change()
+		binds := dir.bindCount()
+		user, ok := LDAPCheckPassword("jdoe", test.password)
+		if ok != test.ok || dir.bindCount()-binds != test.binds {
+			t.Errorf("%s: login ok is %v with %d binds, expected %v with %d binds", test.name, ok, dir.bindCount()-binds, test.ok, test.binds)
+		}
+		if ok && (user.Username != "jdoe" || user.Source != UserSourceLDAP) {
+			t.Errorf("%s: logged in as %+v", test.name, user)
+		}
+	}
+
+	// Expired logins are removed from the cache, others are kept.
+	ldapCache["expired"] = ldapCacheEntry{Expires: time.Now().Add(-time.Second)}
+	LDAPPruneCache()
+	if _, ok := ldapCache["expired"]; ok {
+		t.Error("expired login was not pruned")
+	}
+	if _, ok := ldapCache["jdoe"]; !ok {
+		t.Error("valid login was pruned")
+	}
+
+	// Without a time to live, logins are not cached.
+	config.LDAPCacheTTL = 0
+	app.SetConfig(config)
+	ldapCache = make(map[string]ldapCacheEntry)
+	for i := 0; i < 2; i++ {
+		binds := dir.bindCount()
+		if _, ok := LDAPCheckPassword("jdoe", "secret"); !ok || dir.bindCount()-binds != 1 {
+			t.Errorf("login %d without a cache: ok is %v with %d binds", i+1, ok, dir.bindCount()-binds)
+		}
+	}
+	if len(ldapCache) != 0 {
+		t.Errorf("%d logins cached without a time to live", len(ldapCache))
+	}
+}
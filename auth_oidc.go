@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc"
+	"github.com/gorilla/mux"
+	"golang.org/x/oauth2"
+)
+
+// Cookies which hold the state and nonce while the user is at the identity provider.
+const (
+	OIDCStateCookie = "mail_archive_oidc_state"
+	OIDCNonceCookie = "mail_archive_oidc_nonce"
+)
+
+// How long the user has to complete login at the identity provider.
+const OIDCLoginTimeout = 10 * time.Minute
+
+// The provider is discovered on first use, so the identity provider being down does not prevent start up.
+var (
+	oidcProvider      *oidc.Provider
+	oidcProviderMutex sync.Mutex
+)
+
+// Check if OpenID Connect login is configured.
+func OIDCEnabled() bool {
+	return app.Config().AuthEnabled && app.Config().OIDCDiscoveryURL != "" && app.Config().OIDCClientID != ""
+}
+
+// Get the issuer from the discovery URL, which may be the full configuration URL.
+func OIDCIssuer() string {
+	issuer := strings.TrimSuffix(app.Config().OIDCDiscoveryURL, "/.well-known/openid-configuration")
+	return strings.TrimSuffix(issuer, "/")
+}
+
+// Get the provider, discovering it if it has not yet been discovered.
+func OIDCGetProvider() (*oidc.Provider, error) {
+	oidcProviderMutex.Lock()
+	defer oidcProviderMutex.Unlock()
+	if oidcProvider != nil {
+		return oidcProvider, nil
+	}
+	// The provider keeps the context to fetch signing keys later, so it must not be a request context.
+	provider, err := oidc.NewProvider(context.Background(), OIDCIssuer())
+	if err != nil {
+		return nil, err
+	}
+	oidcProvider = provider
+	return oidcProvider, nil
+}
+
+// Forget the provider, so it is discovered again after its configuration is changed.
+func OIDCResetProvider() {
+	oidcProviderMutex.Lock()
+	oidcProvider = nil
+	oidcProviderMutex.Unlock()
+}
+
+// Get the OAuth2 configuration for the provider.
+func OIDCOAuth2Config(provider *oidc.Provider) *oauth2.Config {
+	scopes := []string{oidc.ScopeOpenID, "profile", "email"}
+	scopes = append(scopes, app.Config().OIDCScopes...)
+	return &oauth2.Config{
+		ClientID:     app.Config().OIDCClientID,
+		ClientSecret: app.Config().OIDCClientSecret,
+		RedirectURL:  app.Config().OIDCRedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       scopes,
+	}
+}
+
+// Set a short lived cookie used during login.
+func OIDCSetCookie(w http.ResponseWriter, name, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/api/auth/oidc/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   app.Config().AuthSecureCookie,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Read a claim which may either be a string or a list of strings.
+func OIDCClaimStrings(claims map[string]interface{}, name string) (values []string) {
+	switch v := claims[name].(type) {
+	case string:
+		values = append(values, v)
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	return
+}
+
+// Check if the user is in one of the allowed groups.
+func OIDCGroupAllowed(groups []string) bool {
+	if len(app.Config().OIDCAllowedGroups) == 0 {
+		return true
+	}
+	for _, allowed := range app.Config().OIDCAllowedGroups {
+		for _, group := range groups {
+			if group == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Setup HTTP router with routes for OpenID Connect login.
+func (s *HTTPServer) RegisterOIDCRoutes(api *mux.Router) {
+	// Redirect the user to the identity provider.
+	api.HandleFunc("/auth/oidc/login", func(w http.ResponseWriter, r *http.Request) {
+		if !OIDCEnabled() {
+			s.APISendGeneralResp(w, APIERR, "SSO is not enabled.")
+			return
+		}
+		provider, err := OIDCGetProvider()
+		if err != nil {
+			LogRequest(logAuth, r).Error("Unable to discover OIDC provider", "error", err)
+			s.APISendGeneralResp(w, APIERR, "Unable to contact the identity provider.")
+			return
+		}
+
+		// The state protects against forged callbacks, and the nonce against replayed tokens.
+		state, err := AuthGenerateToken()
+		if err != nil {
+			s.APISendGeneralResp(w, APIERR, "Unable to generate state.")
+			return
+		}
+		nonce, err := AuthGenerateToken()
+		if err != nil {
+			s.APISendGeneralResp(w, APIERR, "Unable to generate nonce.")
+			return
+		}
+		OIDCSetCookie(w, OIDCStateCookie, state, int(OIDCLoginTimeout.Seconds()))
+		OIDCSetCookie(w, OIDCNonceCookie, nonce, int(OIDCLoginTimeout.Seconds()))
+
+		http.Redirect(w, r, OIDCOAuth2Config(provider).AuthCodeURL(state, oidc.Nonce(nonce)), http.StatusFound)
+	}).Methods("GET")
+
+	// The identity provider sends the user back here after login.
+	api.HandleFunc("/auth/oidc/callback", func(w http.ResponseWriter, r *http.Request) {
+		if !OIDCEnabled() {
+			s.APISendGeneralResp(w, APIERR, "SSO is not enabled.")
+			return
+		}
+		// The login cookies are only good for one attempt.
+		stateCookie, stateErr := r.Cookie(OIDCStateCookie)
+		nonceCookie, nonceErr := r.Cookie(OIDCNonceCookie)
+		OIDCSetCookie(w, OIDCStateCookie, "", -1)
+		OIDCSetCookie(w, OIDCNonceCookie, "", -1)
+
+		if errMsg := r.URL.Query().Get("error"); errMsg != "" {
+			s.JSONResponseCode(w, http.StatusUnauthorized, APIGeneralResp{Status: APIERR, Error: "Identity provider returned an error: " + errMsg})
+			return
+		}
+		if stateErr != nil || nonceErr != nil || stateCookie.Value == "" || stateCookie.Value != r.URL.Query().Get("state") {
+			s.JSONResponseCode(w, http.StatusBadRequest, APIGeneralResp{Status: APIERR, Error: "Invalid login state."})
+			return
+		}
+
+		provider, err := OIDCGetProvider()
+		if err != nil {
+			LogRequest(logAuth, r).Error("Unable to discover OIDC provider", "error", err)
+			s.APISendGeneralResp(w, APIERR, "Unable to contact the identity provider.")
+			return
+		}
+
+		// Exchange the code for tokens, and verify the ID token.
+		oauth2Token, err := OIDCOAuth2Config(provider).Exchange(r.Context(), r.URL.Query().Get("code"))
+		if err != nil {
+			LogRequest(logAuth, r).Warn("OIDC code exchange failed", "error", err)
+			s.JSONResponseCode(w, http.StatusUnauthorized, APIGeneralResp{Status: APIERR, Error: "Unable to complete login."})
+			return
+		}
+		rawIDToken, ok := oauth2Token.Extra("id_token").(string)
+		if !ok {
+			s.JSONResponseCode(w, http.StatusUnauthorized, APIGeneralResp{Status: APIERR, Error: "No ID token was provided."})
+			return
+		}
+		idToken, err := provider.Verifier(&oidc.Config{ClientID: app.Config().OIDCClientID}).Verify(r.Context(), rawIDToken)
+		if err != nil {
+			LogRequest(logAuth, r).Warn("OIDC ID token verification failed", "error", err)
+			s.JSONResponseCode(w, http.StatusUnauthorized, APIGeneralResp{Status: APIERR, Error: "Invalid ID token."})
+			return
+		}
+		if idToken.Nonce != nonceCookie.Value {
+			s.JSONResponseCode(w, http.StatusUnauthorized, APIGeneralResp{Status: APIERR, Error: "Invalid ID token nonce."})
+			return
+		}
+		if idToken.Subject == "" {
+			s.JSONResponseCode(w, http.StatusUnauthorized, APIGeneralResp{Status: APIERR, Error: "ID token has no subject."})
+			return
+		}
+
+		// Read the username and groups from the claims.
+		// The username may be changed at the identity provider, so is only used for display, while the issuer and subject identify the user.
+		claims := make(map[string]interface{})
+		if err := idToken.Claims(&claims); err != nil {
+			s.JSONResponseCode(w, http.StatusUnauthorized, APIGeneralResp{Status: APIERR, Error: "Unable to read ID token claims."})
+			return
+		}
+		usernames := OIDCClaimStrings(claims, app.Config().OIDCUsernameClaim)
+		if len(usernames) == 0 || usernames[0] == "" {
+			s.JSONResponseCode(w, http.StatusUnauthorized, APIGeneralResp{Status: APIERR, Error: "ID token has no " + app.Config().OIDCUsernameClaim + " claim."})
+			return
+		}
+		groups := OIDCClaimStrings(claims, app.Config().OIDCGroupsClaim)
+		if !OIDCGroupAllowed(groups) {
+			LogRequest(logAuth, r).Warn("OIDC login denied as the user is not in an allowed group", "username", usernames[0])
+			s.JSONResponseCode(w, http.StatusForbidden, APIGeneralResp{Status: APIERR, Error: "You are not in a group allowed to login."})
+			return
+		}
+
+		role := AuthRoleForGroups(groups, app.Config().OIDCGroupRoles, app.Config().OIDCDefaultRole)
+		user, err := AuthLoginExternalUser(idToken.Issuer+" "+idToken.Subject, usernames[0], UserSourceOIDC, role)
+		if err != nil {
+			s.JSONResponseCode(w, http.StatusForbidden, APIGeneralResp{Status: APIERR, Error: err.Error()})
+			return
+		}
+		if _, err := AuthStartSession(w, user); err != nil {
+			s.APISendGeneralResp(w, APIERR, "Unable to start session.")
+			return
+		}
+		http.Redirect(w, r, "/", http.StatusFound)
+	}).Methods("GET")
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// An identity provider which issues ID tokens with the claims set by a test.
+type testIdentityProvider struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	claims map[string]interface{}
+}
+
+func newTestIdentityProvider(t *testing.T) *testIdentityProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &testIdentityProvider{key: key}
+	encode := base64.RawURLEncoding.EncodeToString
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                idp.URL,
+			"authorization_endpoint":                idp.URL + "/authorize",
+			"token_endpoint":                        idp.URL + "/token",
+			"jwks_uri":                              idp.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"alg": "RS256",
+				"use": "sig",
+				"kid": "test",
+				"n":   encode(key.N.Bytes()),
+				"e":   encode(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+		payload, _ := json.Marshal(idp.claims)
+		signed := encode(header) + "." + encode(payload)
+		sum := sha256.Sum256([]byte(signed))
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+		if err != nil {
+			t.Error(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     signed + "." + encode(signature),
+		})
+	})
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+// Set the claims of the next ID token issued.
+func (idp *testIdentityProvider) issue(subject, username, nonce string, groups ...string) {
+	idp.claims = map[string]interface{}{
+		"iss":                idp.URL,
+		"aud":                "mail-archive",
+		"sub":                subject,
+		"preferred_username": username,
+		"groups":             groups,
+		"nonce":              nonce,
+		"iat":                time.Now().Unix(),
+		"exp":                time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func TestOIDCCallback(t *testing.T) {
+	testApp(t)
+	idp := newTestIdentityProvider(t)
+	config := *app.Config()
+	config.AuthEnabled = true
+	config.OIDCDiscoveryURL = idp.URL
+	config.OIDCClientID = "mail-archive"
+	config.OIDCClientSecret = "secret"
+	config.OIDCRedirectURL = "http://archive.example.com/api/auth/oidc/callback"
+	config.OIDCAllowedGroups = []string{"mail"}
+	app.SetConfig(config)
+	OIDCResetProvider()
+	t.Cleanup(OIDCResetProvider)
+	r := testRouter()
+
+	// Complete login with the state and nonce cookies, and the state returned by the identity provider.
+	callback := func(stateCookie, nonceCookie, state string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/auth/oidc/callback?code=code&state="+url.QueryEscape(state), nil)
+		if stateCookie != "" {
+			req.AddCookie(&http.Cookie{Name: OIDCStateCookie, Value: stateCookie})
+		}
+		if nonceCookie != "" {
+			req.AddCookie(&http.Cookie{Name: OIDCNonceCookie, Value: nonceCookie})
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	tests := []struct {
+		name        string
+		subject     string
+		username    string
+		nonce       string
+		groups      []string
+		stateCookie string
+		state       string
+		code        int
+		userID      int64 // Of the user logged in, if login succeeds.
+	}{
+		{"no state cookie", "1", "alice", "nonce", []string{"mail"}, "", "state", http.StatusBadRequest, 0},
+		{"state mismatch", "1", "alice", "nonce", []string{"mail"}, "state", "forged", http.StatusBadRequest, 0},
+		{"nonce mismatch", "1", "alice", "replayed", []string{"mail"}, "state", "state", http.StatusUnauthorized, 0},
+		{"not in an allowed group", "1", "alice", "nonce", []string{"other"}, "state", "state", http.StatusForbidden, 0},
+		{"first login", "1", "alice", "nonce", []string{"mail"}, "state", "state", http.StatusFound, 1},
+		{"username changed", "1", "alice.smith", "nonce", []string{"mail"}, "state", "state", http.StatusFound, 1},
+		{"another subject with a taken username", "2", "alice.smith", "nonce", []string{"mail"}, "state", "state", http.StatusForbidden, 0},
+		{"another subject", "2", "alice", "nonce", []string{"mail"}, "state", "state", http.StatusFound, 2},
+	}
+	for _, test := range tests {
+		idp.issue(test.subject, test.username, test.nonce, test.groups...)
+		sessions := 0
+		app.db.Model(&Session{}).Count(&sessions)
+
+		w := callback(test.stateCookie, "nonce", test.state)
+		if w.Code != test.code {
+			t.Errorf("%s: responded with %d, expected %d: %s", test.name, w.Code, test.code, w.Body.String())
+			continue
+		}
+
+		newSessions := 0
+		app.db.Model(&Session{}).Count(&newSessions)
+		if test.userID == 0 {
+			if newSessions != sessions {
+				t.Errorf("%s: a session was started", test.name)
+			}
+			continue
+		}
+		var user User
+		app.db.Where("username = ?", test.username).First(&user)
+		if user.ID != test.userID || user.Source != UserSourceOIDC || user.ExternalID != idp.URL+" "+test.subject {
+			t.Errorf("%s: logged in as %+v, expected user %d", test.name, user, test.userID)
+		}
+		if newSessions != sessions+1 {
+			t.Errorf("%s: no session was started", test.name)
+		}
+	}
+
+	// A local user is not taken over by a new identity with the same username.
+	if _, err := AuthCreateUser("bob", "password", RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	idp.issue("3", "bob", "nonce", "mail")
+	if w := callback("state", "nonce", "state"); w.Code != http.StatusForbidden {
+		t.Errorf("login as a local user responded with %d, expected %d", w.Code, http.StatusForbidden)
+	}
+}
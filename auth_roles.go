@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Roles a user may have, in order of most to least access.
+const (
+	RoleAdmin    = "admin"
+	RoleAuditor  = "auditor"
+	RoleHelpdesk = "helpdesk"
+	RoleReadOnly = "read-only"
+)
+
+// All roles, in order of most to least access.
+var AuthRoles = []string{RoleAdmin, RoleAuditor, RoleHelpdesk, RoleReadOnly}
+
+// Permissions granted by roles.
+const (
+	PermReadMessages    = "read_messages"
+	PermReportSpam      = "report_spam"
+	PermViewDiagnostics = "view_diagnostics"
+	PermManageUsers     = "manage_users"
+	PermViewAudit       = "view_audit"
+	PermDeleteMessages  = "delete_messages" // Delete or redact messages.
+	PermHoldMessages    = "hold_messages"   // Place or release legal holds.
+	PermDataSubject     = "data_subject"    // Export or erase everything involving an address.
+	PermExportMessages  = "export_messages" // Export messages matching a search in bulk.
+	PermManageConfig    = "manage_config"   // Reload the configuration.
+)
+
+// Permissions of each role.
+var AuthRolePermissions = map[string][]string{
+	RoleAdmin:    {PermReadMessages, PermReportSpam, PermViewDiagnostics, PermManageUsers, PermViewAudit, PermDeleteMessages, PermHoldMessages, PermDataSubject, PermExportMessages, PermManageConfig},
+	RoleAuditor:  {PermReadMessages, PermViewDiagnostics, PermViewAudit, PermHoldMessages, PermExportMessages},
+	RoleHelpdesk: {PermReadMessages, PermReportSpam},
+	RoleReadOnly: {PermReadMessages},
+}
+
+// Roles which see every message when they have no scopes. Other roles must have scopes to see any messages.
+var AuthUnscopedRoles = []string{RoleAdmin, RoleAuditor}
+
+// Permissions which are not granted when authentication is not enabled, as what they do cannot be undone.
+var AuthLoginPermissions = []string{PermDeleteMessages, PermHoldMessages, PermDataSubject, PermManageConfig}
+
+// Message returned when a user lacks a permission.
+const AuthPermissionDenied = "You do not have permission to do that."
+
+// Domains in a scope may only contain these characters, as they are matched with LIKE.
+var rxAuthScopeDomain = regexp.MustCompile(`^[a-z0-9.-]+$`)
+
+// Check if a role is one we know about.
+func AuthValidRole(role string) bool {
+	for _, r := range AuthRoles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Determine the role of a user from their groups in an external directory.
+// If the user is in multiple mapped groups, the role with the most access is used.
+func AuthRoleForGroups(groups []string, groupRoles map[string]string, defaultRole string) string {
+	for _, role := range AuthRoles {
+		for _, group := range groups {
+			if groupRoles[group] == role {
+				return role
+			}
+		}
+	}
+	return defaultRole
+}
+
+// Check if a user has a permission. When authentication is not enabled there is no user,
+// and everything is permitted except what requires a login.
+func AuthHasPermission(user *User, perm string) bool {
+	if user == nil {
+		for _, p := range AuthLoginPermissions {
+			if p == perm {
+				return false
+			}
+		}
+		return true
+	}
+	for _, p := range AuthRolePermissions[user.Role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// Wrap a handler so that it requires a permission.
+func (s *HTTPServer) AuthRequire(perm string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !AuthHasPermission(AuthRequestUser(r), perm) {
+			s.APIErrorResponse(w, r, http.StatusForbidden, AuthPermissionDenied)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// Normalize a scope, which is either an email address or a domain.
+func AuthNormalizeScope(scope string) (string, error) {
+	scope = strings.ToLower(strings.TrimSpace(scope))
+	// A domain may be provided as @example.com.
+	scope = strings.TrimPrefix(scope, "@")
+	if scope == "" {
+		return "", fmt.Errorf("Scope cannot be blank.")
+	}
+	domain := scope
+	if i := strings.LastIndex(scope, "@"); i != -1 {
+		domain = scope[i+1:]
+	}
+	if !rxAuthScopeDomain.MatchString(domain) {
+		return "", fmt.Errorf("Invalid scope %s.", scope)
+	}
+	return scope, nil
+}
+
+// Load the scopes of a user.
+func AuthLoadScopes(user *User) {
+	var scopes []UserScope
+	app.db.Where("user_id = ?", user.ID).Order("scope").Find(&scopes)
+	user.Scopes = []string{}
+	for _, scope := range scopes {
+		user.Scopes = append(user.Scopes, scope.Scope)
+	}
+}
+
+// Replace the scopes of a user.
+func AuthSetScopes(user *User, scopes []string) error {
+	var normalized []string
+	for _, scope := range scopes {
+		if strings.TrimSpace(scope) == "" {
+			continue
+		}
+		scope, err := AuthNormalizeScope(scope)
+		if err != nil {
+			return err
+		}
+		normalized = append(normalized, scope)
+	}
+
+	app.db.Where("user_id = ?", user.ID).Delete(UserScope{})
+	for _, scope := range normalized {
+		app.db.Create(&UserScope{UserID: user.ID, Scope: scope})
+	}
+	AuthLoadScopes(user)
+	return nil
+}
+
+// Check if an address is within a scope.
+func AuthAddressInScope(address, scope string) bool {
+	address = strings.ToLower(address)
+	if strings.Contains(scope, "@") {
+		return address == scope
+	}
+	return strings.HasSuffix(address, "@"+scope)
+}
+
+// Check if a user sees every message, either as authentication is not enabled or as their role is not limited to scopes.
+func AuthUnscoped(user *User) bool {
+	if user == nil {
+		return true
+	}
+	if len(user.Scopes) != 0 {
+		return false
+	}
+	for _, role := range AuthUnscopedRoles {
+		if user.Role == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if a message is visible to a user. Scopes are matched against every address recorded for the message,
+// including cc recipients, along with the from and to address of messages received before addresses were recorded.
+func AuthMessageInScope(user *User, entry MessageLog) bool {
+	if AuthUnscoped(user) {
+		return true
+	}
+	return AuthAddressesInScope(user, AuthMessageAddresses(entry))
+}
+
+// Every address of a message which scopes are matched against.
+func AuthMessageAddresses(entry MessageLog) []string {
+	addresses := []string{entry.From, entry.To}
+	var recorded []string
+	app.db.Model(&MessageAddress{}).Where("uuid = ?", entry.UUID).Pluck("address", &recorded)
+	return append(addresses, recorded...)
+}
+
+// Check if any of the addresses of a message are within the scopes of a user.
+func AuthAddressesInScope(user *User, addresses []string) bool {
+	if AuthUnscoped(user) {
+		return true
+	}
+	for _, scope := range user.Scopes {
+		for _, address := range addresses {
+			if AuthAddressInScope(address, scope) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Count the messages visible to a user.
+func AuthMessageCount(user *User) uint {
+	if AuthUnscoped(user) {
+		return app.messageCount
+	}
+	var count uint
+	AuthScopeFilter(app.db.Model(&MessageLog{}), user).Count(&count)
+	return count
+}
+
+// Limit a message log query to the messages visible to a user.
+// Users with a role limited to scopes see no messages until they are given scopes.
+func AuthScopeFilter(db *gorm.DB, user *User) *gorm.DB {
+	if AuthUnscoped(user) {
+		return db
+	}
+	if len(user.Scopes) == 0 {
+		return db.Where("1 = 0")
+	}
+	var queries, addressQueries []string
+	var statements, addressStatements []interface{} // Must be an interface to expand to arguments in a function call.
+	for _, scope := range user.Scopes {
+		if strings.Contains(scope, "@") {
+			queries = append(queries, "LOWER(`from`) = ? OR LOWER(`to`) = ?")
+			statements = append(statements, scope, scope)
+			addressQueries = append(addressQueries, "address = ?")
+			addressStatements = append(addressStatements, scope)
+		} else {
+			queries = append(queries, "LOWER(`from`) LIKE ? OR LOWER(`to`) LIKE ?")
+			statements = append(statements, "%@"+scope, "%@"+scope)
+			addressQueries = append(addressQueries, "address LIKE ?")
+			addressStatements = append(addressStatements, "%@"+scope)
+		}
+	}
+	// Addresses are recorded in lowercase, so they are compared without LOWER.
+	addresses := app.db.Table("message_addresses").Select("uuid").Where(strings.Join(addressQueries, " OR "), addressStatements...)
+	queries = append(queries, "uuid IN ?")
+	statements = append(statements, addresses.SubQuery())
+	return db.Where("("+strings.Join(queries, " OR ")+")", statements...)
+}
+
+// Find a message log entry visible to the user of a request.
+// Messages outside of the user's scopes are treated as not found, so their existence is not revealed.
+func AuthFindMessage(r *http.Request, UUID string) (entry MessageLog) {
+	if UUID == "" {
+		return
+	}
+	user := AuthRequestUser(r)
+	app.db.Where("uuid = ?", UUID).First(&entry)
+	if entry.UUID != "" && !AuthMessageInScope(user, entry) {
+		entry = MessageLog{}
+	}
+	return
+}
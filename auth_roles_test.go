@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+func TestAuthScopes(t *testing.T) {
+	testApp(t)
+	app.db.Create(&MessageLog{UUID: "1", From: "a@brand-a.com", To: "b@example.com"})
+	app.db.Create(&MessageAddress{UUID: "1", Address: "a@brand-a.com", Field: "from"})
+	app.db.Create(&MessageAddress{UUID: "1", Address: "b@example.com", Field: "to"})
+	app.db.Create(&MessageAddress{UUID: "1", Address: "support@brand-b.com", Field: "cc"})
+	app.db.Create(&MessageLog{UUID: "2", From: "c@example.com", To: "d@example.com"})
+
+	tests := []struct {
+		name     string
+		user     *User
+		expected []string
+	}{
+		{"no authentication", nil, []string{"1", "2"}},
+		{"admin without scopes", &User{Role: RoleAdmin}, []string{"1", "2"}},
+		{"auditor without scopes", &User{Role: RoleAuditor}, []string{"1", "2"}},
+		{"helpdesk without scopes", &User{Role: RoleHelpdesk}, []string{}},
+		{"read-only without scopes", &User{Role: RoleReadOnly}, []string{}},
+		{"domain of from address", &User{Role: RoleReadOnly, Scopes: []string{"brand-a.com"}}, []string{"1"}},
+		{"cc address", &User{Role: RoleReadOnly, Scopes: []string{"support@brand-b.com"}}, []string{"1"}},
+		{"cc domain", &User{Role: RoleHelpdesk, Scopes: []string{"brand-b.com"}}, []string{"1"}},
+		{"to address", &User{Role: RoleHelpdesk, Scopes: []string{"b@example.com"}}, []string{"1"}},
+		{"admin with scopes", &User{Role: RoleAdmin, Scopes: []string{"example.com"}}, []string{"1", "2"}},
+		{"unrelated scope", &User{Role: RoleReadOnly, Scopes: []string{"brand-c.com"}}, []string{}},
+	}
+	for _, test := range tests {
+		UUIDs := []string{}
+		AuthScopeFilter(app.db.Model(&MessageLog{}), test.user).Order("uuid").Pluck("uuid", &UUIDs)
+		if len(UUIDs) != len(test.expected) {
+			t.Errorf("%s: filter found %v, expected %v", test.name, UUIDs, test.expected)
+			continue
+		}
+		for i := range UUIDs {
+			if UUIDs[i] != test.expected[i] {
+				t.Errorf("%s: filter found %v, expected %v", test.name, UUIDs, test.expected)
+				break
+			}
+		}
+
+		// Checking a single message must agree with the filter.
+		for _, UUID := range []string{"1", "2"} {
+			var entry MessageLog
+			app.db.Where("uuid = ?", UUID).First(&entry)
+			inFilter := false
+			for _, found := range UUIDs {
+				inFilter = inFilter || found == UUID
+			}
+			if AuthMessageInScope(test.user, entry) != inFilter {
+				t.Errorf("%s: message %s in scope is %t, expected %t", test.name, UUID, !inFilter, inFilter)
+			}
+		}
+	}
+}
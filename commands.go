@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DusanKasan/parsemail"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/urfave/cli"
+)
+
+// Check the configuration, database, storage and listener ports, reporting every problem found.
+func ConfigTestCommand(c *cli.Context) error {
+	app = new(App)
+	app.context = c
+	failed := 0
+	check := func(name string, err error) {
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL %s: %s\n", name, err)
+			return
+		}
+		fmt.Printf("OK   %s\n", name)
+	}
+
+	// Every problem with the configuration is reported, and nothing else can be checked without it.
+	file, err := ConfigFind(c)
+	if err == nil {
+		var config Config
+		config, err = ConfigLoad(file)
+		app.SetConfig(config)
+	}
+	check("configuration", err)
+	if err != nil {
+		return fmt.Errorf("%d checks failed.", failed)
+	}
+
+	// The database must be reachable. Tables are not created, so nothing is changed.
+	db, err := gorm.Open(app.Config().DBType, app.Config().DBConnection)
+	if err == nil {
+		err = db.DB().Ping()
+		db.Close()
+	}
+	check("database", err)
+
+	// Directories written to must exist and be writable.
+	if app.Config().MailPath != "db" {
+		check("mail_path", commandCheckWritable(app.Config().MailPath))
+	}
+	check("export_path", commandCheckWritable(app.Config().ExportPath))
+	if _, err := os.Stat(app.Config().StaticContentPath); err != nil {
+		check("static_content_path", err)
+	}
+
+	// Ports must be free, unless this is checked alongside a running server.
+	if !c.Bool("skip-ports") {
+		check("http port", commandCheckListen("tcp", app.Config().HTTPBindAddr, app.Config().HTTPPort, "http-bind", "http-port"))
+		check("smtp port", commandCheckListen("tcp", app.Config().SMTPBindAddr, app.Config().SMTPPort, "smtp-bind", "smtp-port"))
+		if app.Config().SysLogTCP {
+			check("syslog tcp port", commandCheckListen("tcp", app.Config().SysLogBindAddr, app.Config().SysLogPort, "syslog-bind", "syslog-port"))
+		}
+		if app.Config().SysLogUDP {
+			check("syslog udp port", commandCheckListen("udp", app.Config().SysLogBindAddr, app.Config().SysLogPort, "syslog-bind", "syslog-port"))
+		}
+	}
+
+	// Every API route must be described in the OpenAPI document.
+	r := mux.NewRouter()
+	(&HTTPServer{}).RegisterAPIRoutes(r)
+	check("openapi", commandProblems(OpenAPICheckRoutes(r)))
+
+	if failed != 0 {
+		return fmt.Errorf("%d checks failed.", failed)
+	}
+	return nil
+}
+
+// Combine problems found into one error.
+func commandProblems(problems []string) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(problems, "; "))
+}
+
+// Check that a directory exists and a file can be created in it.
+func commandCheckWritable(dir string) error {
+	fp, err := ioutil.TempFile(dir, ".config-test-")
+	if err != nil {
+		return err
+	}
+	fp.Close()
+	return os.Remove(fp.Name())
+}
+
+// Check that a port is free to listen on, with the command line flags taking priority over the configuration.
+// The flags are global, so they are read from the main command even when checked by a subcommand.
+func commandCheckListen(network string, bindAddr string, port uint, bindFlag string, portFlag string) error {
+	if app.context.GlobalString(bindFlag) != "" {
+		bindAddr = app.context.GlobalString(bindFlag)
+	}
+	if app.context.GlobalUint(portFlag) != 0 {
+		port = app.context.GlobalUint(portFlag)
+	}
+	addr := fmt.Sprintf("%s:%d", bindAddr, port)
+	if network == "udp" {
+		conn, err := net.ListenPacket(network, addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return listener.Close()
+}
+
+// Print statistics about the archive.
+func StatsCommand(c *cli.Context) error {
+	appSetup(c)
+
+	var oldest, newest MessageLog
+	app.db.Order("received").First(&oldest)
+	app.db.Order("received desc").First(&newest)
+	var statuses []struct {
+		Status string
+		Count  int
+	}
+	app.db.Model(&MessageLog{}).Select("status, count(*) as count").Group("status").Order("status").Scan(&statuses)
+	var held, redacted, users, sysLogMessages, unmatched, audit int
+	app.db.Model(&MessageLog{}).Where("hold = ?", true).Count(&held)
+	app.db.Model(&MessageLog{}).Where("redacted = ?", true).Count(&redacted)
+	app.db.Model(&User{}).Count(&users)
+	app.db.Model(&SysLogMessage{}).Count(&sysLogMessages)
+	app.db.Model(&SysLogUnmatched{}).Count(&unmatched)
+	app.db.Model(&AuditLog{}).Count(&audit)
+
+	fmt.Printf("Messages:          %d\n", app.messageCount)
+	for _, status := range statuses {
+		fmt.Printf("  %-16s %d\n", status.Status+":", status.Count)
+	}
+	fmt.Printf("Held:              %d\n", held)
+	fmt.Printf("Redacted:          %d\n", redacted)
+	if oldest.UUID != "" {
+		fmt.Printf("Oldest:            %s\n", oldest.Received.Format(time.RFC3339))
+		fmt.Printf("Newest:            %s\n", newest.Received.Format(time.RFC3339))
+	}
+	fmt.Printf("Storage size:      %d bytes\n", MailStorageSize())
+	fmt.Printf("Syslog messages:   %d\n", sysLogMessages)
+	fmt.Printf("Unmatched syslog:  %d\n", unmatched)
+	fmt.Printf("Users:             %d\n", users)
+	fmt.Printf("Audit log entries: %d\n", audit)
+	return nil
+}
+
+// Parse an age such as 30d or 12h.
+func commandParseAge(value string) (time.Duration, error) {
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil || days <= 0 {
+			return 0, fmt.Errorf("Invalid age: %s", value)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	age, err := time.ParseDuration(value)
+	if err != nil || age <= 0 {
+		return 0, fmt.Errorf("Invalid age: %s", value)
+	}
+	return age, nil
+}
+
+// Flags for the purge command.
+func purgeFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "older-than",
+			Usage: "Remove messages received more than `AGE` ago, such as 90d or 36h",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Only count the messages which would be removed",
+		},
+	}
+}
+
+// Remove messages older than an age, as the cleanup does with max_age. Messages under legal hold are kept.
+func PurgeCommand(c *cli.Context) error {
+	if c.String("older-than") == "" {
+		return fmt.Errorf("An age must be provided with --older-than.")
+	}
+	age, err := commandParseAge(c.String("older-than"))
+	if err != nil {
+		return err
+	}
+	appSetup(c)
+
+	var messageIDs []struct {
+		UUID      string
+		MessageID string
+	}
+	var held int
+	maxAge := time.Now().Add(age * -1)
+	app.db.Model(&MessageLog{}).Where("received <= ? AND hold = ?", maxAge, true).Count(&held)
+	app.db.Table("message_logs").Select("uuid,message_id").Where("received <= ? AND hold = ?", maxAge, false).Scan(&messageIDs)
+	if c.Bool("dry-run") {
+		logApp.Info("Would remove messages", "messages", len(messageIDs), "received_before", maxAge, "held", held)
+		return nil
+	}
+
+	detail := "purge older than " + c.String("older-than")
+	for _, message := range messageIDs {
+		MailDeleteMessage(message.UUID, message.MessageID)
+		AuditRecord(nil, AuditActionDelete, message.UUID, detail, AuditOutcomeSuccess)
+	}
+	logApp.Info("Removed messages", "messages", len(messageIDs), "received_before", maxAge, "held", held)
+	return nil
+}
+
+// Rebuild the addresses and hashes of messages from their stored source, and update the status of messages from syslog.
+// Messages received before addresses were recorded can then be found by any address in their headers.
+func ReindexCommand(c *cli.Context) error {
+	appSetup(c)
+
+	var UUIDs []string
+	app.db.Model(&MessageLog{}).Order("received").Pluck("uuid", &UUIDs)
+	failed := 0
+	for n, UUID := range UUIDs {
+		err := func() error {
+			reader, err := MailGetMessageData(UUID)
+			if err != nil {
+				return err
+			}
+			b, err := ioutil.ReadAll(reader)
+			// If we need to close after reading, close now.
+			if x, ok := reader.(io.Closer); ok {
+				x.Close()
+			}
+			if err != nil {
+				return err
+			}
+			email, err := parsemail.Parse(bytes.NewReader(b))
+			if err != nil {
+				return err
+			}
+
+			// The envelope is only known when a message is received, so those addresses are kept.
+			app.db.Where("uuid = ? AND field NOT IN (?)", UUID, []string{"envelope_from", "envelope_to"}).Delete(MessageAddress{})
+			for _, address := range MailMessageAddresses("", nil, email) {
+				address.UUID = UUID
+				app.db.Create(&address)
+			}
+			// Redacted messages keep the hash of the message as received.
+			app.db.Model(&MessageLog{}).Where("uuid = ? AND hash = ?", UUID, "").Update("hash", MailHash(b))
+			return nil
+		}()
+		if err != nil {
+			failed++
+			logApp.Error("Unable to reindex", "uuid", UUID, "error", err)
+		}
+		if (n+1)%1000 == 0 {
+			logApp.Info("Reindexing", "done", n+1, "total", len(UUIDs))
+		}
+	}
+	SysLogReconcileUnknownMessages()
+	logApp.Info("Reindexed messages", "messages", len(UUIDs)-failed, "failed", failed)
+	return nil
+}
+
+// Read a password from the flag, or the first line of standard input.
+func commandPassword(c *cli.Context) (string, error) {
+	if c.String("password") != "" {
+		return c.String("password"), nil
+	}
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(password, "\r\n"), nil
+}
+
+// Find a user by username.
+func commandFindUser(username string) (user User, err error) {
+	app.db.Where("username = ?", username).First(&user)
+	if user.ID == 0 {
+		err = fmt.Errorf("User %s was not found.", username)
+	}
+	return
+}
+
+// Commands for managing users.
+func userCommands() []cli.Command {
+	passwordFlag := cli.StringFlag{
+		Name:  "password, p",
+		Usage: "Set the password to `PASSWORD`, otherwise it is read from standard input",
+	}
+	return []cli.Command{
+		{
+			Name:      "add",
+			Usage:     "Create a local user.",
+			ArgsUsage: "USERNAME",
+			Flags: []cli.Flag{
+				passwordFlag,
+				cli.StringFlag{
+					Name:  "role, r",
+					Value: RoleReadOnly,
+					Usage: "Give the user `ROLE`, either admin, auditor, helpdesk or read-only",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 1 {
+					return fmt.Errorf("A username must be provided.")
+				}
+				password, err := commandPassword(c)
+				if err != nil {
+					return err
+				}
+				appSetup(c)
+				user, err := AuthCreateUser(c.Args().First(), password, c.String("role"))
+				if err != nil {
+					return err
+				}
+				logApp.Info("Created user", "username", user.Username, "role", user.Role)
+				return nil
+			},
+		},
+		{
+			Name:      "del",
+			Usage:     "Delete a user along with their sessions, API tokens and scopes.",
+			ArgsUsage: "USERNAME",
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 1 {
+					return fmt.Errorf("A username must be provided.")
+				}
+				appSetup(c)
+				user, err := commandFindUser(c.Args().First())
+				if err != nil {
+					return err
+				}
+				AuthDeleteUser(user)
+				logApp.Info("Deleted user", "username", user.Username)
+				return nil
+			},
+		},
+		{
+			Name:      "passwd",
+			Usage:     "Set the password of a local user, ending their sessions.",
+			ArgsUsage: "USERNAME",
+			Flags:     []cli.Flag{passwordFlag},
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 1 {
+					return fmt.Errorf("A username must be provided.")
+				}
+				appSetup(c)
+				user, err := commandFindUser(c.Args().First())
+				if err != nil {
+					return err
+				}
+				// Users of an external directory change their password there.
+				if user.Source != UserSourceLocal {
+					return fmt.Errorf("The password of %s is managed by %s.", user.Username, user.Source)
+				}
+				password, err := commandPassword(c)
+				if err != nil {
+					return err
+				}
+				if err := AuthSetPassword(&user, password, ""); err != nil {
+					return err
+				}
+				logApp.Info("Changed password", "username", user.Username)
+				return nil
+			},
+		},
+	}
+}
+
+// Flags for the get command.
+func getFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "output, o",
+			Usage: "Write the message to `FILE` instead of standard output",
+		},
+	}
+}
+
+// Print the original source of a stored message. Downloads are recorded in the audit log.
+func GetCommand(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("A message UUID must be provided.")
+	}
+	UUID := c.Args().First()
+	appSetup(c)
+
+	var messageEntry MessageLog
+	app.db.Where("uuid = ?", UUID).First(&messageEntry)
+	reader, err := MailGetMessageData(UUID)
+	if messageEntry.UUID == "" || err != nil {
+		AuditRecord(nil, AuditActionDownload, UUID, "eml", AuditOutcomeNotFound)
+		return fmt.Errorf("Message %s was not found.", UUID)
+	}
+	// If we need to close after reading, close when done.
+	if x, ok := reader.(io.Closer); ok {
+		defer x.Close()
+	}
+
+	// The download is recorded before the message is written, so a message is not read without a record.
+	if err := AuditRecord(nil, AuditActionDownload, UUID, "eml", AuditOutcomeSuccess); err != nil {
+		return fmt.Errorf(AuditNotRecorded)
+	}
+
+	var w io.Writer = os.Stdout
+	if output := c.String("output"); output != "" {
+		fp, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		w = fp
+	}
+	_, err = io.Copy(w, reader)
+	return err
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
-	"log"
+	"io/ioutil"
 	"os"
 	"os/user"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jinzhu/configor"
@@ -13,17 +19,18 @@ import (
 )
 
 // Configuration Structure.
+// Settings which are only used on start are tagged with restart, and are not changed when the configuration is reloaded.
 type Config struct {
-	HTTPBindAddr   string `default:"" json:"http_bind_addr"`
-	HTTPPort       uint   `default:"80" json:"http_port"`
+	HTTPBindAddr   string `default:"" json:"http_bind_addr" restart:"true"`
+	HTTPPort       uint   `default:"80" json:"http_port" restart:"true"`
 	HTTPDebug      bool   `default:"false" json:"http_debug"`
-	SMTPBindAddr   string `default:"" json:"smtp_bind_addr"`
-	SMTPPort       uint   `default:"25" json:"smtp_port"`
-	SMTPDomain     string `default:"localhost" json:"smtp_domain"`
-	SysLogBindAddr string `default:"" json:"syslog_bind_addr"`
-	SysLogPort     uint   `default:"514" json:"syslog_port"`
-	SysLogUDP      bool   `default:"true" json:"syslog_udp"`
-	SysLogTCP      bool   `default:"false" json:"syslog_tcp"`
+	SMTPBindAddr   string `default:"" json:"smtp_bind_addr" restart:"true"`
+	SMTPPort       uint   `default:"25" json:"smtp_port" restart:"true"`
+	SMTPDomain     string `default:"localhost" json:"smtp_domain" restart:"true"`
+	SysLogBindAddr string `default:"" json:"syslog_bind_addr" restart:"true"`
+	SysLogPort     uint   `default:"514" json:"syslog_port" restart:"true"`
+	SysLogUDP      bool   `default:"true" json:"syslog_udp" restart:"true"`
+	SysLogTCP      bool   `default:"false" json:"syslog_tcp" restart:"true"`
 	// There are some syslog ids which you may want to ignore because they belong to
 	//  the original receiving message which is to be sent out, or because
 	//  they belong to the message which is sent to this mail archive tool.
@@ -31,19 +38,86 @@ type Config struct {
 	//  you wish to ignore.
 	// The ignore list only pertains to messages sent on or after the message-id message is received.
 	SysLogIgnoreContaining []string `json:"syslog_ignore_containing"`
+	// When mail passes through multiple hosts, the relay name logged in `relay=` may not match
+	//  the hostname the next host uses in syslog. This maps relay names or addresses to syslog hostnames.
+	SysLogRelayHostnames map[string]string `json:"syslog_relay_hostnames"`
+	// Mail log messages which could not be associated with a message are kept for diagnostics.
+	// This is the maximum number kept, set to 0 to disable.
+	SysLogUnmatchedMax int `default:"10000" json:"syslog_unmatched_max"`
 
-	StaticContentPath string `default:"./www/" json:"static_content_path"`
+	// Local mail log files to read from, for hosts which cannot forward syslog.
+	LogFiles []LogFileConfig `json:"log_files" restart:"true"`
 
-	DBType       string `default:"sqlite3" json:"database_type"` // Review documentation at http://gorm.io/docs/connecting_to_the_database.html
-	DBConnection string `default:"MailArchive.db" json:"database_connection"`
-	DBDebug      bool   `default:"false" json:"database_debug"`
+	StaticContentPath string `default:"./www/" json:"static_content_path" restart:"true"`
 
-	MailPath string `default:"db" json:"mail_path"`
+	// When enabled, the web interface and API require a login or API token.
+	AuthEnabled        bool          `default:"false" json:"auth_enabled" restart:"true"`
+	AuthSessionTimeout time.Duration `default:"43200" json:"auth_session_timeout"` // Default is 12 hours.
+	AuthSecureCookie   bool          `default:"false" json:"auth_secure_cookie"`   // Set if the web interface is served over HTTPS.
+	// If set, this user is created on start if it does not exist. Useful for setting up the first user.
+	AuthAdminUsername string `json:"auth_admin_username" restart:"true"`
+	AuthAdminPassword string `json:"auth_admin_password" restart:"true"`
 
-	MaxAge         time.Duration `default:"1209600" json:"max_age"`          // Used for cleanup of old messages. Default is 2 weeks.
-	MaxMessageSize int           `default:"5242880" json:"max_message_size"` // Default of 5 MB
+	// OpenID Connect single sign-on, users are created on their first login.
+	OIDCDiscoveryURL  string   `json:"oidc_discovery_url"` // The issuer URL, or its /.well-known/openid-configuration URL.
+	OIDCClientID      string   `json:"oidc_client_id"`
+	OIDCClientSecret  string   `json:"oidc_client_secret"`
+	OIDCRedirectURL   string   `json:"oidc_redirect_url"` // The URL of /api/auth/oidc/callback as the browser reaches it.
+	OIDCScopes        []string `json:"oidc_scopes"`       // Additional scopes to request, such as groups.
+	OIDCUsernameClaim string   `default:"preferred_username" json:"oidc_username_claim"`
+	OIDCGroupsClaim   string   `default:"groups" json:"oidc_groups_claim"`
+	OIDCAllowedGroups []string `json:"oidc_allowed_groups"` // If set, users must be in one of these groups to login.
+	// Map of IdP groups to archive roles. If a user is in multiple groups, the role with the most access is used.
+	OIDCGroupRoles  map[string]string `json:"oidc_group_roles"`
+	OIDCDefaultRole string            `default:"read-only" json:"oidc_default_role"` // Role of users not in a mapped group.
+
+	// LDAP bind authentication, users are created on their first login.
+	LDAPURL                string `json:"ldap_url"` // In ldap://host:389 or ldaps://host:636 format.
+	LDAPStartTLS           bool   `default:"false" json:"ldap_start_tls"`
+	LDAPInsecureSkipVerify bool   `default:"false" json:"ldap_insecure_skip_verify"`
+	LDAPBindDN             string `json:"ldap_bind_dn"` // Account used to search for users, leave blank for anonymous search.
+	LDAPBindPassword       string `json:"ldap_bind_password"`
+	LDAPBaseDN             string `json:"ldap_base_dn"`
+	LDAPUserFilter         string `default:"(uid=%s)" json:"ldap_user_filter"` // %s is replaced with the escaped username.
+	LDAPUsernameAttribute  string `default:"uid" json:"ldap_username_attribute"`
+	LDAPGroupAttribute     string `default:"memberOf" json:"ldap_group_attribute"`
+	// For directories without a memberOf attribute, groups can be searched for instead. %s is replaced with the escaped user DN.
+	LDAPGroupFilter   string   `json:"ldap_group_filter"`
+	LDAPGroupBaseDN   string   `json:"ldap_group_base_dn"`   // Defaults to the base DN.
+	LDAPAllowedGroups []string `json:"ldap_allowed_groups"` // If set, users must be in one of these groups to login.
+	// Map of groups, by DN or common name, to archive roles. If a user is in multiple groups, the role with the most access is used.
+	LDAPGroupRoles  map[string]string `json:"ldap_group_roles"`
+	LDAPDefaultRole string            `default:"read-only" json:"ldap_default_role"` // Role of users not in a mapped group.
+	LDAPCacheTTL    time.Duration     `default:"300" json:"ldap_cache_ttl"`          // Seconds a successful login is cached for, set to 0 to disable.
+
+	DBType       string `default:"sqlite3" json:"database_type" restart:"true"` // Review documentation at http://gorm.io/docs/connecting_to_the_database.html
+	DBConnection string `default:"MailArchive.db" json:"database_connection" restart:"true"`
+	DBDebug      bool   `default:"false" json:"database_debug" restart:"true"`
+
+	MailPath string `default:"db" json:"mail_path" restart:"true"`
+
+	MaxAge         time.Duration `default:"1209600" json:"max_age"`                         // Used for cleanup of old messages. Default is 2 weeks.
+	MaxMessageSize int           `default:"5242880" json:"max_message_size" restart:"true"` // Default of 5 MB
+
+	// Metrics are exposed at /metrics in the Prometheus text format.
+	MetricsEnabled bool `default:"true" json:"metrics_enabled"`
+	// If set, readiness fails when no syslog messages were received for this many seconds.
+	HealthSysLogMaxAge time.Duration `default:"0" json:"health_syslog_max_age"`
+
+	// Log lines are written as text, json or logfmt, at a level which may be set for each subsystem.
+	LogFormat string            `default:"text" json:"log_format"`
+	LogLevel  string            `default:"info" json:"log_level"`
+	LogLevels map[string]string `json:"log_levels"` // Levels of subsystems, such as {"smtp": "debug"}.
+
+	// On shutdown, messages being received and other work in progress have this many seconds to finish.
+	ShutdownTimeout time.Duration `default:"30" json:"shutdown_timeout"`
+
+	// Background exports are written to this directory, and removed after the retention in seconds.
+	ExportPath      string        `default:"exports" json:"export_path" restart:"true"`
+	ExportRetention time.Duration `default:"86400" json:"export_retention"` // Default is 1 day.
 
 	MessagesPerPage int `default:"100" json:"messages_per_page"`
+	APIMaxPageSize  int `default:"1000" json:"api_max_page_size"` // The largest page size which may be requested with the v2 API.
 
 	SpamReportingAPIBaseURLS []string `json:"spam_reporting_api_base_urls"`
 	SpamReportingAuthHeader  string   `json:"spam_reporting_auth_header"` // If your spam reporting tool uses a header for authentication. In `Header: Value` format
@@ -53,16 +127,73 @@ type Config struct {
 	SpamReportingSpamURI     string   `default:"learn_spam" json:"spam_reporting_spam_uri"`
 	SpamReportingHamURI      string   `default:"learn_ham" json:"spam_reporting_ham_uri"`
 
-	UICustomBrand          string `defualt:"Mail Archive" json:"ui_custom_brand"`
-	UIDisableSpamReporting bool   `defualt:"false" json:"ui_disable_spam_reporting"`
-	UIDisableLogs          bool   `defualt:"false" json:"ui_disable_logs"`
+	UICustomBrand          string `default:"Mail Archive" json:"ui_custom_brand"`
+	UIDisableSpamReporting bool   `default:"false" json:"ui_disable_spam_reporting"`
+	UIDisableLogs          bool   `default:"false" json:"ui_disable_logs"`
+}
+
+// Configuration of a local log file to read mail logs from.
+type LogFileConfig struct {
+	Path   string `json:"path"`
+	Format string `default:"syslog" json:"format"` // Either syslog for standard mail log files, or journald for `journalctl -o json` output.
+}
+
+// Environment variables starting with this prefix set the setting with the rest of the name,
+// such as MAIL_ARCHIVE_HTTP_PORT for http_port. They take priority over the configuration file.
+const ConfigEnvPrefix = "MAIL_ARCHIVE_"
+
+// Environment variables with the prefix which are not settings.
+var configEnvIgnore = map[string]bool{
+	ConfigEnvPrefix + "CONFIG": true, // The configuration file flag.
+}
+
+// Problems found in the configuration, which are all reported together.
+type ConfigError struct {
+	Problems []string
+}
+
+// Every problem, separated by semicolons.
+func (e *ConfigError) Error() string {
+	return strings.Join(e.Problems, "; ")
 }
 
 // Load the configuration.
 func initConfig(c *cli.Context) Config {
+	file, err := ConfigFind(c)
+	if err != nil {
+		logApp.Fatal("Unable to find the configuration file", "error", err)
+	}
+	if file == "" {
+		logApp.Info("No configuration file found, using environment variables and defaults")
+	}
+
+	// Load the configuration file.
+	config, err := ConfigLoad(file)
+	if configErr, ok := err.(*ConfigError); ok {
+		for _, problem := range configErr.Problems {
+			logApp.Error("Invalid configuration", "problem", problem)
+		}
+		logApp.Fatal("Invalid configuration", "file", file)
+	} else if err != nil {
+		logApp.Fatal("Unable to load the configuration file", "file", file, "error", err)
+	}
+	return config
+}
+
+// Find the configuration file to use. If there is none, a blank path is returned,
+// and the configuration is taken from environment variables and defaults.
+func ConfigFind(c *cli.Context) (string, error) {
+	// A file which was asked for must exist.
+	if file := c.GlobalString("config"); file != "" {
+		if _, err := os.Stat(file); err != nil {
+			return "", err
+		}
+		return file, nil
+	}
+
 	usr, err := user.Current()
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
 
 	// Configuration paths.
@@ -71,30 +202,227 @@ func initConfig(c *cli.Context) Config {
 	etcConfig := "/etc/mail-archive/config.json"
 
 	// Determine which configuration to use.
-	var configFile string
-	if _, err := os.Stat(c.String("config")); err == nil {
-		configFile = c.String("config")
-	} else if _, err := os.Stat(localConfig); err == nil {
-		configFile = localConfig
-	} else if _, err := os.Stat(homeDirConfig); err == nil {
-		configFile = homeDirConfig
-	} else if _, err := os.Stat(etcConfig); err == nil {
-		configFile = etcConfig
-	} else {
-		log.Fatal("Unable to find a configuration file.")
+	for _, file := range []string{localConfig, homeDirConfig, etcConfig} {
+		if _, err := os.Stat(file); err == nil {
+			return file, nil
+		}
 	}
+	return "", nil
+}
 
-	// Load the configuration file.
+// Load the configuration from a file, if one is provided, and environment variables.
+// The file is remembered so that it can be reloaded. Every problem found is returned in a ConfigError.
+func ConfigLoad(file string) (Config, error) {
+	var problems []string
+	if file != "" {
+		// The modification time is taken before reading, so a change while reading is not missed.
+		info, err := os.Stat(file)
+		if err != nil {
+			return Config{}, err
+		}
+		// A file which could not be loaded is not reloaded again until it is changed.
+		configReloadMutex.Lock()
+		configFile, configModTime = file, info.ModTime()
+		configReloadMutex.Unlock()
+
+		if problems, err = ConfigCheckFile(file); err != nil {
+			return Config{}, err
+		}
+	}
+
+	// Defaults are set even without a file.
 	config := Config{}
-	err = configor.Load(&config, configFile)
+	files := []string{}
+	if file != "" {
+		files = append(files, file)
+	}
+	// If the file had problems, they explain why it could not be loaded.
+	loadErr := configor.Load(&config, files...)
+	if loadErr != nil && len(problems) == 0 {
+		return Config{}, loadErr
+	}
+	problems = append(problems, ConfigApplyEnv(&config)...)
+	// Defaults are not set on entries of lists.
+	for i := range config.LogFiles {
+		if config.LogFiles[i].Format == "" {
+			config.LogFiles[i].Format = LogFileFormatSysLog
+		}
+	}
+	if loadErr == nil {
+		problems = append(problems, ConfigValidate(config)...)
+	}
+	if len(problems) != 0 {
+		return Config{}, &ConfigError{Problems: problems}
+	}
+	return config, nil
+}
+
+// Find the field of each setting by its name.
+func configFields() map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		fields[name] = t.Field(i)
+	}
+	return fields
+}
+
+// Describe the type of a setting, for problems with its value.
+func configTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int, reflect.Int64, reflect.Uint:
+		return "a number"
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.String {
+			return "a list of strings"
+		}
+		return "a list of objects"
+	case reflect.Map:
+		return "an object of strings"
+	}
+	return "a string"
+}
+
+// Check each setting in a JSON configuration file, returning every unknown setting and invalid value.
+// Files in other formats are checked when they are loaded.
+func ConfigCheckFile(file string) ([]string, error) {
+	if !strings.HasSuffix(file, ".json") {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var settings map[string]json.RawMessage
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return []string{fmt.Sprintf("%s is not valid JSON: %s", file, err)}, nil
+	}
+
+	var problems []string
+	fields := configFields()
+	for name, value := range settings {
+		field, ok := fields[name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s is not a known setting", name))
+			continue
+		}
+		decoder := json.NewDecoder(bytes.NewReader(value))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(reflect.New(field.Type).Interface()); err != nil {
+			if _, ok := err.(*json.UnmarshalTypeError); ok {
+				problems = append(problems, fmt.Sprintf("%s must be %s", name, configTypeName(field.Type)))
+			} else {
+				problems = append(problems, fmt.Sprintf("%s is invalid: %s", name, strings.TrimPrefix(err.Error(), "json: ")))
+			}
+		}
+	}
+	sort.Strings(problems)
+	return problems, nil
+}
+
+// Set settings from environment variables, returning every unknown variable and invalid value.
+// Lists of strings may be comma separated, while other lists and objects are in JSON.
+func ConfigApplyEnv(config *Config) []string {
+	var problems []string
+	fields := configFields()
+	values := reflect.ValueOf(config).Elem()
+	for _, env := range os.Environ() {
+		i := strings.Index(env, "=")
+		key, value := env[:i], env[i+1:]
+		if !strings.HasPrefix(key, ConfigEnvPrefix) || configEnvIgnore[key] {
+			continue
+		}
+		name := strings.ToLower(strings.TrimPrefix(key, ConfigEnvPrefix))
+		field, ok := fields[name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s is not a known setting", key))
+			continue
+		}
+		if err := configSetValue(values.FieldByIndex(field.Index), value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s (%s) must be %s", key, name, configTypeName(field.Type)))
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// Set a setting from the value of an environment variable.
+func configSetValue(field reflect.Value, value string) error {
+	switch {
+	case field.Kind() == reflect.String:
+		field.SetString(value)
+		return nil
+	case field.Type() == reflect.TypeOf([]string{}) && !strings.HasPrefix(strings.TrimSpace(value), "["):
+		list := []string{}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		field.Set(reflect.ValueOf(list))
+		return nil
+	case field.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+		return nil
+	}
+	v := reflect.New(field.Type())
+	if err := json.Unmarshal([]byte(value), v.Interface()); err != nil {
+		return err
+	}
+	field.Set(v.Elem())
+	return nil
+}
+
+// Check settings which are otherwise only checked when they are used, returning each problem found.
+func ConfigValidate(config Config) []string {
+	var problems []string
+	roles := map[string]string{"oidc_default_role": config.OIDCDefaultRole, "ldap_default_role": config.LDAPDefaultRole}
+	for group, role := range config.OIDCGroupRoles {
+		roles["oidc_group_roles "+group] = role
+	}
+	for group, role := range config.LDAPGroupRoles {
+		roles["ldap_group_roles "+group] = role
+	}
+	for name, role := range roles {
+		if !AuthValidRole(role) {
+			problems = append(problems, fmt.Sprintf("%s has invalid role %s", name, role))
+		}
+	}
+	for _, logFile := range config.LogFiles {
+		if logFile.Format != LogFileFormatSysLog && logFile.Format != LogFileFormatJournald {
+			problems = append(problems, fmt.Sprintf("log_files %s has unknown format %s", logFile.Path, logFile.Format))
+		}
+	}
+	if config.AuthEnabled && config.AuthAdminUsername != "" && config.AuthAdminPassword == "" {
+		problems = append(problems, "auth_admin_password cannot be blank")
+	}
+	if config.MessagesPerPage <= 0 {
+		problems = append(problems, "messages_per_page must be greater than 0")
+	}
 	if config.HTTPPort == 0 {
-		fmt.Println(err)
-		log.Fatal("Unable to load the configuration file.")
+		problems = append(problems, "http_port cannot be 0")
 	}
-	return config
+	if config.APIMaxPageSize <= 0 {
+		problems = append(problems, "api_max_page_size must be greater than 0")
+	}
+	problems = append(problems, LogValidateConfig(config)...)
+	sort.Strings(problems)
+	return problems
 }
 
-// Flags for the server command.
+// Flags for the config test command.
 func configTestFlags() []cli.Flag {
-	return []cli.Flag{}
+	return []cli.Flag{
+		cli.BoolFlag{
+			Name:  "skip-ports",
+			Usage: "Do not check that ports are free, such as when the server is running",
+		},
+	}
 }
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What caused the configuration to be reloaded.
+const (
+	ConfigReloadSignal = "signal" // SIGHUP was received.
+	ConfigReloadFile   = "file"   // The configuration file was changed.
+	ConfigReloadAPI    = "api"    // An administrator requested it.
+)
+
+// How often the configuration file is checked for changes.
+const configWatchInterval = 5 * time.Second
+
+// Result of the last reload of the configuration.
+type ConfigReloadStatus struct {
+	File    string    `json:"file"`
+	Time    time.Time `json:"time"`    // When the configuration was last reloaded, zero if it was not since start.
+	Trigger string    `json:"trigger"` // Either signal, file or api.
+	Changed []string  `json:"changed"` // Settings changed by the last reload.
+	// Settings changed in the file which are not used until restart, whether by the last reload or one before it.
+	RestartRequired []string `json:"restart_required"`
+	Error           string   `json:"error"` // Why the last reload was rejected, leaving the running configuration as it was.
+}
+
+// The configuration file in use, and the result of reloading it.
+var (
+	configFile         string
+	configModTime      time.Time
+	configReloadStatus ConfigReloadStatus
+	configReloadMutex  sync.Mutex
+	configReloadSerial sync.Mutex // Only one reload runs at a time.
+)
+
+// Get the running configuration. It is shared by everything running, so it must not be changed.
+// Reloading replaces it as a whole, so a configuration read once stays consistent.
+func (a *App) Config() *Config {
+	config, _ := a.config.Load().(*Config)
+	if config == nil { // Not loaded yet.
+		return &Config{}
+	}
+	return config
+}
+
+// Replace the running configuration.
+func (a *App) SetConfig(config Config) {
+	a.config.Store(&config)
+}
+
+// Get the result of the last reload of the configuration.
+func ConfigGetReloadStatus() ConfigReloadStatus {
+	configReloadMutex.Lock()
+	defer configReloadMutex.Unlock()
+	status := configReloadStatus
+	status.File = configFile
+	if status.Changed == nil {
+		status.Changed = []string{}
+	}
+	if status.RestartRequired == nil {
+		status.RestartRequired = []string{}
+	}
+	return status
+}
+
+// Reload the configuration file, applying settings which are safe to change while running.
+// The file is validated first, and if it has problems the running configuration is left as it was.
+// Settings which need a restart are reported, and keep their running value.
+func ConfigReload(trigger string) (ConfigReloadStatus, error) {
+	configReloadSerial.Lock()
+	defer configReloadSerial.Unlock()
+	configReloadMutex.Lock()
+	file := configFile
+	configReloadMutex.Unlock()
+
+	config, err := ConfigLoad(file)
+
+	configReloadMutex.Lock()
+	status := ConfigReloadStatus{Time: time.Now(), Trigger: trigger, Changed: []string{}, RestartRequired: configReloadStatus.RestartRequired}
+	if err != nil {
+		status.Error = err.Error()
+		configReloadStatus = status
+		configReloadMutex.Unlock()
+		logApp.Error("Configuration reload rejected, keeping the running configuration", "trigger", trigger, "error", err)
+		return ConfigGetReloadStatus(), err
+	}
+
+	// Compare each setting with the running configuration, building the next one from the changes which can be applied.
+	// Settings which need a restart are never changed, so they are compared with what was loaded on start.
+	// The running configuration is read without a lock, so it is replaced rather than changed.
+	status.RestartRequired = []string{}
+	next := *app.Config()
+	running := reflect.ValueOf(&next).Elem()
+	loaded := reflect.ValueOf(config)
+	for i := 0; i < running.NumField(); i++ {
+		field := running.Type().Field(i)
+		if reflect.DeepEqual(running.Field(i).Interface(), loaded.Field(i).Interface()) {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if field.Tag.Get("restart") == "true" {
+			status.RestartRequired = append(status.RestartRequired, name)
+			continue
+		}
+		running.Field(i).Set(loaded.Field(i))
+		status.Changed = append(status.Changed, name)
+	}
+	app.SetConfig(next)
+	configReloadStatus = status
+	configReloadMutex.Unlock()
+
+	// The identity provider is discovered again if its settings changed.
+	for _, name := range status.Changed {
+		if strings.HasPrefix(name, "oidc_") {
+			OIDCResetProvider()
+			break
+		}
+	}
+
+	logApp.Info("Configuration reloaded", "file", file, "trigger", trigger, "changed", len(status.Changed))
+	for _, name := range status.Changed {
+		logApp.Info("Configuration change applied", "setting", name)
+	}
+	for _, name := range status.RestartRequired {
+		logApp.Warn("Configuration change requires a restart", "setting", name)
+	}
+	return ConfigGetReloadStatus(), nil
+}
+
+// Reload the configuration when its file is changed.
+func RunConfigWatcher() {
+	ticker := time.NewTicker(configWatchInterval)
+	for _ = range ticker.C {
+		if !app.work.Begin() {
+			return
+		}
+		configReloadMutex.Lock()
+		file, modTime := configFile, configModTime
+		configReloadMutex.Unlock()
+		// If the file is being replaced it may briefly not exist, which is checked again on the next tick.
+		if info, err := os.Stat(file); err == nil && !info.ModTime().Equal(modTime) {
+			ConfigReload(ConfigReloadFile)
+		}
+		app.work.End()
+	}
+}
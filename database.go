@@ -10,7 +10,7 @@ import (
 // Main message metadata storage.
 type MessageLog struct {
 	UUID        string    `gorm:"primary_key" json:"uuid"`
-	MessageID   string    `json:"message_id"`
+	MessageID   string    `gorm:"index" json:"message_id"`
 	From        string    `json:"from"`
 	To          string    `json:"to"`
 	Subject     string    `json:"subject"`
@@ -20,8 +20,19 @@ type MessageLog struct {
 	SpamScore   int       `json:"spam_score"`
 	SourceIP    string    `default:"" json:"source_ip"`
 	Size        int       `json:"size"`
-	Received    time.Time `json:"received"`
-	Status      string    `json:"status"`
+	Hash        string    `gorm:"index" json:"hash"` // SHA-256 of the message as received, for finding duplicates.
+	Received    time.Time `gorm:"index" json:"received"`
+	Status      string    `gorm:"index" json:"status"`
+	Redacted    bool      `json:"redacted"`          // The body and attachments were replaced with a notice.
+	Hold        bool      `gorm:"index" json:"hold"` // Under legal hold, the message may not be removed or redacted.
+}
+
+// Addresses which appear in the envelope or headers of a message, for finding all messages involving an address.
+type MessageAddress struct {
+	ID      int64  `gorm:"primary_key" json:"-"`
+	UUID    string `gorm:"index" json:"-"`
+	Address string `gorm:"index" json:"address"` // Lowercase.
+	Field   string `json:"field"`                // Where the address appears, such as envelope_to or cc.
 }
 
 // Database storage of message data.
@@ -31,30 +42,117 @@ type Messages struct {
 }
 
 // Syslog message storage.
+// Columns of a composite index are in the order of the fields, so s_id comes first for lookups by s_id alone.
 type SysLogMessage struct {
-	ID        int64 `gorm:"primary_key"`
-	Hostname  string
+	ID        int64  `gorm:"primary_key"`
+	SID       string `gorm:"index:idx_sys_log_messages_s_id_hostname"`
+	Hostname  string `gorm:"index:idx_sys_log_messages_s_id_hostname"`
 	Timestamp time.Time
 	Tag       string
-	SID       string
 	Content   string
 }
 
 // Map of syslog message ids to email message ids with information on email status.
+// As with syslog messages, s_id comes first in the composite index.
 type SysLogIDInfo struct {
-	ID        int64 `gorm:"primary_key"`
-	Hostname  string
-	SID       string
-	MessageID string
+	ID        int64  `gorm:"primary_key"`
+	SID       string `gorm:"index:idx_sys_log_id_infos_s_id_hostname"`
+	Hostname  string `gorm:"index:idx_sys_log_id_infos_s_id_hostname"`
+	MessageID string `gorm:"index"`
 	Status    string
 	Ignore    bool
+	Relay     string    // The relay the message was handed off to, as seen in `relay=`.
+	QueuedAs  string    // The syslog id the relay queued the message as.
+	UpdatedAt time.Time // Used to determine which hop reported last.
+}
+
+// Syslog messages which could not be associated with a message, kept for diagnostics.
+type SysLogUnmatched struct {
+	ID        int64     `gorm:"primary_key" json:"id"`
+	Hostname  string    `json:"hostname"`
+	Timestamp time.Time `json:"timestamp"`
+	Tag       string    `json:"tag"`
+	Content   string    `json:"content"`
+	Reason    string    `json:"reason"`
+}
+
+// Users which may log in to the web interface and API.
+type User struct {
+	ID           int64     `gorm:"primary_key" json:"id"`
+	Username     string    `gorm:"unique_index" json:"username"`
+	PasswordHash string    `json:"-"`
+	Role         string    `gorm:"default:'admin'" json:"role"`
+	Source       string    `gorm:"default:'local'" json:"source"` // Where the user authenticates: local, oidc or ldap.
+	ExternalID   string    `gorm:"index" json:"-"`                // Identity at the external directory which does not change, such as the OIDC issuer and subject.
+	CreatedAt    time.Time `json:"created_at"`
+	Scopes       []string  `gorm:"-" json:"scopes"` // Loaded from user scopes.
+}
+
+// Addresses or domains a user is limited to seeing mail for. Users without scopes can see all mail.
+type UserScope struct {
+	ID     int64 `gorm:"primary_key"`
+	UserID int64 `gorm:"index"`
+	Scope  string
+}
+
+// Login sessions for the web interface. Only a hash of the session token is stored.
+type Session struct {
+	TokenHash string `gorm:"primary_key"`
+	UserID    int64
+	CSRFToken string
+	Expires   time.Time
+}
+
+// API tokens for scripts. Only a hash of the token is stored.
+type APIToken struct {
+	ID        int64     `gorm:"primary_key" json:"id"`
+	UserID    int64     `json:"user_id"`
+	Name      string    `json:"name"`
+	TokenHash string    `gorm:"unique_index" json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+	LastUsed  time.Time `json:"last_used"`
+}
+
+// Append-only record of access to archived mail. Each entry includes a hash of the entry before it,
+//  so that modification or removal of entries can be detected.
+type AuditLog struct {
+	ID          int64     `gorm:"primary_key" json:"id"`
+	Time        time.Time `gorm:"index" json:"time"`
+	UserID      int64     `json:"user_id"`
+	Username    string    `gorm:"index" json:"username"`
+	Action      string    `json:"action"`
+	MessageUUID string    `gorm:"index" json:"message_uuid"`
+	Query       string    `json:"query"` // The search query, for search actions.
+	SourceIP    string    `json:"source_ip"`
+	Outcome     string    `json:"outcome"`
+	Detail      string    `json:"detail"`                        // Additional information, such as the format of the message read.
+	PrevHash    string    `gorm:"unique_index" json:"prev_hash"` // Unique so that the log cannot fork when appended by more than one process.
+	Hash        string    `json:"hash"`
+}
+
+// Read offset of a local log file, so that reading resumes where it left off.
+type LogFileOffset struct {
+	Path            string `gorm:"primary_key"`
+	Offset          int64
+	Fingerprint     string // Hash of the start of the file, used to detect rotation while we were not running.
+	FingerprintSize int
 }
 
 // Configure the database and add tables/adjust tables to match structures above.
+// Indexes in the structure tags are created if they do not exist, which may take a while on large existing databases.
 func initDB(db *gorm.DB) {
-	db.LogMode(app.config.DBDebug)
+	db.LogMode(app.Config().DBDebug)
 	db.AutoMigrate(&MessageLog{})
 	db.AutoMigrate(&Messages{})
+	db.AutoMigrate(&MessageAddress{})
 	db.AutoMigrate(&SysLogMessage{})
 	db.AutoMigrate(&SysLogIDInfo{})
+	db.AutoMigrate(&SysLogUnmatched{})
+	db.AutoMigrate(&LogFileOffset{})
+	db.AutoMigrate(&User{})
+	db.AutoMigrate(&UserScope{})
+	db.AutoMigrate(&Session{})
+	db.AutoMigrate(&APIToken{})
+	db.AutoMigrate(&AuditLog{})
+
 }
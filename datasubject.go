@@ -0,0 +1,288 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// Everything in the archive involving an address, for data subject requests.
+type DataSubjectRecords struct {
+	Address  string
+	Messages []MessageLog
+	Fields   map[string][]string // Where the address appears in each message, by UUID.
+	Logs     []SysLogMessage     // Syslog messages where the address appears.
+}
+
+// Description of a message in the manifest of an export.
+type DataSubjectManifestMessage struct {
+	MessageLog
+	Fields []string `json:"fields"` // Where the address appears, such as envelope_to or cc.
+	File   string   `json:"file"`   // Path of the message source within the export.
+	SHA256 string   `json:"sha256"` // Hash of the message source.
+	Error  string   `json:"error,omitempty"`
+}
+
+// Manifest of an export, included as manifest.json.
+type DataSubjectManifest struct {
+	Address     string                       `json:"address"`
+	Generated   time.Time                    `json:"generated"`
+	Messages    []DataSubjectManifestMessage `json:"messages"`
+	SysLogFile  string                       `json:"syslog_file"`
+	SysLogLines int                          `json:"syslog_lines"`
+}
+
+// Result of erasing everything involving an address.
+type DataSubjectErasure struct {
+	Erased      int `json:"erased"`       // Number of messages removed.
+	Held        int `json:"held"`         // Number of messages kept as they are under legal hold.
+	SysLogLines int `json:"syslog_lines"` // Number of syslog messages removed.
+}
+
+// A basic check that an address is an email address, as it is matched against the archive exactly.
+var dataSubjectAddressRx = regexp.MustCompile(`^[^\s<>@]+@[^\s<>@]+$`)
+
+// Normalize an address provided for a data subject request.
+func DataSubjectNormalize(address string) (string, error) {
+	address = strings.ToLower(strings.TrimSpace(address))
+	if !dataSubjectAddressRx.MatchString(address) {
+		return "", fmt.Errorf("Invalid email address: %s", address)
+	}
+	return address, nil
+}
+
+// Find all messages and syslog messages where an address appears in the envelope, headers or logs.
+// Messages outside of the user's scopes are left out, as are syslog messages if the user has scopes.
+func DataSubjectFind(address string, user *User) (records DataSubjectRecords) {
+	records.Address = address
+	records.Fields = make(map[string][]string)
+
+	// Addresses recorded when messages were received.
+	var addresses []MessageAddress
+	app.db.Where("address = ?", address).Find(&addresses)
+	var UUIDs []string
+	for _, a := range addresses {
+		if records.Fields[a.UUID] == nil {
+			UUIDs = append(UUIDs, a.UUID)
+		}
+		records.Fields[a.UUID] = append(records.Fields[a.UUID], a.Field)
+	}
+
+	// Syslog messages mentioning the address, such as to=<address> or from=<address>.
+	// Like may match more than wanted, so matches are checked exactly.
+	var candidates []SysLogMessage
+	app.db.Where("LOWER(content) LIKE ?", "%<"+address+">%").Order("timestamp").Find(&candidates)
+	var messageIDs []string
+	for _, line := range candidates {
+		if !strings.Contains(strings.ToLower(line.Content), "<"+address+">") {
+			continue
+		}
+		records.Logs = append(records.Logs, line)
+
+		// Messages may be found through their syslog, such as recipients which were not in the headers.
+		var info SysLogIDInfo
+		app.db.Where("s_id = ? AND hostname = ?", line.SID, line.Hostname).First(&info)
+		if info.MessageID != "" {
+			messageIDs = append(messageIDs, info.MessageID)
+		}
+	}
+
+	// Messages received before addresses were recorded only have the from and to address.
+	db := app.db.Where("LOWER(`from`) = ? OR LOWER(`to`) = ?", address, address)
+	if len(UUIDs) != 0 {
+		db = db.Or("uuid IN (?)", UUIDs)
+	}
+	if len(messageIDs) != 0 {
+		db = db.Or("message_id IN (?)", messageIDs)
+	}
+	var messages []MessageLog
+	db.Order("received").Find(&messages)
+	for _, message := range messages {
+		if !AuthMessageInScope(user, message) {
+			continue
+		}
+		if records.Fields[message.UUID] == nil {
+			// Describe where the address appears for messages without recorded addresses.
+			if strings.ToLower(message.From) == address {
+				records.Fields[message.UUID] = append(records.Fields[message.UUID], "from")
+			}
+			if strings.ToLower(message.To) == address {
+				records.Fields[message.UUID] = append(records.Fields[message.UUID], "to")
+			}
+			if records.Fields[message.UUID] == nil {
+				records.Fields[message.UUID] = []string{"syslog"}
+			}
+		}
+		records.Messages = append(records.Messages, message)
+	}
+
+	// Syslog messages are not limited by scopes, so they are only provided to users without scopes.
+	if user != nil && len(user.Scopes) != 0 {
+		records.Logs = nil
+	}
+	return
+}
+
+// Write a ZIP file with the source of each message, the syslog messages and a manifest describing them.
+// Each message exported is recorded in the audit log.
+func DataSubjectExport(r *http.Request, w io.Writer, records DataSubjectRecords) error {
+	zw := zip.NewWriter(w)
+	manifest := DataSubjectManifest{Address: records.Address, Generated: time.Now(), Messages: []DataSubjectManifestMessage{}}
+	detail := "data subject: " + records.Address
+
+	for _, message := range records.Messages {
+		entry := DataSubjectManifestMessage{MessageLog: message, Fields: records.Fields[message.UUID]}
+		entry.File = "messages/" + message.UUID + ".eml"
+
+		reader, err := MailGetMessageData(message.UUID)
+		if err != nil {
+			entry.File = ""
+			entry.Error = APINoMessage
+			manifest.Messages = append(manifest.Messages, entry)
+			AuditRecord(r, AuditActionExport, message.UUID, detail, AuditOutcomeNotFound)
+			continue
+		}
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: entry.File, Method: zip.Deflate, Modified: message.Received})
+		if err != nil {
+			return err
+		}
+		hash := sha256.New()
+		_, err = io.Copy(io.MultiWriter(fw, hash), reader)
+		// If we need to close after reading, close now.
+		if x, ok := reader.(io.Closer); ok {
+			x.Close()
+		}
+		if err != nil {
+			return err
+		}
+		entry.SHA256 = hex.EncodeToString(hash.Sum(nil))
+		manifest.Messages = append(manifest.Messages, entry)
+		AuditRecord(r, AuditActionExport, message.UUID, detail, AuditOutcomeSuccess)
+	}
+
+	// Syslog messages, in the same format as the message log.
+	if len(records.Logs) != 0 {
+		manifest.SysLogFile = "syslog.txt"
+		manifest.SysLogLines = len(records.Logs)
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: manifest.SysLogFile, Method: zip.Deflate, Modified: manifest.Generated})
+		if err != nil {
+			return err
+		}
+		for _, line := range records.Logs {
+			fmt.Fprintf(fw, "%v %s %s: %s\n", line.Timestamp, line.Hostname, line.Tag, line.Content)
+		}
+	}
+
+	fw, err := zw.CreateHeader(&zip.FileHeader{Name: "manifest.json", Method: zip.Deflate, Modified: manifest.Generated})
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(fw)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(manifest); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// Remove the messages and syslog messages involving an address. Messages under legal hold, and their syslog messages, are kept.
+// Each message is recorded in the audit log.
+func DataSubjectErase(r *http.Request, records DataSubjectRecords) (result DataSubjectErasure) {
+	detail := "data subject: " + records.Address
+
+	// Syslog messages of held messages are kept with them, including held messages which do not involve the address.
+	heldMessageIDs := make(map[string]bool)
+	isHeld := func(messageID string) bool {
+		held, ok := heldMessageIDs[messageID]
+		if !ok {
+			count := 0
+			app.db.Model(&MessageLog{}).Where("message_id = ? AND hold = ?", messageID, true).Count(&count)
+			held = count != 0
+			heldMessageIDs[messageID] = held
+		}
+		return held
+	}
+
+	// Syslog messages are removed first, so those of erased messages are counted.
+	for _, line := range records.Logs {
+		var info SysLogIDInfo
+		app.db.Where("s_id = ? AND hostname = ?", line.SID, line.Hostname).First(&info)
+		if info.MessageID != "" && isHeld(info.MessageID) {
+			continue
+		}
+		result.SysLogLines += int(app.db.Where("id = ?", line.ID).Delete(SysLogMessage{}).RowsAffected)
+	}
+
+	for _, message := range records.Messages {
+		if message.Hold {
+			result.Held++
+			AuditRecord(r, AuditActionDelete, message.UUID, detail, AuditOutcomeDenied)
+			continue
+		}
+		MailDeleteMessage(message.UUID, message.MessageID)
+		result.Erased++
+		AuditRecord(r, AuditActionDelete, message.UUID, detail, AuditOutcomeSuccess)
+	}
+	return
+}
+
+// Flags for the data subject command.
+func dataSubjectFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "output, o",
+			Usage: "Write the export to `FILE`, defaults to data-subject-ADDRESS.zip",
+		},
+		cli.BoolFlag{
+			Name:  "erase",
+			Usage: "Erase everything involving the address after it is exported, except messages under legal hold",
+		},
+	}
+}
+
+// Export, and optionally erase, everything in the archive involving an address.
+func DataSubjectCommand(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("An email address must be provided.")
+	}
+	address, err := DataSubjectNormalize(c.Args().First())
+	if err != nil {
+		return err
+	}
+	appSetup(c)
+
+	records := DataSubjectFind(address, nil)
+	logApp.Info("Found records involving address", "address", address, "messages", len(records.Messages), "syslog_messages", len(records.Logs))
+
+	// Export first, so that nothing is erased without a copy.
+	output := c.String("output")
+	if output == "" {
+		output = "data-subject-" + address + ".zip"
+	}
+	fp, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	err = DataSubjectExport(nil, fp, records)
+	fp.Close()
+	if err != nil {
+		return err
+	}
+	logApp.Info("Exported records", "file", output)
+
+	if c.Bool("erase") {
+		result := DataSubjectErase(nil, records)
+		logApp.Info("Erased records", "messages", result.Erased, "syslog_messages", result.SysLogLines, "held", result.Held)
+	}
+	return nil
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Formats messages may be exported in.
+const (
+	ExportFormatMbox    = "mbox"
+	ExportFormatZip     = "zip"     // ZIP of EML files with a CSV manifest.
+	ExportFormatMaildir = "maildir" // Maildir in a gzipped tarball.
+)
+
+// Status of an export job.
+const (
+	ExportStatusRunning   = "running"
+	ExportStatusComplete  = "complete"
+	ExportStatusFailed    = "failed"
+	ExportStatusCancelled = "cancelled"
+)
+
+// Content type and file extension of each export format.
+var ExportFormats = map[string]struct {
+	ContentType string
+	Extension   string
+}{
+	ExportFormatMbox:    {"application/mbox", ".mbox"},
+	ExportFormatZip:     {"application/zip", ".zip"},
+	ExportFormatMaildir: {"application/gzip", ".tar.gz"},
+}
+
+// Returned when an export is cancelled.
+var ErrExportCancelled = errors.New("Export was cancelled.")
+
+// Number of message log entries read at a time while exporting.
+const exportPageSize = 500
+
+// Writes messages to an export file.
+type ExportWriter interface {
+	Add(message MessageLog, data []byte) error
+	Close() error
+}
+
+// Check that an export format is known.
+func ExportValidFormat(format string) error {
+	if _, ok := ExportFormats[format]; !ok {
+		return fmt.Errorf("Format must be %s, %s or %s.", ExportFormatMbox, ExportFormatZip, ExportFormatMaildir)
+	}
+	return nil
+}
+
+// Create a writer for an export format.
+func NewExportWriter(format string, w io.Writer) (ExportWriter, error) {
+	if err := ExportValidFormat(format); err != nil {
+		return nil, err
+	}
+	switch format {
+	case ExportFormatMbox:
+		return &mboxExportWriter{w: bufio.NewWriter(w)}, nil
+	case ExportFormatZip:
+		return newZipExportWriter(w), nil
+	}
+	return newMaildirExportWriter(w), nil
+}
+
+// Lines starting with From, including those already quoted, are quoted in mboxrd format.
+var mboxFromLineRx = regexp.MustCompile(`(?m)^(>*From )`)
+
+// Writes messages to an mbox file in mboxrd format.
+type mboxExportWriter struct {
+	w *bufio.Writer
+}
+
+func (e *mboxExportWriter) Add(message MessageLog, data []byte) error {
+	from := message.From
+	if from == "" || strings.ContainsAny(from, " \t") {
+		from = "MAILER-DAEMON"
+	}
+	// Mbox files use unix line endings.
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	data = mboxFromLineRx.ReplaceAll(data, []byte(">$1"))
+	fmt.Fprintf(e.w, "From %s %s\n", from, message.Received.UTC().Format(time.ANSIC))
+	e.w.Write(data)
+	if !bytes.HasSuffix(data, []byte("\n")) {
+		e.w.WriteString("\n")
+	}
+	_, err := e.w.WriteString("\n")
+	return err
+}
+
+func (e *mboxExportWriter) Close() error {
+	return e.w.Flush()
+}
+
+// Writes messages to a ZIP file as EML files, with a CSV manifest of their metadata.
+type zipExportWriter struct {
+	zw       *zip.Writer
+	manifest bytes.Buffer
+	cw       *csv.Writer
+}
+
+func newZipExportWriter(w io.Writer) *zipExportWriter {
+	e := &zipExportWriter{zw: zip.NewWriter(w)}
+	e.cw = csv.NewWriter(&e.manifest)
+	e.cw.Write([]string{"file", "sha256", "uuid", "message_id", "from", "to", "subject", "received", "status", "size", "spam_score", "source_ip", "hold", "redacted"})
+	return e
+}
+
+func (e *zipExportWriter) Add(message MessageLog, data []byte) error {
+	file := message.UUID + ".eml"
+	fw, err := e.zw.CreateHeader(&zip.FileHeader{Name: file, Method: zip.Deflate, Modified: message.Received})
+	if err != nil {
+		return err
+	}
+	if _, err := fw.Write(data); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	return e.cw.Write([]string{
+		file,
+		hex.EncodeToString(sum[:]),
+		message.UUID,
+		message.MessageID,
+		message.From,
+		message.To,
+		message.Subject,
+		message.Received.UTC().Format(time.RFC3339),
+		message.Status,
+		strconv.Itoa(message.Size),
+		strconv.Itoa(message.SpamScore),
+		message.SourceIP,
+		strconv.FormatBool(message.Hold),
+		strconv.FormatBool(message.Redacted),
+	})
+}
+
+func (e *zipExportWriter) Close() error {
+	e.cw.Flush()
+	fw, err := e.zw.CreateHeader(&zip.FileHeader{Name: "manifest.csv", Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	if _, err := fw.Write(e.manifest.Bytes()); err != nil {
+		return err
+	}
+	return e.zw.Close()
+}
+
+// Writes messages to a Maildir in a gzipped tarball. Messages are placed in cur and marked as seen.
+type maildirExportWriter struct {
+	gw *gzip.Writer
+	tw *tar.Writer
+}
+
+func newMaildirExportWriter(w io.Writer) *maildirExportWriter {
+	e := &maildirExportWriter{gw: gzip.NewWriter(w)}
+	e.tw = tar.NewWriter(e.gw)
+	now := time.Now()
+	for _, dir := range []string{"Maildir/", "Maildir/cur/", "Maildir/new/", "Maildir/tmp/"} {
+		e.tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: dir, Mode: 0700, ModTime: now})
+	}
+	return e
+}
+
+func (e *maildirExportWriter) Add(message MessageLog, data []byte) error {
+	name := fmt.Sprintf("Maildir/cur/%d.%s.mail-archive:2,S", message.Received.Unix(), message.UUID)
+	err := e.tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0600, Size: int64(len(data)), ModTime: message.Received})
+	if err != nil {
+		return err
+	}
+	_, err = e.tw.Write(data)
+	return err
+}
+
+func (e *maildirExportWriter) Close() error {
+	if err := e.tw.Close(); err != nil {
+		return err
+	}
+	return e.gw.Close()
+}
+
+// Write every message matching a message log query to an export, newest first.
+// The progress function is called after each message is written.
+func ExportMessages(ctx context.Context, db *gorm.DB, format string, w io.Writer, progress func(message MessageLog)) error {
+	ew, err := NewExportWriter(format, w)
+	if err != nil {
+		return err
+	}
+
+	// Messages are read a page at a time, as there may be too many to hold at once.
+	cursor := ""
+	for {
+		entries, nextCursor, err := APIMessageLogPage(db, cursor, exportPageSize)
+		if err != nil {
+			return err
+		}
+		for _, message := range entries {
+			if ctx.Err() != nil {
+				return ErrExportCancelled
+			}
+
+			reader, err := MailGetMessageData(message.UUID)
+			if err != nil { // The message may have been removed since it was found.
+				continue
+			}
+			data, err := ioutil.ReadAll(reader)
+			// If we need to close after reading, close now.
+			if x, ok := reader.(io.Closer); ok {
+				x.Close()
+			}
+			if err != nil {
+				return err
+			}
+			if err := ew.Add(message, data); err != nil {
+				return err
+			}
+			progress(message)
+		}
+		if nextCursor == "" {
+			break
+		}
+		cursor = nextCursor
+	}
+	return ew.Close()
+}
+
+// An export running in the background.
+type ExportJob struct {
+	ID       int64     `json:"id"`
+	UserID   int64     `json:"user_id"`
+	Username string    `json:"username"`
+	Query    string    `json:"query"`
+	Format   string    `json:"format"`
+	Status   string    `json:"status"`
+	Total    int       `json:"total"` // Number of messages matching the query when the job started.
+	Done     int       `json:"done"`  // Number of messages written.
+	Size     int64     `json:"size"`  // Size of the export file once complete.
+	Error    string    `json:"error"`
+	Created  time.Time `json:"created"`
+	Finished time.Time `json:"finished"`
+
+	path   string
+	cancel context.CancelFunc
+}
+
+// Export jobs since start, by ID.
+var exportJobs = struct {
+	sync.Mutex
+	jobs   map[int64]*ExportJob
+	nextID int64
+}{jobs: make(map[int64]*ExportJob)}
+
+// Start an export job for the messages matching a message log query, which are visible to the user.
+func ExportStartJob(user *User, sourceIP string, query string, format string) (ExportJob, error) {
+	if err := ExportValidFormat(format); err != nil {
+		return ExportJob{}, err
+	}
+	if err := os.MkdirAll(app.Config().ExportPath, 0700); err != nil {
+		return ExportJob{}, err
+	}
+	// Exports use the database, which is closed on shutdown.
+	if !app.work.Begin() {
+		return ExportJob{}, ErrExportCancelled
+	}
+
+	db := AuthScopeFilter(app.db, user)
+	if query != "" {
+		db = APIMessageLogSearch(db, query)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &ExportJob{Query: query, Format: format, Status: ExportStatusRunning, Created: time.Now(), cancel: cancel}
+	if user != nil {
+		job.UserID = user.ID
+		job.Username = user.Username
+	}
+	db.Model(&MessageLog{}).Count(&job.Total)
+
+	exportJobs.Lock()
+	exportJobs.nextID++
+	job.ID = exportJobs.nextID
+	job.path = path.Join(app.Config().ExportPath, fmt.Sprintf("export-%d-%s%s", job.ID, job.Created.Format("20060102-150405"), ExportFormats[format].Extension))
+	exportJobs.jobs[job.ID] = job
+	started := *job
+	exportJobs.Unlock()
+
+	go func() {
+		defer app.work.End()
+		detail := fmt.Sprintf("export job %d: %s", job.ID, format)
+		err := func() error {
+			fp, err := os.Create(job.path)
+			if err != nil {
+				return err
+			}
+			defer fp.Close()
+			return ExportMessages(ctx, db, format, fp, func(message MessageLog) {
+				AuditRecordUser(user, sourceIP, AuditActionExport, message.UUID, detail, AuditOutcomeSuccess)
+				exportJobs.Lock()
+				job.Done++
+				exportJobs.Unlock()
+			})
+		}()
+
+		exportJobs.Lock()
+		defer exportJobs.Unlock()
+		job.Finished = time.Now()
+		if err == ErrExportCancelled {
+			job.Status = ExportStatusCancelled
+		} else if err != nil {
+			logExport.Error("Export job failed", "job", job.ID, "error", err)
+			job.Status = ExportStatusFailed
+			job.Error = err.Error()
+		} else {
+			job.Status = ExportStatusComplete
+			if info, err := os.Stat(job.path); err == nil {
+				job.Size = info.Size()
+			}
+			return
+		}
+		os.Remove(job.path)
+	}()
+	return started, nil
+}
+
+// Get a copy of an export job, if it exists and belongs to the user.
+func ExportGetJob(user *User, ID int64) (ExportJob, bool) {
+	exportJobs.Lock()
+	defer exportJobs.Unlock()
+	job, ok := exportJobs.jobs[ID]
+	if !ok || (user != nil && job.UserID != user.ID) {
+		return ExportJob{}, false
+	}
+	return *job, true
+}
+
+// Get copies of the export jobs of a user, newest first.
+func ExportListJobs(user *User) (jobs []ExportJob) {
+	exportJobs.Lock()
+	defer exportJobs.Unlock()
+	for _, job := range exportJobs.jobs {
+		if user == nil || job.UserID == user.ID {
+			jobs = append(jobs, *job)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID > jobs[j].ID })
+	return
+}
+
+// Cancel a running export job, or remove a finished export job and its file.
+func ExportRemoveJob(user *User, ID int64) bool {
+	exportJobs.Lock()
+	defer exportJobs.Unlock()
+	job, ok := exportJobs.jobs[ID]
+	if !ok || (user != nil && job.UserID != user.ID) {
+		return false
+	}
+	if job.Status == ExportStatusRunning {
+		job.cancel() // The job removes its file when it stops.
+		return true
+	}
+	os.Remove(job.path)
+	delete(exportJobs.jobs, ID)
+	return true
+}
+
+// Cancel every running export job, such as on shutdown.
+func ExportCancelAll() {
+	exportJobs.Lock()
+	defer exportJobs.Unlock()
+	for _, job := range exportJobs.jobs {
+		if job.Status == ExportStatusRunning {
+			job.cancel()
+		}
+	}
+}
+
+// Open the file of a complete export job.
+func ExportOpenJob(job ExportJob) (*os.File, error) {
+	if job.Status != ExportStatusComplete {
+		return nil, fmt.Errorf("Export is not complete.")
+	}
+	return os.Open(job.path)
+}
+
+// Remove export jobs and files older than the configured retention, including files from before a restart.
+func ExportCleanup() {
+	maxAge := time.Now().Add(app.Config().ExportRetention * time.Second * -1)
+
+	exportJobs.Lock()
+	for ID, job := range exportJobs.jobs {
+		if job.Status != ExportStatusRunning && job.Finished.Before(maxAge) {
+			os.Remove(job.path)
+			delete(exportJobs.jobs, ID)
+		}
+	}
+	exportJobs.Unlock()
+
+	files, err := ioutil.ReadDir(app.Config().ExportPath)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), "export-") && file.ModTime().Before(maxAge) {
+			os.Remove(path.Join(app.Config().ExportPath, file.Name()))
+		}
+	}
+}
@@ -4,13 +4,19 @@ go 1.14
 
 require (
 	github.com/DusanKasan/parsemail v1.2.0
+	github.com/coreos/go-oidc v2.2.1+incompatible
 	github.com/emersion/go-smtp v0.13.0
+	github.com/go-asn1-ber/asn1-ber v1.5.1
+	github.com/go-ldap/ldap/v3 v3.3.0
 	github.com/google/uuid v1.1.1
 	github.com/gorilla/mux v1.7.4
 	github.com/gorilla/websocket v1.4.2
 	github.com/jinzhu/configor v1.2.0
 	github.com/jinzhu/gorm v1.9.14
+	github.com/pquerna/cachecontrol v0.2.0 // indirect
 	github.com/urfave/cli v1.22.4
-	golang.org/x/crypto v0.0.0-20200709230013-948cd5f35899 // indirect
+	golang.org/x/crypto v0.0.0-20200709230013-948cd5f35899
+	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
 	gopkg.in/mcuadros/go-syslog.v2 v2.3.0
+	gopkg.in/square/go-jose.v2 v2.6.0 // indirect
 )
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Status of a component, and of the application as a whole.
+const (
+	HealthOK   = "ok"
+	HealthFail = "fail"
+)
+
+// States of listeners.
+const (
+	HealthListenerListening = "listening"
+	HealthListenerFailed    = "failed"  // Unable to listen, such as the port being in use.
+	HealthListenerStopped   = "stopped" // Stopped on shutdown, or unexpectedly.
+	HealthListenerDisabled  = "disabled"
+)
+
+// Paths of the health checks. They do not require authentication, so orchestrators can reach them.
+const (
+	HealthPath    = "/healthz" // Fails if the application must be restarted.
+	ReadinessPath = "/readyz"  // Fails if the application cannot archive mail, or is shutting down.
+)
+
+// State of a component of the application.
+type HealthComponent struct {
+	Status string     `json:"status"`
+	State  string     `json:"state,omitempty"` // The state of a listener.
+	Error  string     `json:"error,omitempty"`
+	Time   *time.Time `json:"time,omitempty"` // When the component last did its work, such as the last cleanup.
+}
+
+// Response with the state of each component.
+type HealthResp struct {
+	Status     string                     `json:"status"`
+	Components map[string]HealthComponent `json:"components"`
+}
+
+// Listener states, and when work was last done by background components.
+var healthState = struct {
+	sync.Mutex
+	started         time.Time
+	listeners       map[string]HealthComponent
+	lastCleanup     time.Time // When cleanup last finished.
+	cleanupActivity time.Time // When cleanup last started, deleted a message or finished.
+	lastSysLog      time.Time
+}{started: time.Now(), listeners: make(map[string]HealthComponent)}
+
+// Record the state of a listener, with the error if it failed.
+func HealthSetListener(name string, state string, err error) {
+	component := HealthComponent{Status: HealthOK, State: state}
+	if state == HealthListenerFailed || state == HealthListenerStopped {
+		component.Status = HealthFail
+	}
+	if err != nil {
+		component.Error = err.Error()
+	}
+	healthState.Lock()
+	healthState.listeners[name] = component
+	healthState.Unlock()
+}
+
+// Record that cleanup of old messages started, or deleted a message, so a long cleanup is not considered stuck.
+func HealthRecordCleanupActivity() {
+	healthState.Lock()
+	healthState.cleanupActivity = time.Now()
+	healthState.Unlock()
+}
+
+// Record that cleanup of old messages finished.
+func HealthRecordCleanup() {
+	healthState.Lock()
+	healthState.lastCleanup = time.Now()
+	healthState.cleanupActivity = healthState.lastCleanup
+	healthState.Unlock()
+}
+
+// Record that a syslog message was received.
+func HealthRecordSysLog() {
+	healthState.Lock()
+	healthState.lastSysLog = time.Now()
+	healthState.Unlock()
+}
+
+// Check that the database responds.
+func healthCheckDatabase() HealthComponent {
+	if err := app.db.DB().Ping(); err != nil {
+		return HealthComponent{Status: HealthFail, Error: err.Error()}
+	}
+	return HealthComponent{Status: HealthOK}
+}
+
+// Check that files can be written to a directory.
+func healthCheckWritable(dir string) HealthComponent {
+	if err := commandCheckWritable(dir); err != nil {
+		return HealthComponent{Status: HealthFail, Error: err.Error()}
+	}
+	return HealthComponent{Status: HealthOK}
+}
+
+// Check the state of the application. Components which would not recover without a restart are checked for liveness,
+// while every component is checked for readiness.
+func HealthCheck(readiness bool) HealthResp {
+	resp := HealthResp{Status: HealthOK, Components: make(map[string]HealthComponent)}
+
+	healthState.Lock()
+	for name, component := range healthState.listeners {
+		resp.Components[name] = component
+	}
+	started, lastCleanup, cleanupActivity, lastSysLog := healthState.started, healthState.lastCleanup, healthState.cleanupActivity, healthState.lastSysLog
+	healthState.Unlock()
+
+	// Cleanup runs on an interval, so if it missed a run, or stopped deleting messages part way through, it is stuck.
+	// A cleanup which takes longer than the interval, such as after max_age is lowered, is fine while it makes progress.
+	cleanup := HealthComponent{Status: HealthOK}
+	if !lastCleanup.IsZero() {
+		cleanup.Time = &lastCleanup
+	}
+	if cleanupActivity.IsZero() {
+		cleanupActivity = started
+	}
+	if time.Since(cleanupActivity) > 2*cleanupInterval {
+		cleanup.Status = HealthFail
+		cleanup.Error = "Cleanup has made no progress since " + cleanupActivity.Format(time.RFC3339)
+	}
+	resp.Components["cleanup"] = cleanup
+
+	if readiness {
+		resp.Components["database"] = healthCheckDatabase()
+		if app.Config().MailPath == "db" {
+			resp.Components["mail_storage"] = resp.Components["database"]
+		} else {
+			resp.Components["mail_storage"] = healthCheckWritable(app.Config().MailPath)
+		}
+		resp.Components["export_storage"] = healthCheckWritable(app.Config().ExportPath)
+
+		// Mail servers may go quiet, so syslog is only considered failed if a maximum age is configured.
+		sysLog := HealthComponent{Status: HealthOK}
+		if !lastSysLog.IsZero() {
+			sysLog.Time = &lastSysLog
+		} else {
+			lastSysLog = started
+		}
+		if app.Config().HealthSysLogMaxAge > 0 && time.Since(lastSysLog) > app.Config().HealthSysLogMaxAge*time.Second {
+			sysLog.Status = HealthFail
+			sysLog.Error = "No syslog messages received since " + lastSysLog.Format(time.RFC3339)
+		}
+		resp.Components["syslog"] = sysLog
+
+		// Once shutdown starts, no new work should be sent.
+		if app.work.Stopping() {
+			resp.Components["shutdown"] = HealthComponent{Status: HealthFail, Error: "Shutting down"}
+		}
+	}
+
+	for _, component := range resp.Components {
+		if component.Status != HealthOK {
+			resp.Status = HealthFail
+		}
+	}
+	return resp
+}
+
+// Respond with the state of each component, with a 503 status if any failed.
+func (s *HTTPServer) HealthHandler(readiness bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := HealthCheck(readiness)
+		if resp.Status != HealthOK {
+			s.JSONResponseCode(w, http.StatusServiceUnavailable, resp)
+			return
+		}
+		s.JSONResponse(w, resp)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 
 	"github.com/gorilla/mux"
@@ -10,6 +11,7 @@ import (
 
 // Basic HTTP server structure.
 type HTTPServer struct {
+	server      *http.Server
 	ws          *WS
 	wsInterface *WSInterface
 }
@@ -17,13 +19,13 @@ type HTTPServer struct {
 // This functions starts the HTTP server.
 func HTTPServe() {
 	// Get the configuration/
-	httpBindAddr := app.config.HTTPBindAddr
-	httpPort := app.config.HTTPPort
-	if app.context.String("http-bind") != "" {
-		httpBindAddr = app.context.String("http-bind")
+	httpBindAddr := app.Config().HTTPBindAddr
+	httpPort := app.Config().HTTPPort
+	if app.context.GlobalString("http-bind") != "" {
+		httpBindAddr = app.context.GlobalString("http-bind")
 	}
-	if app.context.Uint("http-port") != 0 {
-		httpPort = app.context.Uint("http-port")
+	if app.context.GlobalUint("http-port") != 0 {
+		httpPort = app.context.GlobalUint("http-port")
 	}
 
 	// Create the server.
@@ -36,26 +38,34 @@ func HTTPServe() {
 
 	// Set the handlers.
 	r := mux.NewRouter()
+	// Give each request an ID for logs, record the time taken to respond, then require authentication for the API and websocket if enabled.
+	r.Use(httpServer.RequestIDMiddleware)
+	r.Use(httpServer.MetricsMiddleware)
+	r.Use(httpServer.AuthMiddleware)
+	r.HandleFunc(MetricsPath, httpServer.MetricsHandler)
+	r.HandleFunc(HealthPath, httpServer.HealthHandler(false))
+	r.HandleFunc(ReadinessPath, httpServer.HealthHandler(true))
 	httpServer.RegisterAPIRoutes(r)
 	r.HandleFunc("/ws", httpServer.ws.Handler)
-	fs := http.FileServer(http.Dir(app.config.StaticContentPath))
+	fs := http.FileServer(http.Dir(app.Config().StaticContentPath))
 	r.PathPrefix("/").Handler(fs)
 
-	// The http server handler will be the mux router by default.
-	var handler http.Handler
-	handler = r
-	// If the debug log is enabled, we'll add a middleware handler to log then pass the request to mux router.
-	if app.config.HTTPDebug {
-		handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-			log.Println(req.Method + " " + req.URL.String())
-			r.ServeHTTP(w, req)
-		})
+	// Routes missing from the OpenAPI document should be found during development.
+	for _, problem := range OpenAPICheckRoutes(r) {
+		logAPI.Warn("Route is missing from the OpenAPI document", "problem", problem)
 	}
 
-	// Start the server.
-	log.Println("Starting http server on port", httpPort)
-	err := http.ListenAndServe(fmt.Sprintf("%s:%d", httpBindAddr, httpPort), handler)
+	// Start the server. Errors from the server, such as failed TLS handshakes, are logged as warnings.
+	logAPI.Info("Starting http server", "port", httpPort)
+	httpServer.server = &http.Server{Addr: fmt.Sprintf("%s:%d", httpBindAddr, httpPort), Handler: r, ErrorLog: log.New(LogWriter{logAPI, LogLevelWarn}, "", 0)}
+	listener, err := net.Listen("tcp", httpServer.server.Addr)
 	if err != nil {
-		log.Fatal(err)
+		logAPI.Fatal("Unable to start http server", "error", err)
+	}
+	HealthSetListener("http_listener", HealthListenerListening, nil)
+	err = httpServer.server.Serve(listener)
+	HealthSetListener("http_listener", HealthListenerStopped, nil)
+	if err != nil && err != http.ErrServerClosed {
+		logAPI.Fatal("Http server failed", "error", err)
 	}
 }
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// Formats mail may be imported from.
+const (
+	ImportFormatAuto    = "auto" // Detected from each path.
+	ImportFormatMbox    = "mbox"
+	ImportFormatMaildir = "maildir"
+	ImportFormatEML     = "eml" // An EML file, or a directory of them.
+)
+
+// Progress is saved after this many messages, so an interrupted import does not start over.
+const importSaveInterval = 100
+
+// Progress of an import, saved so that an interrupted import can be resumed.
+type ImportState struct {
+	// Byte offset of the next message in each mbox file already imported, by absolute path.
+	Positions map[string]int64 `json:"positions"`
+	// Hash of the start of each mbox file, so an offset is not used if the file was replaced.
+	Fingerprints map[string]string `json:"fingerprints"`
+	Failures     []ImportFailure   `json:"failures"`
+}
+
+// A message which could not be imported.
+type ImportFailure struct {
+	Path     string `json:"path"`     // The mbox file, or the file in a directory.
+	Location string `json:"location"` // Byte offset of the message in an mbox file.
+	Error    string `json:"error"`
+}
+
+// Imports messages into the archive, keeping track of progress.
+type Importer struct {
+	State      ImportState
+	StatePath  string // Where progress is saved, if set.
+	Imported   int
+	Duplicates int
+	Failed     int
+	unsaved    int // Messages since progress was last saved.
+}
+
+// Lines starting with From are quoted in mbox files, which is undone on import.
+var mboxQuotedFromLineRx = regexp.MustCompile(`^>(>*From )`)
+
+// Load the progress of a previous import, if any.
+func NewImporter(statePath string) (*Importer, error) {
+	i := &Importer{StatePath: statePath}
+	i.State.Positions = make(map[string]int64)
+	i.State.Fingerprints = make(map[string]string)
+	if statePath == "" {
+		return i, nil
+	}
+	data, err := ioutil.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		return i, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &i.State); err != nil {
+		return nil, fmt.Errorf("Unable to read import progress from %s: %s", statePath, err)
+	}
+	if i.State.Positions == nil {
+		i.State.Positions = make(map[string]int64)
+	}
+	if i.State.Fingerprints == nil {
+		i.State.Fingerprints = make(map[string]string)
+	}
+	return i, nil
+}
+
+// Save the progress of the import. The file is replaced, so progress is not lost if interrupted while saving.
+func (i *Importer) Save() error {
+	i.unsaved = 0
+	if i.StatePath == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(i.State, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(i.StatePath+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(i.StatePath+".tmp", i.StatePath)
+}
+
+// Record that a message was handled, saving progress every so often.
+func (i *Importer) progress() {
+	i.unsaved++
+	if i.unsaved >= importSaveInterval {
+		if err := i.Save(); err != nil {
+			logImport.Error("Unable to save import progress", "error", err)
+		}
+		logImport.Info("Import progress", "imported", i.Imported, "duplicates", i.Duplicates, "failed", i.Failed)
+	}
+}
+
+// Record a message which could not be imported.
+func (i *Importer) fail(path string, location string, err error) {
+	i.Failed++
+	i.State.Failures = append(i.State.Failures, ImportFailure{Path: path, Location: location, Error: err.Error()})
+	logImport.Warn("Unable to import message", "path", path, "location", location, "error", err)
+}
+
+// Determine the format of a path to import.
+func ImportDetectFormat(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		if strings.EqualFold(filepath.Ext(path), ".eml") {
+			return ImportFormatEML, nil
+		}
+		return ImportFormatMbox, nil
+	}
+	// A Maildir has a cur directory for messages which were seen.
+	if info, err := os.Stat(filepath.Join(path, "cur")); err == nil && info.IsDir() {
+		return ImportFormatMaildir, nil
+	}
+	return ImportFormatEML, nil
+}
+
+// Determine when a message was received from its most recent Received header, or its Date header.
+// If neither can be parsed, the fallback is used, such as the time in an mbox From line or the file time.
+func ImportReceivedTime(header mail.Header, fallback time.Time) time.Time {
+	// The most recent Received header is first, with the time after the semicolon.
+	if received := header["Received"]; len(received) != 0 {
+		if i := strings.LastIndex(received[0], ";"); i != -1 {
+			if t, err := mail.ParseDate(strings.TrimSpace(received[0][i+1:])); err == nil {
+				return t
+			}
+		}
+	}
+	if t, err := header.Date(); err == nil {
+		return t
+	}
+	return fallback
+}
+
+// Check if a message was already archived, by its Message-ID or hash.
+func ImportIsDuplicate(messageID string, hash string) bool {
+	count := 0
+	db := app.db.Model(&MessageLog{}).Where("hash = ?", hash)
+	if messageID != "" {
+		db = db.Or("message_id = ?", messageID)
+	}
+	db.Count(&count)
+	return count != 0
+}
+
+// Import a message unless it was already archived. The envelope sender is used if the message has no From header.
+func (i *Importer) Message(from string, data []byte, fallback time.Time) error {
+	// Messages received over SMTP are stored with CRLF line endings, which imported messages are converted to.
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	data = bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	messageID := strings.Trim(strings.TrimSpace(msg.Header.Get("Message-ID")), "<>")
+	if ImportIsDuplicate(messageID, MailHash(data)) {
+		i.Duplicates++
+		return nil
+	}
+
+	// The envelope is recorded by the delivering server in these headers, where available.
+	if returnPath := strings.Trim(strings.TrimSpace(msg.Header.Get("Return-Path")), "<>"); returnPath != "" {
+		from = returnPath
+	}
+	var to []string
+	for _, header := range []string{"Delivered-To", "X-Original-To"} {
+		for _, address := range msg.Header[header] {
+			to = append(to, strings.Trim(strings.TrimSpace(address), "<>"))
+		}
+	}
+
+	_, err = MailStoreMessage("", from, to, data, ImportReceivedTime(msg.Header, fallback))
+	if err != nil {
+		return err
+	}
+	i.Imported++
+	return nil
+}
+
+// Import every message in an mbox file, starting after the messages of a previous import.
+func (i *Importer) Mbox(path string) error {
+	fp, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	info, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+
+	// Continue after the messages of a previous import, unless the file was replaced or truncated since.
+	// Messages are appended to mbox files, so the start of the file stays the same.
+	var offset int64
+	fingerprint := ""
+	if stored := i.State.Positions[path]; stored != 0 && stored <= info.Size() {
+		fingerprint, err = mboxFingerprint(fp, stored)
+		if err == nil && fingerprint == i.State.Fingerprints[path] {
+			offset = stored
+		} else {
+			fingerprint = ""
+			logImport.Info("Mbox file changed since it was last imported, starting from the beginning", "path", path)
+		}
+	}
+	if _, err := fp.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	var message bytes.Buffer
+	var messageStart int64 = -1
+	var from string
+	var fallback time.Time
+	// Import the message read so far, which ends where the next one begins.
+	flush := func(end int64) {
+		if messageStart == -1 {
+			return
+		}
+		// The blank line before the next From line separates messages, and is not part of the message.
+		data := message.Bytes()
+		if bytes.HasSuffix(data, []byte("\n\n")) {
+			data = data[:len(data)-1]
+		} else if bytes.HasSuffix(data, []byte("\r\n\r\n")) {
+			data = data[:len(data)-2]
+		}
+		if err := i.Message(from, data, fallback); err != nil {
+			i.fail(path, strconv.FormatInt(messageStart, 10), err)
+		}
+		// The fingerprint only changes until the previous offset is past the fingerprinted start of the file.
+		if fingerprint == "" || i.State.Positions[path] < logFileFingerprintSize {
+			var err error
+			if fingerprint, err = mboxFingerprint(fp, end); err != nil {
+				logImport.Error("Unable to fingerprint mbox file", "path", path, "error", err)
+			}
+		}
+		i.State.Positions[path] = end
+		i.State.Fingerprints[path] = fingerprint
+		i.progress()
+	}
+
+	reader := bufio.NewReader(fp)
+	previousBlank := true
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) != 0 {
+			if previousBlank && bytes.HasPrefix(line, []byte("From ")) {
+				flush(offset)
+				message.Reset()
+				messageStart = offset
+				// The From line has the envelope sender and the time the message was delivered.
+				from, fallback = "", info.ModTime()
+				fields := strings.Fields(string(line))
+				if len(fields) >= 2 && fields[1] != "MAILER-DAEMON" {
+					from = fields[1]
+				}
+				if len(fields) >= 7 {
+					if t, err := time.Parse(time.ANSIC, strings.Join(fields[2:7], " ")); err == nil {
+						fallback = t
+					}
+				}
+			} else if messageStart != -1 {
+				message.Write(mboxQuotedFromLineRx.ReplaceAll(line, []byte("$1")))
+			}
+			previousBlank = len(bytes.TrimRight(line, "\r\n")) == 0
+			offset += int64(len(line))
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	flush(offset)
+	return nil
+}
+
+// Hash the start of an mbox file, up to the offset of the next message.
+func mboxFingerprint(fp *os.File, offset int64) (string, error) {
+	size := logFileFingerprintSize
+	if offset < int64(size) {
+		size = int(offset)
+	}
+	return LogFileFingerprint(fp, size)
+}
+
+// Import every message in a Maildir, including its folders, or a directory of EML files.
+// Every file is read again when an import is resumed, as Maildir files are moved and renamed when read by a mail client.
+// Files imported previously are skipped as duplicates.
+func (i *Importer) Dir(path string, format string) error {
+	var files []string
+	err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		// Maildir messages are in cur and new, while tmp has messages still being delivered.
+		dir := filepath.Base(filepath.Dir(file))
+		if format == ImportFormatMaildir && dir != "cur" && dir != "new" {
+			return nil
+		}
+		if format == ImportFormatEML && strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+		files = append(files, file)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		err := func() error {
+			info, err := os.Stat(file)
+			if err != nil {
+				return err
+			}
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			return i.Message("", data, info.ModTime())
+		}()
+		if err != nil {
+			i.fail(file, "", err)
+		}
+		i.progress()
+	}
+	return nil
+}
+
+// Import a path in the format provided, or the format detected.
+func (i *Importer) Import(path string, format string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if format == ImportFormatAuto {
+		if format, err = ImportDetectFormat(path); err != nil {
+			return err
+		}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	switch {
+	case format == ImportFormatMbox && !info.IsDir():
+		err = i.Mbox(path)
+	case format == ImportFormatMaildir && info.IsDir(), format == ImportFormatEML:
+		// A single EML file is imported as a directory with one file.
+		err = i.Dir(path, format)
+	default:
+		err = fmt.Errorf("%s is not in %s format", path, format)
+	}
+	if saveErr := i.Save(); err == nil {
+		err = saveErr
+	}
+	return err
+}
+
+// Flags for the import command.
+func importFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "format, f",
+			Value: ImportFormatAuto,
+			Usage: "Mail `FORMAT`, either auto, mbox, maildir or eml",
+		},
+		cli.StringFlag{
+			Name:  "state, s",
+			Value: "mail-archive-import.json",
+			Usage: "Save progress to `FILE`, so an interrupted import can be resumed",
+		},
+	}
+}
+
+// Import mail from mbox files, Maildirs and EML files, skipping messages which were already archived.
+func ImportCommand(c *cli.Context) error {
+	format := c.String("format")
+	if format != ImportFormatAuto && format != ImportFormatMbox && format != ImportFormatMaildir && format != ImportFormatEML {
+		return fmt.Errorf("Unknown mail format: %s", format)
+	}
+	if c.NArg() == 0 {
+		return fmt.Errorf("No mail provided.")
+	}
+	importer, err := NewImporter(c.String("state"))
+	if err != nil {
+		return err
+	}
+	appSetup(c)
+
+	failures := len(importer.State.Failures)
+	for _, path := range c.Args() {
+		if err := importer.Import(path, format); err != nil {
+			logImport.Error("Unable to import", "path", path, "error", err)
+		}
+	}
+
+	// Summarize the import, with each message which failed.
+	logImport.Info("Import complete", "imported", importer.Imported, "duplicates", importer.Duplicates, "failed", importer.Failed)
+	for _, failure := range importer.State.Failures[failures:] {
+		logImport.Warn("Message failed to import", "path", failure.Path, "location", failure.Location, "error", failure.Error)
+	}
+	return nil
+}
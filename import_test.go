@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A message as written to an mbox file, with its From line and the blank line separating it from the next.
+func testMboxMessage(id string, body string) string {
+	return fmt.Sprintf("From sender@example.com Sat Oct 18 12:00:00 2026\n%s\n", testEML(id, body))
+}
+
+// A message with the Message-ID and body provided.
+func testEML(id string, body string) string {
+	return fmt.Sprintf("From: sender@example.com\nTo: user@example.com\nSubject: Message %s\nMessage-ID: <%s@example.com>\n\n%s\n", id, id, body)
+}
+
+// Read the stored data of an imported message.
+func testImportedData(t *testing.T, id string) string {
+	var entry MessageLog
+	app.db.Where("message_id = ?", id+"@example.com").First(&entry)
+	if entry.UUID == "" {
+		t.Fatalf("message %s was not imported", id)
+	}
+	reader, err := MailGetMessageData(entry.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestImporterMbox(t *testing.T) {
+	testApp(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "archive.mbox")
+	statePath := filepath.Join(dir, "state.json")
+	testAppendFile(t, path, testMboxMessage("1", ">From the start of a line\n>>From quoted twice\n\nlast line")+testMboxMessage("2", "Second"))
+
+	tests := []struct {
+		name       string
+		change     func()
+		imported   int
+		duplicates int
+	}{
+		{"messages are imported", func() {}, 2, 0},
+		{"resume after the messages imported", func() { testAppendFile(t, path, testMboxMessage("3", "Third")) }, 1, 0},
+		{"nothing new", func() {}, 0, 0},
+		{"replaced file starts over", func() {
+			data := testMboxMessage("4", "A message longer than the first message it replaced, so the offset is within the file.") +
+				testMboxMessage("2", "Second") + testMboxMessage("3", "Third")
+			if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}, 1, 2},
+	}
+	for _, test := range tests {
+		test.change()
+		importer, err := NewImporter(statePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := importer.Import(path, ImportFormatAuto); err != nil {
+			t.Fatal(err)
+		}
+		if importer.Imported != test.imported || importer.Duplicates != test.duplicates || importer.Failed != 0 {
+			t.Errorf("%s: imported %d, duplicates %d and failed %d, expected %d imported and %d duplicates",
+				test.name, importer.Imported, importer.Duplicates, importer.Failed, test.imported, test.duplicates)
+		}
+	}
+
+	// Quoted From lines are unquoted once, and the blank line separating messages is not part of the message.
+	data := testImportedData(t, "1")
+	if !strings.Contains(data, "\r\nFrom the start of a line\r\n>From quoted twice\r\n") {
+		t.Errorf("From lines were not unquoted: %q", data)
+	}
+	if !strings.HasSuffix(data, "\r\n\r\nlast line\r\n") {
+		t.Errorf("message does not end with its last line: %q", data)
+	}
+	if data := testImportedData(t, "3"); !strings.HasSuffix(data, "\r\n\r\nThird\r\n") {
+		t.Errorf("last message in the file does not end with its last line: %q", data)
+	}
+}
+
+func TestImporterMaildir(t *testing.T) {
+	testApp(t)
+	dir := t.TempDir()
+	files := map[string]string{
+		"cur/1.mx1:2,S":       testEML("cur", "Seen"),
+		"new/2.mx1":           testEML("new", "Not yet seen"),
+		"tmp/3.mx1":           testEML("tmp", "Still being delivered"),
+		".Sent/cur/4.mx1:2,S": testEML("sent", "In a folder"),
+		"dovecot-uidlist":     "3 V1 N5\n",
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		testAppendFile(t, path, data)
+	}
+
+	importer, err := NewImporter("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format, err := ImportDetectFormat(dir); err != nil || format != ImportFormatMaildir {
+		t.Fatalf("detected %s format, expected maildir", format)
+	}
+	if err := importer.Import(dir, ImportFormatAuto); err != nil {
+		t.Fatal(err)
+	}
+	if importer.Imported != 3 || importer.Failed != 0 {
+		t.Errorf("imported %d and failed %d, expected 3 imported", importer.Imported, importer.Failed)
+	}
+	for _, id := range []string{"cur", "new", "sent"} {
+		testImportedData(t, id)
+	}
+	count := 0
+	app.db.Model(&MessageLog{}).Where("message_id = ?", "tmp@example.com").Count(&count)
+	if count != 0 {
+		t.Error("message still being delivered in tmp was imported")
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Formats log lines may be written in.
+const (
+	LogFormatText   = "text"   // Easy to read in a terminal.
+	LogFormatJSON   = "json"   // One JSON object per line.
+	LogFormatLogfmt = "logfmt" // Key and value pairs.
+)
+
+// Levels of log lines, from most to least verbose.
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+// Names of log levels, as used in the configuration and log lines.
+var logLevelNames = map[string]LogLevel{
+	"debug": LogLevelDebug,
+	"info":  LogLevelInfo,
+	"warn":  LogLevelWarn,
+	"error": LogLevelError,
+}
+
+// Get the name of a log level.
+func (level LogLevel) String() string {
+	for name, l := range logLevelNames {
+		if l == level {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// Check if a log level name is one we know about.
+func LogValidLevel(name string) bool {
+	_, ok := logLevelNames[name]
+	return ok
+}
+
+// Subsystems which log, each of which may have its own level.
+const (
+	LogSubsystemApp     = "app" // Start up, shutdown, configuration and commands.
+	LogSubsystemSMTP    = "smtp"
+	LogSubsystemSysLog  = "syslog" // The syslog server and log files.
+	LogSubsystemAPI     = "api"
+	LogSubsystemAuth    = "auth"
+	LogSubsystemCleanup = "cleanup"
+	LogSubsystemExport  = "export"
+	LogSubsystemImport  = "import"
+	LogSubsystemWS      = "ws"
+)
+
+// All subsystems which log.
+var LogSubsystems = []string{LogSubsystemApp, LogSubsystemSMTP, LogSubsystemSysLog, LogSubsystemAPI, LogSubsystemAuth, LogSubsystemCleanup, LogSubsystemExport, LogSubsystemImport, LogSubsystemWS}
+
+// Logs lines for a subsystem, with fields added to every line.
+type Logger struct {
+	subsystem string
+	fields    []interface{}
+}
+
+// Loggers of each subsystem.
+var (
+	logApp     = NewLogger(LogSubsystemApp)
+	logSMTP    = NewLogger(LogSubsystemSMTP)
+	logSysLog  = NewLogger(LogSubsystemSysLog)
+	logAPI     = NewLogger(LogSubsystemAPI)
+	logAuth    = NewLogger(LogSubsystemAuth)
+	logCleanup = NewLogger(LogSubsystemCleanup)
+	logExport  = NewLogger(LogSubsystemExport)
+	logImport  = NewLogger(LogSubsystemImport)
+	logWS      = NewLogger(LogSubsystemWS)
+)
+
+// Log lines are written here, one at a time.
+var (
+	logOutput io.Writer = os.Stderr
+	logMutex  sync.Mutex
+)
+
+// Create a logger for a subsystem.
+func NewLogger(subsystem string) *Logger {
+	return &Logger{subsystem: subsystem}
+}
+
+// Create a logger which adds fields to every line, provided as key and value pairs.
+func (l *Logger) With(fields ...interface{}) *Logger {
+	return &Logger{subsystem: l.subsystem, fields: append(append([]interface{}{}, l.fields...), fields...)}
+}
+
+// Check if lines of a level are logged for the subsystem. The configuration is read each time, so it may be reloaded.
+func (l *Logger) Enabled(level LogLevel) bool {
+	minimum := LogLevelInfo
+	if app != nil {
+		config := app.Config()
+		if name, ok := config.LogLevels[l.subsystem]; ok {
+			minimum = logLevelNames[name]
+		} else if name, ok := logLevelNames[config.LogLevel]; ok {
+			minimum = name
+		}
+	}
+	return level >= minimum
+}
+
+// Log a line for debugging, with fields provided as key and value pairs.
+func (l *Logger) Debug(msg string, fields ...interface{}) {
+	l.Log(LogLevelDebug, msg, fields...)
+}
+
+// Log a line about normal operation.
+func (l *Logger) Info(msg string, fields ...interface{}) {
+	l.Log(LogLevelInfo, msg, fields...)
+}
+
+// Log a line about a problem which did not stop the work being done.
+func (l *Logger) Warn(msg string, fields ...interface{}) {
+	l.Log(LogLevelWarn, msg, fields...)
+}
+
+// Log a line about work which failed.
+func (l *Logger) Error(msg string, fields ...interface{}) {
+	l.Log(LogLevelError, msg, fields...)
+}
+
+// Log an error, then exit.
+func (l *Logger) Fatal(msg string, fields ...interface{}) {
+	l.Log(LogLevelError, msg, fields...)
+	os.Exit(1)
+}
+
+// Log a line at a level, if enabled for the subsystem.
+func (l *Logger) Log(level LogLevel, msg string, fields ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	format := LogFormatText
+	if app != nil && app.Config().LogFormat != "" {
+		format = app.Config().LogFormat
+	}
+	line := logFormatLine(format, time.Now(), level, l.subsystem, msg, append(append([]interface{}{}, l.fields...), fields...))
+
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	io.WriteString(logOutput, line+"\n")
+}
+
+// Convert a field value to one which may be written, such as the message of an error.
+func logFieldValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	case time.Time:
+		return v.Format(time.RFC3339)
+	}
+	return value
+}
+
+// Values with spaces, quotes or equal signs must be quoted in text and logfmt lines.
+var logNeedsQuote = regexp.MustCompile(`[\s"=]|^$`)
+
+// Format a field value for text and logfmt lines.
+func logFormatValue(value interface{}) string {
+	s := fmt.Sprint(logFieldValue(value))
+	if logNeedsQuote.MatchString(s) {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
+
+// Format a log line. Fields are key and value pairs, and a key without a value is logged with an empty value.
+func logFormatLine(format string, t time.Time, level LogLevel, subsystem string, msg string, fields []interface{}) string {
+	if len(fields)%2 != 0 {
+		fields = append(fields, "")
+	}
+
+	switch format {
+	case LogFormatJSON:
+		entry := map[string]interface{}{"time": t.Format(time.RFC3339Nano), "level": level.String(), "subsystem": subsystem, "msg": msg}
+		for i := 0; i < len(fields); i += 2 {
+			entry[fmt.Sprint(fields[i])] = logFieldValue(fields[i+1])
+		}
+		js, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Sprintf(`{"level":"error","msg":%q}`, "Unable to encode log line: "+err.Error())
+		}
+		return string(js)
+
+	case LogFormatLogfmt:
+		pairs := []string{"time=" + t.Format(time.RFC3339Nano), "level=" + level.String(), "subsystem=" + subsystem, "msg=" + logFormatValue(msg)}
+		for i := 0; i < len(fields); i += 2 {
+			pairs = append(pairs, fmt.Sprint(fields[i])+"="+logFormatValue(fields[i+1]))
+		}
+		return strings.Join(pairs, " ")
+	}
+
+	// The text format keeps the look of the standard logger, with the level and subsystem before the message.
+	line := t.Format("2006/01/02 15:04:05") + " " + strings.ToUpper(level.String()) + " " + subsystem + ": " + msg
+	for i := 0; i < len(fields); i += 2 {
+		line += " " + fmt.Sprint(fields[i]) + "=" + logFormatValue(fields[i+1])
+	}
+	return line
+}
+
+// Writes lines from the standard logger, such as those of libraries, to a subsystem.
+type LogWriter struct {
+	Logger *Logger
+	Level  LogLevel
+}
+
+// Log each line written.
+func (w LogWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		w.Logger.Log(w.Level, line)
+	}
+	return len(p), nil
+}
+
+// Printf for libraries which take a logger, such as the SMTP server.
+func (w LogWriter) Printf(format string, v ...interface{}) {
+	w.Logger.Log(w.Level, strings.TrimRight(fmt.Sprintf(format, v...), "\n"))
+}
+
+// Println for libraries which take a logger.
+func (w LogWriter) Println(v ...interface{}) {
+	w.Logger.Log(w.Level, strings.TrimRight(fmt.Sprintln(v...), "\n"))
+}
+
+// Check the log settings, returning each problem found.
+func LogValidateConfig(config Config) []string {
+	var problems []string
+	if config.LogFormat != LogFormatText && config.LogFormat != LogFormatJSON && config.LogFormat != LogFormatLogfmt {
+		problems = append(problems, fmt.Sprintf("log_format %s must be text, json or logfmt", config.LogFormat))
+	}
+	if !LogValidLevel(config.LogLevel) {
+		problems = append(problems, fmt.Sprintf("log_level %s must be debug, info, warn or error", config.LogLevel))
+	}
+	for subsystem, level := range config.LogLevels {
+		known := false
+		for _, s := range LogSubsystems {
+			known = known || s == subsystem
+		}
+		if !known {
+			problems = append(problems, fmt.Sprintf("log_levels %s is not a known subsystem, which are %s", subsystem, strings.Join(LogSubsystems, ", ")))
+		} else if !LogValidLevel(level) {
+			problems = append(problems, fmt.Sprintf("log_levels %s has invalid level %s", subsystem, level))
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// Key for the request ID in the context of a request.
+type logRequestIDKeyType struct{}
+
+var logRequestIDKey = logRequestIDKeyType{}
+
+// The request ID header, which is kept if provided by a proxy in front of the archive.
+const LogRequestIDHeader = "X-Request-ID"
+
+// Request IDs provided by a proxy are only kept if they are safe to log.
+var rxLogRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// Middleware which gives each request an ID, sent back in the X-Request-ID header and added to log lines.
+// Each request is logged at the debug level, or the info level if http_debug is enabled.
+func (s *HTTPServer) RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(LogRequestIDHeader)
+		if !rxLogRequestID.MatchString(requestID) {
+			requestID = uuid.New().String()
+		}
+		w.Header().Set(LogRequestIDHeader, requestID)
+		r = r.WithContext(context.WithValue(r.Context(), logRequestIDKey, requestID))
+
+		level := LogLevelDebug
+		if app.Config().HTTPDebug {
+			level = LogLevelInfo
+		}
+		LogRequest(logAPI, r).Log(level, "Request", "method", r.Method, "url", r.URL.String(), "remote_addr", r.RemoteAddr)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Get the ID of a request.
+func LogRequestID(r *http.Request) string {
+	requestID, _ := r.Context().Value(logRequestIDKey).(string)
+	return requestID
+}
+
+// Get a logger for a request, which adds its ID to every line.
+func LogRequest(logger *Logger, r *http.Request) *Logger {
+	return logger.With("request_id", LogRequestID(r))
+}
@@ -2,13 +2,17 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"net/mail"
 	"os"
 	"path"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -17,48 +21,56 @@ import (
 	"github.com/google/uuid"
 )
 
-// When a new message is received, this function is called to store it.
-func MailSaveMessage(remoteAddr string, from string, to string, r io.Reader) error {
+// Highest spam score stored, higher scores are stored as this.
+const MailMaxSpamScore = 1000
+
+// When a new message is received, this function is called to store it. The SMTP session ID is logged with the message.
+func MailSaveMessage(sessionID string, remoteAddr string, from string, to []string, r io.Reader) error {
 	// We need the message body in bytes to save.
 	b, err := ioutil.ReadAll(r)
 	if err != nil { // If we can't read, we have an issue.
 		return err
 	}
+	messageEntry, err := MailStoreMessage(remoteAddr, from, to, b, time.Now())
+	if err != nil {
+		return err
+	}
+	logSMTP.Info("Received message", "session", sessionID, "from", messageEntry.From, "bytes", messageEntry.Size, "uuid", messageEntry.UUID, "message_id", messageEntry.MessageID)
+	metricSMTPMessages.Inc()
+	metricSMTPBytes.Observe(float64(len(b)))
+
+	// Notify websocket subscribers of new message, if the message is within their scopes.
+	// The addresses are loaded once, rather than for each subscriber.
+	addresses := AuthMessageAddresses(messageEntry)
+	app.httpServer.wsInterface.sendMessageFiltered("receivedNewMessage", messageEntry, func(c *WSClient) bool {
+		return AuthAddressesInScope(c.user, addresses)
+	})
+
+	// Update message count.
+	app.httpServer.wsInterface.sendMessageCount()
+	return nil
+}
+
+// Parse and store a message with its message log entry and addresses, as received at the time provided.
+// Used for messages received over SMTP and those imported, which do not notify websocket subscribers.
+func MailStoreMessage(remoteAddr string, from string, to []string, b []byte, received time.Time) (messageEntry MessageLog, err error) {
 	// The email parser expects an io.Reader, but as we already read the reader passed. We must make a new one.
 	reader := bytes.NewReader(b)
 	// Parse the email
 	email, err := parsemail.Parse(reader)
 	if err != nil {
-		return err
+		metricParseFailures.Inc()
+		return
 	}
 	// Generate a UUID for this message.
 	UUID := uuid.New().String()
 
 	// Save message body using database or file if configured.
-	if app.config.MailPath == "db" {
-		// Save to database.
-		message := Messages{}
-		message.UUID = UUID
-		message.Message = b
-		app.db.Create(&message)
-	} else {
-		// If the directory configured in the config does not exist... We must fail.
-		if _, err := os.Stat(app.config.MailPath); err != nil {
-			return fmt.Errorf("Mail directory does not exist: %s", app.config.MailPath)
-		}
-		// Create the file.
-		messagePath := path.Join(app.config.MailPath, UUID)
-		fp, err := os.Create(messagePath)
-		if err != nil {
-			return err
-		}
-		// Write to the file
-		fp.Write(b)
-		fp.Close()
+	if err = MailWriteMessageData(UUID, b); err != nil {
+		return
 	}
 
 	// Create a message log entry with parsed email.
-	messageEntry := MessageLog{}
 	messageEntry.UUID = UUID
 	messageEntry.MessageID = email.MessageID
 	if len(email.From) <= 0 {
@@ -67,7 +79,9 @@ func MailSaveMessage(remoteAddr string, from string, to string, r io.Reader) err
 		messageEntry.From = email.From[0].Address
 	}
 	if len(email.To) <= 0 {
-		messageEntry.To = to
+		if len(to) > 0 {
+			messageEntry.To = to[0]
+		}
 	} else {
 		messageEntry.To = email.To[0].Address
 	}
@@ -82,9 +96,10 @@ func MailSaveMessage(remoteAddr string, from string, to string, r io.Reader) err
 	rxScore := regexp.MustCompile("Spam detection results:\\s+([0-9]+)")
 	matches := rxScore.FindStringSubmatch(spamScore)
 	if len(matches) == 2 {
+		// Scores are limited, as the header may be set by anyone sending mail.
 		spamScoreI, err := strconv.Atoi(matches[1])
-		if err != nil {
-			spamScoreI = 0
+		if err != nil || spamScoreI > MailMaxSpamScore {
+			spamScoreI = MailMaxSpamScore
 		}
 		messageEntry.SpamScore = spamScoreI
 	}
@@ -105,27 +120,69 @@ func MailSaveMessage(remoteAddr string, from string, to string, r io.Reader) err
 	}
 
 	messageEntry.Size = len(b)
-	messageEntry.Received = time.Now()
+	messageEntry.Hash = MailHash(b)
+	messageEntry.Received = received
 	messageEntry.Status = "unknown" // We start as unknown and the status is updated by syslog.
+	// The syslog for the message may have arrived before the message itself, if so we can apply the status now.
+	if status := SysLogMessageStatus(messageEntry.MessageID); status != "" {
+		messageEntry.Status = status
+	}
 
-	// Save the message entry.
+	// Save the message entry, and the addresses involved for finding messages by address.
 	app.db.Create(&messageEntry)
-	log.Printf("SMTP: Received message from %s (%d bytes)", messageEntry.From, messageEntry.Size)
-
-	// Notify websocket subscribers of new message.
-	app.httpServer.wsInterface.sendMessage("receivedNewMessage", messageEntry)
+	for _, address := range MailMessageAddresses(from, to, email) {
+		address.UUID = UUID
+		app.db.Create(&address)
+	}
 
 	// Update message count.
 	app.messageCount++
-	app.httpServer.wsInterface.sendMessage("updateMessageCount", app.messageCount)
-	return nil
+	return
+}
+
+// Hash of a message, for finding duplicates.
+func MailHash(b []byte) string {
+	hash := sha256.Sum256(b)
+	return hex.EncodeToString(hash[:])
+}
+
+// Collect the addresses in the envelope and headers of a message, lowercased and without duplicates per field.
+func MailMessageAddresses(from string, to []string, email parsemail.Email) (addresses []MessageAddress) {
+	seen := make(map[string]bool)
+	add := func(field string, address string) {
+		address = strings.ToLower(strings.TrimSpace(address))
+		if address == "" || seen[field+" "+address] {
+			return
+		}
+		seen[field+" "+address] = true
+		addresses = append(addresses, MessageAddress{Address: address, Field: field})
+	}
+	addList := func(field string, list []*mail.Address) {
+		for _, address := range list {
+			add(field, address.Address)
+		}
+	}
+
+	add("envelope_from", from)
+	for _, address := range to {
+		add("envelope_to", address)
+	}
+	addList("from", email.From)
+	if email.Sender != nil {
+		add("sender", email.Sender.Address)
+	}
+	addList("reply_to", email.ReplyTo)
+	addList("to", email.To)
+	addList("cc", email.Cc)
+	addList("bcc", email.Bcc)
+	return
 }
 
 // Finds and outputs a reader for the message body based on UUID.
 func MailGetMessageData(UUID string) (r io.Reader, err error) {
 	// If we are configured to use the database for storage, then we should check if the UUID is in the database.
 	// Otherwise, we check the path set to see if a file exists with the UUID.
-	if app.config.MailPath == "db" {
+	if app.Config().MailPath == "db" {
 		// Search database for message body by UUID.
 		var message Messages
 		app.db.Where("uuid = ?", UUID).First(&message)
@@ -138,80 +195,295 @@ func MailGetMessageData(UUID string) (r io.Reader, err error) {
 		r = bytes.NewReader(message.Message)
 	} else {
 		// Verify that the UUID exists in the file system.
-		if _, err = os.Stat(path.Join(app.config.MailPath, UUID)); err != nil {
+		if _, err = os.Stat(path.Join(app.Config().MailPath, UUID)); err != nil {
 			return
 		}
 		// If the file exists, we open it to return.
-		r, err = os.Open(path.Join(app.config.MailPath, UUID))
+		r, err = os.Open(path.Join(app.Config().MailPath, UUID))
 	}
 	// Return reader.
 	return
 }
 
+// Returned when a message under legal hold would be removed or redacted.
+var ErrMailHeld = errors.New("Message is under legal hold.")
+
+// Stores the message body in the database or file system based on configuration, replacing any existing body.
+func MailWriteMessageData(UUID string, b []byte) error {
+	if app.Config().MailPath == "db" {
+		// Save to database.
+		message := Messages{}
+		message.UUID = UUID
+		message.Message = b
+		return app.db.Save(&message).Error
+	}
+
+	// If the directory configured in the config does not exist... We must fail.
+	if _, err := os.Stat(app.Config().MailPath); err != nil {
+		return fmt.Errorf("Mail directory does not exist: %s", app.Config().MailPath)
+	}
+	// Create the file.
+	fp, err := os.Create(path.Join(app.Config().MailPath, UUID))
+	if err != nil {
+		return err
+	}
+	// Write to the file
+	_, err = fp.Write(b)
+	fp.Close()
+	return err
+}
+
+// Size of the stored message bodies in bytes, in the database or file system based on configuration.
+func MailStorageSize() (size int64) {
+	if app.Config().MailPath == "db" {
+		app.db.Model(&Messages{}).Select("COALESCE(SUM(LENGTH(message)), 0)").Row().Scan(&size)
+		return
+	}
+	files, err := ioutil.ReadDir(app.Config().MailPath)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		size += file.Size()
+	}
+	return
+}
+
+// Removes a message, its stored body, and the syslog messages and ids related to it.
+// Syslog messages are kept while another message with the same message id remains, such as a copy under legal hold.
+func MailDeleteMessage(UUID string, messageID string) {
+	// Delete the message log entry and addresses for this message.
+	app.db.Where("uuid = ?", UUID).Delete(MessageLog{})
+	app.db.Where("uuid = ?", UUID).Delete(MessageAddress{})
+
+	remaining := 0
+	app.db.Model(&MessageLog{}).Where("message_id = ?", messageID).Count(&remaining)
+	if messageID != "" && remaining == 0 {
+		// Find syslog id information entries matching this message.
+		var matches []SysLogIDInfo
+		app.db.Where("message_id = ?", messageID).Find(&matches)
+		// With each found syslog id, we need to delete the syslog messages and the syslog id information.
+		for _, match := range matches {
+			app.db.Where("s_id = ? AND hostname = ?", match.SID, match.Hostname).Delete(SysLogMessage{})
+			app.db.Delete(&match)
+		}
+	}
+
+	// Delete message data matching the UUID for the message.
+	app.db.Where("uuid = ?", UUID).Delete(Messages{})
+	// If the configured mail storage path is not the database, remove it from the file system.
+	if app.Config().MailPath != "db" {
+		if _, err := os.Stat(path.Join(app.Config().MailPath, UUID)); err == nil {
+			os.Remove(path.Join(app.Config().MailPath, UUID))
+		}
+	}
+	// Update message count.
+	app.messageCount--
+}
+
+// Build a message to replace a redacted message. The headers are kept, while the body and attachments are replaced with a notice.
+func MailTombstone(original []byte, username string, reason string, redacted time.Time) ([]byte, error) {
+	message, err := mail.ReadMessage(bytes.NewReader(original))
+	if err != nil {
+		return nil, err
+	}
+
+	// Headers describing the content no longer apply, everything else is kept in a stable order.
+	var keys []string
+	for key := range message.Header {
+		lower := strings.ToLower(key)
+		if strings.HasPrefix(lower, "content-") || lower == "mime-version" {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	for _, key := range keys {
+		for _, value := range message.Header[key] {
+			fmt.Fprintf(&b, "%s: %s\r\n", key, value)
+		}
+	}
+	fmt.Fprintf(&b, "X-Mail-Archive-Redacted: %s\r\n", redacted.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	fmt.Fprintf(&b, "The body and attachments of this message were redacted by %s on %s.\r\n", username, redacted.Format(time.RFC1123Z))
+	if reason != "" {
+		fmt.Fprintf(&b, "Reason: %s\r\n", reason)
+	}
+	return b.Bytes(), nil
+}
+
+// Replaces the body and attachments of a message with a notice, keeping the headers and message log entry.
+func MailRedactMessage(messageEntry *MessageLog, username string, reason string) error {
+	if messageEntry.Hold {
+		return ErrMailHeld
+	}
+	reader, err := MailGetMessageData(messageEntry.UUID)
+	if err != nil {
+		return err
+	}
+	original, err := ioutil.ReadAll(reader)
+	// If we need to close after reading, close now.
+	if x, ok := reader.(io.Closer); ok {
+		x.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	tombstone, err := MailTombstone(original, username, reason, time.Now())
+	if err != nil {
+		return err
+	}
+	if err := MailWriteMessageData(messageEntry.UUID, tombstone); err != nil {
+		return err
+	}
+
+	// Update the message log entry to match the new body.
+	messageEntry.PlainText = true
+	messageEntry.HTML = false
+	messageEntry.Attachments = false
+	messageEntry.Size = len(tombstone)
+	messageEntry.Redacted = true
+	return app.db.Model(&MessageLog{}).Where("uuid = ?", messageEntry.UUID).Updates(map[string]interface{}{
+		"plain_text":  messageEntry.PlainText,
+		"html":        messageEntry.HTML,
+		"attachments": messageEntry.Attachments,
+		"size":        messageEntry.Size,
+		"redacted":    messageEntry.Redacted,
+	}).Error
+}
+
 // To try and make the syslog code light weight, this function was created
 //  to update the status of messages to what was parsed in the syslog.
-// This function will read an update queue map of syslog ids with updated statuses.
 func RunSysLogMailUpdateQueue() {
 	ticker := time.NewTicker(5 * time.Second)
 	for _ = range ticker.C { // Every 5 seconds.
-		// We want to keep track as to rather statuses were updated to notify subscribers.
-		updated := false
-
-		// Copy the update queue so that we can empty the main update queue.
-		updateQueue := make(map[string]bool)
-		for key, val := range app.sysLogMailUpdateQueue {
-			updateQueue[key] = val
-		}
-		// We empty the main update queue as the syslog may have status changes during this run.
-		// We want to ensure that those changes do not get lost.
-		app.sysLogMailUpdateQueue = make(map[string]bool)
-
-		// Loop the update queue.
-		for sidHostname, _ := range updateQueue {
-			// Update queue should contain syslog id and hostname separated by a colon.
-			// We pair the syslog id with the hostname just incase different hosts use the same syslog id.
-			s := strings.Split(sidHostname, ":")
-			// If there is more or less than 2 parts, this is invalid.
-			if len(s) != 2 {
-				continue
-			}
-			sid := s[0]
-			hostname := s[1]
-
-			// Pull the syslog id information from the database.
-			var match SysLogIDInfo
-			app.db.Where("s_id = ? AND hostname = ?", sid, hostname).First(&match)
-			// If nothing was returned, or this one is set to be ignored... We will stop here.
-			// When a syslog id is ignored, it is likely due to it being either the main message received before sending out,
-			//  or it is the message forwarded to Mail Archive which is not the main mail delivery status.
-			if match.SID == "" || match.Ignore {
-				continue
-			}
+		// On shutdown, the update queue is processed a final time once syslog messages stop.
+		if !app.work.Begin() {
+			return
+		}
+		// If we updated the status of a message log entry, we need to inform subscribers connected to websocket.
+		if SysLogProcessMailUpdateQueue() {
+			app.httpServer.wsInterface.sendMessage("messageStatusesUpdated", true)
+		}
+		app.work.End()
+	}
+}
 
-			// Pull the message log entry matching the message id associated with the syslog id.
-			var messageEntry MessageLog
-			app.db.Where("message_id = ?", match.MessageID).First(&messageEntry)
-			// If we found the message log entry, we can update the status to match our syslog id delivery status.
-			if messageEntry.UUID != "" {
-				messageEntry.Status = match.Status
-				app.db.Save(&messageEntry)
-				// As we updated a message log entry, we want to inform the subscribers that an update occurred.
-				updated = true
-			}
+// Add a syslog id, as its id and hostname separated by a colon, to the queue of statuses to apply to messages.
+func SysLogQueueMailUpdate(sidHostname string) {
+	app.sysLogMailUpdateMutex.Lock()
+	app.sysLogMailUpdateQueue[sidHostname] = true
+	app.sysLogMailUpdateMutex.Unlock()
+}
+
+// This function will read an update queue map of syslog ids with updated statuses.
+// Returns true if the status of any message log entry was updated.
+func SysLogProcessMailUpdateQueue() (updated bool) {
+	defer metricUpdateQueueDuration.ObserveSince(time.Now())
+	// Take the update queue, replacing it with an empty one.
+	// The syslog may have status changes during this run, and we want to ensure that those changes do not get lost.
+	app.sysLogMailUpdateMutex.Lock()
+	updateQueue := app.sysLogMailUpdateQueue
+	app.sysLogMailUpdateQueue = make(map[string]bool)
+	app.sysLogMailUpdateMutex.Unlock()
+	metricUpdateQueueDepth.Set(float64(len(updateQueue)))
+
+	// Loop the update queue.
+	for sidHostname, _ := range updateQueue {
+		// Update queue should contain syslog id and hostname separated by a colon.
+		// We pair the syslog id with the hostname just incase different hosts use the same syslog id.
+		s := strings.Split(sidHostname, ":")
+		// If there is more or less than 2 parts, this is invalid.
+		if len(s) != 2 {
+			continue
+		}
+		sid := s[0]
+		hostname := s[1]
+
+		// Pull the syslog id information from the database.
+		var match SysLogIDInfo
+		app.db.Where("s_id = ? AND hostname = ?", sid, hostname).First(&match)
+		// If nothing was returned, we will stop here.
+		if match.SID == "" {
+			continue
+		}
+
+		// As the message may pass through multiple hosts, the status is determined from the whole path.
+		// Ignored syslog ids are not considered for the status.
+		status := SysLogMessageStatus(match.MessageID)
+		if status == "" {
+			continue
+		}
+
+		// Pull the message log entry matching the message id associated with the syslog id.
+		var messageEntry MessageLog
+		app.db.Where("message_id = ?", match.MessageID).First(&messageEntry)
+		// If we found the message log entry, we can update the status to match the delivery status.
+		if messageEntry.UUID != "" && messageEntry.Status != status {
+			messageEntry.Status = status
+			app.db.Save(&messageEntry)
+			// As we updated a message log entry, we want to inform the subscribers that an update occurred.
+			updated = true
+		}
+	}
+	return
+}
+
+// Messages may be stored after the syslog for them was processed, in which case the update queue
+//  never sees them. This function will reconcile messages with an unknown status every 10 minutes.
+func RunSysLogReconcile() {
+	ticker := time.NewTicker(10 * time.Minute)
+	for _ = range ticker.C {
+		if !app.work.Begin() {
+			return
 		}
 		// If we updated the status of a message log entry, we need to inform subscribers connected to websocket.
-		if updated {
+		if SysLogReconcileUnknownMessages() {
 			app.httpServer.wsInterface.sendMessage("messageStatusesUpdated", true)
 		}
+		app.work.End()
+	}
+}
+
+// Find messages with an unknown status which have syslog information, and apply the status.
+// Returns true if the status of any message log entry was updated.
+func SysLogReconcileUnknownMessages() (updated bool) {
+	// Only messages with a message id we have syslog information for can be updated.
+	var entries []MessageLog
+	sysLogMessageIDs := app.db.Model(&SysLogIDInfo{}).Select("message_id").QueryExpr()
+	app.db.Where("status = ? AND message_id IN (?)", "unknown", sysLogMessageIDs).Find(&entries)
+
+	for _, messageEntry := range entries {
+		status := SysLogMessageStatus(messageEntry.MessageID)
+		if status == "" {
+			continue
+		}
+		messageEntry.Status = status
+		app.db.Save(&messageEntry)
+		updated = true
 	}
+	return
 }
 
+// How often old messages are cleaned up.
+const cleanupInterval = 30 * time.Minute
+
 // This function will run a database cleanup of old messages every 30 minutes.
 func RunDatabaseCleanup() {
-	ticker := time.NewTicker(30 * time.Minute)
+	ticker := time.NewTicker(cleanupInterval)
 	for _ = range ticker.C {
+		// Cleanup does not start once shutdown has started.
+		if !app.work.Begin() {
+			return
+		}
+		HealthRecordCleanupActivity()
 		// Get the oldest date we will allow at this point in time based on the configured maximum age.
-		maxAge := time.Now().Add(app.config.MaxAge * time.Second * -1)
+		maxAge := time.Now().Add(app.Config().MaxAge * time.Second * -1)
 
 		// We want to just pull UUID and message id of the old messages to be cleaned up.
 		type MessageIDs struct {
@@ -219,34 +491,38 @@ func RunDatabaseCleanup() {
 			MessageID string
 		}
 		var messageIDs []MessageIDs
-		app.db.Table("message_logs").Select("uuid,message_id").Where("received <= ?", maxAge).Scan(&messageIDs)
+		// Messages under legal hold are kept.
+		app.db.Table("message_logs").Select("uuid,message_id").Where("received <= ? AND hold = ?", maxAge, false).Scan(&messageIDs)
 
 		// Loop through all found old messages to clean up the database.
+		// On shutdown, we stop between messages and continue with the next cleanup after start.
+		deleted := 0
 		for _, message := range messageIDs {
-			// Find syslog id information entries matching this message.
-			var matches []SysLogIDInfo
-			app.db.Where("message_id = ?", message.MessageID).Find(&matches)
-			// With each found syslog id, we need to delete the syslog messages and the syslog id information.
-			for _, match := range matches {
-				app.db.Where("s_id = ? AND hostname = ?", match.SID, match.Hostname).Delete(SysLogMessage{})
-				app.db.Delete(&match)
+			if app.work.Stopping() {
+				break
 			}
-
-			// Delete the message log entry for this message.
-			app.db.Where("uuid = ?", message.UUID).Delete(MessageLog{})
-			// Delete message data matching the UUID for the message.
-			app.db.Where("uuid = ?", message.UUID).Delete(Messages{})
-			// If the configured mail storage path is not the database, remove it from the file system.
-			if app.config.MailPath != "db" {
-				if _, err := os.Stat(path.Join(app.config.MailPath, message.UUID)); err == nil {
-					os.Remove(path.Join(app.config.MailPath, message.UUID))
-				}
-			}
-			// Update message count.
-			app.messageCount--
+			MailDeleteMessage(message.UUID, message.MessageID)
+			metricCleanupDeletions.Inc()
+			HealthRecordCleanupActivity()
+			deleted++
 		}
+		if deleted != 0 {
+			logCleanup.Info("Removed old messages", "messages", deleted, "received_before", maxAge)
+		}
+
+		// Remove expired login sessions.
+		app.db.Where("expires <= ?", time.Now()).Delete(Session{})
+		// Remove expired LDAP logins from the cache.
+		LDAPPruneCache()
+		// Remove unmatched syslog messages stored past the maximum.
+		SysLogTrimUnmatched()
+		// Remove export files past their retention.
+		ExportCleanup()
 
 		// Send updated message count.
-		app.httpServer.wsInterface.sendMessage("updateMessageCount", app.messageCount)
+		app.httpServer.wsInterface.sendMessageCount()
+		logCleanup.Debug("Cleanup complete")
+		HealthRecordCleanup()
+		app.work.End()
 	}
 }
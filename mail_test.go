@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMailDeleteMessageKeepsSharedSysLog(t *testing.T) {
+	testApp(t)
+	app.db.Create(&MessageLog{UUID: "1", MessageID: "<a@example.com>"})
+	app.db.Create(&MessageLog{UUID: "2", MessageID: "<a@example.com>", Hold: true})
+	app.db.Create(&SysLogIDInfo{SID: "ABC123", Hostname: "mx1", MessageID: "<a@example.com>", Status: "sent"})
+	app.db.Create(&SysLogMessage{SID: "ABC123", Hostname: "mx1", Content: "ABC123: to=<b@example.com>, status=sent"})
+	counts := func() (infos, lines int) {
+		app.db.Model(&SysLogIDInfo{}).Count(&infos)
+		app.db.Model(&SysLogMessage{}).Count(&lines)
+		return
+	}
+
+	// The held copy keeps the delivery log.
+	MailDeleteMessage("1", "<a@example.com>")
+	if infos, lines := counts(); infos != 1 || lines != 1 {
+		t.Errorf("%d syslog ids and %d syslog messages are left, expected both to be kept", infos, lines)
+	}
+
+	// Once no message has the message id, the delivery log is removed.
+	MailDeleteMessage("2", "<a@example.com>")
+	if infos, lines := counts(); infos != 0 || lines != 0 {
+		t.Errorf("%d syslog ids and %d syslog messages are left, expected none", infos, lines)
+	}
+}
+
+func TestMailStoreMessageSpamScore(t *testing.T) {
+	testApp(t)
+	for level, expected := range map[string]int{
+		"Spam detection results:  7":                   7,
+		"Spam detection results: 9000000000000000000":  MailMaxSpamScore,
+		"Spam detection results: 99999999999999999999": MailMaxSpamScore,
+		"not a score": 0,
+	} {
+		message := "From: sender@example.com\r\nTo: user@example.com\r\nSubject: Score\r\nX-Spam-Level: " + level + "\r\n\r\nBody\r\n"
+		entry, err := MailStoreMessage("192.0.2.1", "sender@example.com", []string{"user@example.com"}, []byte(message), time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.SpamScore != expected {
+			t.Errorf("%q stored a spam score of %d, expected %d", strings.TrimSpace(level), entry.SpamScore, expected)
+		}
+	}
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"log"
+	"net"
 	"os"
+	"sync"
+	"sync/atomic"
 
 	"github.com/emersion/go-smtp"
 	"github.com/jinzhu/gorm"
@@ -16,49 +19,80 @@ import (
 // Global application structure for communicating between servers and storing information.
 type App struct {
 	context               *cli.Context
-	config                Config
+	config                atomic.Value // The running *Config, replaced as a whole on reload.
 	db                    *gorm.DB
 	httpServer            *HTTPServer
 	smtpServer            *smtp.Server
+	smtpListener          net.Listener
 	sysLogServer          *syslog.Server
 	sysLogMailUpdateQueue map[string]bool
+	sysLogMailUpdateMutex sync.Mutex // Guards the update queue, which the syslog runner adds to while it is processed.
 	messageCount          uint
+	audit                 AuditChain // The end of the audit log, which entries are appended to.
+	work                  AppWork // Work which should finish before shutdown.
 }
 
 var app *App
 
-// Main start of the application.
-func appInit(c *cli.Context) {
+// Load the configuration and connect to the database, used by all commands.
+func appSetup(c *cli.Context) {
 	app = new(App)
 	app.context = c
-	app.config = initConfig(c)
+	app.SetConfig(initConfig(c))
 
 	// Connect to the database.
-	db, err := gorm.Open(app.config.DBType, app.config.DBConnection)
+	db, err := gorm.Open(app.Config().DBType, app.Config().DBConnection)
 	if err != nil {
-		log.Fatal(err)
+		logApp.Fatal("Unable to connect to the database", "error", err)
 	}
 	initDB(db)
 	app.db = db
+	app.sysLogMailUpdateQueue = make(map[string]bool) // Must initialize maps.
 
 	// Get message count.
 	db.Model(&MessageLog{}).Count(&app.messageCount)
+}
+
+// Main start of the application.
+func appInit(c *cli.Context) {
+	appSetup(c)
+
+	// Create the admin user if configured.
+	AuthInitAdmin()
+
+	// Create the export directory, so readiness does not fail before the first export.
+	if err := os.MkdirAll(app.Config().ExportPath, 0700); err != nil {
+		logExport.Error("Unable to create the export directory", "path", app.Config().ExportPath, "error", err)
+	}
+
+	// Reload the configuration when its file is changed.
+	go RunConfigWatcher()
 
 	// Automatically clean up old email every 30 minutes.
 	go RunDatabaseCleanup()
 
-	// Start SysLog servers.
-	app.sysLogMailUpdateQueue = make(map[string]bool) // Must initialize maps.
-	go SysLogServe()
+	// Start SysLog servers and local log file readers.
+	sysLogChannel, sysLogDone := SysLogStartRunner()
+	go SysLogServe(sysLogChannel)
+	go LogFileServe(sysLogChannel)
 	// As syslog updates email status, we need to also update related messages.
 	go RunSysLogMailUpdateQueue()
+	// Messages may arrive after their syslog, so we need to reconcile those with an unknown status.
+	go RunSysLogReconcile()
 
 	// Start SNMTP server.
 	go SMTPServe()
-	HTTPServe()
+	go HTTPServe()
+
+	// Run until stopped, then shutdown without losing messages being received.
+	AppWaitForSignal(sysLogChannel, sysLogDone)
 }
 
 func main() {
+	// Lines from libraries which use the standard logger are written as structured lines.
+	log.SetFlags(0)
+	log.SetOutput(LogWriter{logApp, LogLevelInfo})
+
 	capp := cli.NewApp()
 	capp.Name = "mail-archive"
 	capp.Usage = "Email Archive Server with SysLog support and web interface."
@@ -68,8 +102,9 @@ func main() {
 
 	capp.Flags = []cli.Flag{
 		cli.StringFlag{
-			Name:  "config, c",
-			Usage: "Load configuration from `FILE`",
+			Name:   "config, c",
+			Usage:  "Load configuration from `FILE`",
+			EnvVar: ConfigEnvPrefix + "CONFIG",
 		},
 		cli.StringFlag{Name: "http-bind"},
 		cli.UintFlag{Name: "http-port"},
@@ -80,8 +115,71 @@ func main() {
 		cli.UintFlag{Name: "syslog-port"},
 	}
 
+	capp.Commands = []cli.Command{
+		{
+			Name:   "serve",
+			Usage:  "Start the archive servers, as is done without a command.",
+			Action: appInit,
+		},
+		{
+			Name:   "config-test",
+			Usage:  "Check the configuration, database connection, storage paths and ports.",
+			Action: ConfigTestCommand,
+			Flags:  configTestFlags(),
+		},
+		{
+			Name:   "stats",
+			Usage:  "Print statistics about the archive.",
+			Action: StatsCommand,
+		},
+		{
+			Name:   "purge",
+			Usage:  "Remove messages older than an age, except those under legal hold.",
+			Action: PurgeCommand,
+			Flags:  purgeFlags(),
+		},
+		{
+			Name:   "reindex",
+			Usage:  "Rebuild the addresses and hashes of messages from their stored source, and update statuses from syslog.",
+			Action: ReindexCommand,
+		},
+		{
+			Name:        "user",
+			Usage:       "Manage local users.",
+			Subcommands: userCommands(),
+		},
+		{
+			Name:      "get",
+			Usage:     "Print the original source of a stored message.",
+			ArgsUsage: "UUID",
+			Action:    GetCommand,
+			Flags:     getFlags(),
+		},
+		{
+			Name:      "import-logs",
+			Usage:     "Import historic mail log files to backfill message statuses.",
+			ArgsUsage: "FILE...",
+			Action:    LogFileImportCommand,
+			Flags:     logFileImportFlags(),
+		},
+		{
+			Name:      "import",
+			Usage:     "Import mail from mbox files, Maildirs and EML files, skipping messages already archived.",
+			ArgsUsage: "PATH...",
+			Action:    ImportCommand,
+			Flags:     importFlags(),
+		},
+		{
+			Name:      "data-subject",
+			Usage:     "Export everything involving an email address to a ZIP file, and optionally erase it.",
+			ArgsUsage: "ADDRESS",
+			Action:    DataSubjectCommand,
+			Flags:     dataSubjectFlags(),
+		},
+	}
+
 	err := capp.Run(os.Args)
 	if err != nil {
-		log.Fatal(err)
+		logApp.Fatal(err.Error())
 	}
 }
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Types of metrics, as named in the Prometheus text format.
+const (
+	MetricTypeCounter   = "counter"
+	MetricTypeGauge     = "gauge"
+	MetricTypeHistogram = "histogram"
+)
+
+// The path metrics are exposed at.
+const MetricsPath = "/metrics"
+
+// Buckets for durations in seconds.
+var MetricDurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Buckets for message sizes in bytes.
+var MetricSizeBuckets = []float64{1024, 4096, 16384, 65536, 262144, 1048576, 4194304, 16777216}
+
+// A metric with a value for each combination of its labels.
+type Metric struct {
+	Name    string
+	Help    string
+	Type    string
+	Labels  []string
+	Buckets []float64      // Upper bounds of histogram buckets.
+	Func    func() float64 // If set, the value of a gauge is found when metrics are collected.
+
+	mutex  sync.Mutex
+	series map[string]*metricSeries
+}
+
+// The value of a metric with a combination of labels.
+type metricSeries struct {
+	labels []string
+	value  float64  // The value of a counter or gauge, or the sum of a histogram.
+	counts []uint64 // The number of observations in each histogram bucket.
+	count  uint64   // The number of histogram observations.
+}
+
+// Every metric, in the order they are exposed.
+var metrics []*Metric
+
+// Register a metric to be exposed.
+func metricRegister(m *Metric) *Metric {
+	m.series = make(map[string]*metricSeries)
+	metrics = append(metrics, m)
+	return m
+}
+
+// Create a counter, which only goes up.
+func NewMetricCounter(name string, help string, labels ...string) *Metric {
+	return metricRegister(&Metric{Name: name, Help: help, Type: MetricTypeCounter, Labels: labels})
+}
+
+// Create a gauge, which is set to the current value.
+func NewMetricGauge(name string, help string, labels ...string) *Metric {
+	return metricRegister(&Metric{Name: name, Help: help, Type: MetricTypeGauge, Labels: labels})
+}
+
+// Create a gauge which has its value found when metrics are collected.
+func NewMetricGaugeFunc(name string, help string, f func() float64) *Metric {
+	return metricRegister(&Metric{Name: name, Help: help, Type: MetricTypeGauge, Func: f})
+}
+
+// Create a histogram, which counts observations in buckets.
+func NewMetricHistogram(name string, help string, buckets []float64, labels ...string) *Metric {
+	return metricRegister(&Metric{Name: name, Help: help, Type: MetricTypeHistogram, Labels: labels, Buckets: buckets})
+}
+
+// Get the series for the label values provided, creating it if needed. The mutex must be held.
+func (m *Metric) get(labels []string) *metricSeries {
+	key := strings.Join(labels, "\xff")
+	series, ok := m.series[key]
+	if !ok {
+		series = &metricSeries{labels: labels}
+		if m.Type == MetricTypeHistogram {
+			series.counts = make([]uint64, len(m.Buckets))
+		}
+		m.series[key] = series
+	}
+	return series
+}
+
+// Add to a counter or gauge.
+func (m *Metric) Add(value float64, labels ...string) {
+	m.mutex.Lock()
+	m.get(labels).value += value
+	m.mutex.Unlock()
+}
+
+// Add one to a counter or gauge.
+func (m *Metric) Inc(labels ...string) {
+	m.Add(1, labels...)
+}
+
+// Set the value of a gauge.
+func (m *Metric) Set(value float64, labels ...string) {
+	m.mutex.Lock()
+	m.get(labels).value = value
+	m.mutex.Unlock()
+}
+
+// Observe a value in a histogram.
+func (m *Metric) Observe(value float64, labels ...string) {
+	m.mutex.Lock()
+	series := m.get(labels)
+	for i, bound := range m.Buckets {
+		if value <= bound {
+			series.counts[i]++
+		}
+	}
+	series.count++
+	series.value += value
+	m.mutex.Unlock()
+}
+
+// Observe the seconds since a time in a histogram.
+func (m *Metric) ObserveSince(start time.Time, labels ...string) {
+	m.Observe(time.Since(start).Seconds(), labels...)
+}
+
+// Format a value for the text format.
+func metricFormatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Format label names and values for the text format, with an extra label such as a histogram bucket.
+func metricFormatLabels(names []string, values []string, extra ...string) string {
+	var pairs []string
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs = append(pairs, name+"=\""+metricEscaper.Replace(value)+"\"")
+	}
+	if len(extra) == 2 {
+		pairs = append(pairs, extra[0]+"=\""+extra[1]+"\"")
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Label values must have backslashes, quotes and new lines escaped.
+var metricEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+// Write the metric in the Prometheus text format.
+func (m *Metric) Write(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", m.Name, m.Help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.Name, m.Type)
+	if m.Func != nil {
+		fmt.Fprintf(w, "%s %s\n", m.Name, metricFormatValue(m.Func()))
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	// Metrics without labels always have a value, even before anything was counted.
+	if len(m.Labels) == 0 {
+		m.get(nil)
+	}
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		series := m.series[key]
+		if m.Type != MetricTypeHistogram {
+			fmt.Fprintf(w, "%s%s %s\n", m.Name, metricFormatLabels(m.Labels, series.labels), metricFormatValue(series.value))
+			continue
+		}
+		for i, bound := range m.Buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.Name, metricFormatLabels(m.Labels, series.labels, "le", metricFormatValue(bound)), series.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.Name, metricFormatLabels(m.Labels, series.labels, "le", "+Inf"), series.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.Name, metricFormatLabels(m.Labels, series.labels), metricFormatValue(series.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.Name, metricFormatLabels(m.Labels, series.labels), series.count)
+	}
+}
+
+// Metrics of the archive.
+var (
+	metricSMTPSessions   = NewMetricCounter("mail_archive_smtp_sessions_total", "SMTP sessions started.")
+	metricSMTPMessages   = NewMetricCounter("mail_archive_smtp_messages_total", "Messages received over SMTP and stored.")
+	metricSMTPBytes      = NewMetricHistogram("mail_archive_smtp_message_bytes", "Size of messages received over SMTP and stored.", MetricSizeBuckets)
+	metricSMTPRejections = NewMetricCounter("mail_archive_smtp_rejections_total", "Messages rejected over SMTP, by reason.", "reason")
+	metricParseFailures  = NewMetricCounter("mail_archive_parse_failures_total", "Messages which could not be parsed, and were not stored.")
+
+	metricSysLogReceived  = NewMetricCounter("mail_archive_syslog_lines_received_total", "Syslog lines received from the syslog server and log files.")
+	metricSysLogMatched   = NewMetricCounter("mail_archive_syslog_lines_matched_total", "Syslog lines matched, by the rule which matched them.", "rule")
+	metricSysLogUnmatched = NewMetricCounter("mail_archive_syslog_lines_unmatched_total", "Syslog lines which could not be associated with a message, by reason.", "reason")
+
+	metricUpdateQueueDepth    = NewMetricGauge("mail_archive_update_queue_depth", "Syslog ids in the update queue when it was last processed.")
+	metricUpdateQueueDuration = NewMetricHistogram("mail_archive_update_queue_duration_seconds", "Time taken to process the update queue.", MetricDurationBuckets)
+
+	metricCleanupDeletions = NewMetricCounter("mail_archive_cleanup_deleted_messages_total", "Messages removed by cleanup of old messages.")
+
+	metricMessages    = NewMetricGaugeFunc("mail_archive_messages", "Messages in the archive.", func() float64 { return float64(app.messageCount) })
+	metricStorageSize = NewMetricGaugeFunc("mail_archive_storage_bytes", "Size of stored messages.", MetricStorageSize)
+
+	metricHTTPDuration = NewMetricHistogram("mail_archive_http_request_duration_seconds", "Time taken to respond to HTTP requests, by route.", MetricDurationBuckets, "method", "route", "code")
+	metricWSClients    = NewMetricGauge("mail_archive_websocket_clients", "Connected websocket clients.")
+)
+
+// Finding the storage size is slow for large archives, so it is only found every few minutes.
+var metricStorageCache struct {
+	sync.Mutex
+	size    int64
+	updated time.Time
+}
+
+// Get the size of stored messages for metrics.
+func MetricStorageSize() float64 {
+	metricStorageCache.Lock()
+	defer metricStorageCache.Unlock()
+	if time.Since(metricStorageCache.updated) >= 5*time.Minute {
+		metricStorageCache.size = MailStorageSize()
+		metricStorageCache.updated = time.Now()
+	}
+	return float64(metricStorageCache.size)
+}
+
+// Keeps the status code of a response for metrics.
+type metricsResponseWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+// Keep the status code, and send it.
+func (w *metricsResponseWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Flush responses which are streamed.
+func (w *metricsResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Middleware which records the time taken to respond to each route.
+func (s *HTTPServer) MetricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The websocket stays connected, so its time is not useful.
+		if r.URL.Path == "/ws" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Routes are recorded by their template, so IDs do not create a series each.
+		route := ""
+		if current := mux.CurrentRoute(r); current != nil {
+			route, _ = current.GetPathTemplate()
+		}
+		start := time.Now()
+		mw := &metricsResponseWriter{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(mw, r)
+		metricHTTPDuration.ObserveSince(start, r.Method, route, strconv.Itoa(mw.code))
+	})
+}
+
+// Expose every metric in the Prometheus text format.
+func (s *HTTPServer) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if !app.Config().MetricsEnabled {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.Write(bw)
+	}
+	bw.Flush()
+}
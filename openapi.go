@@ -0,0 +1,476 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Path the OpenAPI document is served at.
+const OpenAPIPath = "/api/openapi.json"
+
+// A parameter of an API endpoint. Sent in the query for GET and DELETE requests, and as form data otherwise.
+type OpenAPIParam struct {
+	Name        string
+	Description string
+	Required    bool
+	Enum        []string
+}
+
+// Description of an API endpoint. Path parameters are read from the path.
+type OpenAPIEndpoint struct {
+	Method      string
+	Path        string // The path as registered with the router.
+	Summary     string
+	Permission  string // The permission required, if any. Multiple are joined by "and".
+	Params      []OpenAPIParam
+	Response    interface{}       // The structure sent as JSON.
+	ContentType map[string]string // Content types and descriptions of responses not sent as JSON.
+	Redirect    bool              // The response is a redirect.
+}
+
+// Parameters shared by multiple endpoints.
+var (
+	openAPIPageParam   = OpenAPIParam{Name: "p", Description: "Page number."}
+	openAPICursorParam = OpenAPIParam{Name: "cursor", Description: "The next_cursor of the previous page."}
+	openAPILimitParam  = OpenAPIParam{Name: "limit", Description: "Number of entries per page, up to api_max_page_size."}
+	openAPIAuditParams = []OpenAPIParam{
+		{Name: "user", Description: "Username which performed the action."},
+		{Name: "action", Description: "Action performed.", Enum: []string{AuditActionRead, AuditActionDownload, AuditActionSearch, AuditActionReport, AuditActionHold, AuditActionDelete, AuditActionRedact, AuditActionExport}},
+		{Name: "uuid", Description: "UUID of the message accessed."},
+		{Name: "outcome", Description: "Outcome of the action.", Enum: []string{AuditOutcomeSuccess, AuditOutcomeNotFound, AuditOutcomeDenied, AuditOutcomeError}},
+		{Name: "since", Description: "Entries at or after this time, in RFC3339 or YYYY-MM-DD format."},
+		{Name: "until", Description: "Entries before this time, in RFC3339 or YYYY-MM-DD format."},
+	}
+	openAPIDataSubjectParams = []OpenAPIParam{
+		{Name: "address", Description: "Email address of the data subject.", Required: true},
+	}
+	openAPIExportParams = []OpenAPIParam{
+		{Name: "q", Description: "Words which must each match the from, to, subject, source IP, message id or status. Without a query, every message is exported."},
+		{Name: "format", Description: "Format of the export.", Required: true, Enum: []string{ExportFormatMbox, ExportFormatZip, ExportFormatMaildir}},
+	}
+	openAPIExportContentTypes = map[string]string{
+		"application/mbox": "Messages in mboxrd format.",
+		"application/zip":  "ZIP file with UUID.eml for each message and manifest.csv with their metadata.",
+		"application/gzip": "Gzipped tarball of a Maildir, with messages in cur.",
+	}
+	openAPIStatsParams = []OpenAPIParam{
+		{Name: "since", Description: "Messages received at or after this time, in RFC3339 or YYYY-MM-DD format. Defaults to 7 days before until."},
+		{Name: "until", Description: "Messages received before this time, in RFC3339 or YYYY-MM-DD format. Defaults to now."},
+		{Name: "interval", Description: "Interval the volume is grouped by, in local time. Defaults to hour for ranges up to 2 days, and day otherwise.", Enum: []string{StatsIntervalHour, StatsIntervalDay}},
+		{Name: "q", Description: "Words which must each match the from, to, subject, source IP, message id or status."},
+		{Name: "top", Description: "Number of senders, recipients and domains to include, up to 100. Defaults to 10."},
+	}
+	openAPIUnmatchedParams = []OpenAPIParam{
+		{Name: "q", Description: "Words which must each match the hostname, tag or content."},
+		{Name: "reason", Description: "Reason the message was not associated.", Enum: []string{SysLogDropNoQueue, SysLogDropUnmatched, SysLogDropBufferDiscarded, SysLogDropDisconnectUnmatched}},
+	}
+)
+
+// Every endpoint of the API. Each registered route must be described here, which is checked on start.
+var OpenAPIEndpoints = []OpenAPIEndpoint{
+	{Method: "GET", Path: OpenAPIPath, Summary: "This OpenAPI document.", ContentType: map[string]string{"application/json": "OpenAPI 3.0 document."}},
+
+	// Original API.
+	{Method: "GET", Path: "/api/ping", Summary: "Test to see that the server responds.", Response: APIGeneralResp{}},
+	{Method: "GET", Path: "/api/config", Summary: "Configuration for the web UI and the current message count.", Response: APIConfigResp{}},
+	{Method: "GET", Path: "/api/message_log", Summary: "Messages matching a search query, newest first.", Response: APIMessageLogResp{}, Params: []OpenAPIParam{
+		{Name: "q", Description: "Words which must each match the from, to, subject, source IP, message id or status."},
+		openAPIPageParam,
+		openAPICursorParam,
+	}},
+	{Method: "GET", Path: "/api/message/{id}", Summary: "A message log entry.", Response: APIMessageEntryResp{}},
+	{Method: "GET", Path: "/api/message/{id}.log", Summary: "Syslog messages of a message from every host it passed through.", ContentType: map[string]string{"text/plain": "One syslog message per line."}},
+	{Method: "GET", Path: "/api/message/{id}/timeline", Summary: "Timeline of delivery events for a message.", Response: APIMessageTimelineResp{}},
+	{Method: "GET", Path: "/api/message/{id}.{type:eml|txt|html}", Summary: "The original message source, or its text or HTML body.", ContentType: map[string]string{
+		"message/rfc822": "Original message source.",
+		"text/plain":     "Text body.",
+		"text/html":      "HTML body.",
+	}},
+	{Method: "PUT", Path: "/api/message/{id}/learn_{type:spam|ham}", Summary: "Report a message as spam or ham to the spam reporting tools.", Permission: PermReportSpam, Response: APISpamReportResp{}},
+	{Method: "DELETE", Path: "/api/message/{id}", Summary: "Delete a message, its stored body and related syslog messages.", Permission: PermDeleteMessages, Response: APIMessageDeleteResp{}},
+	{Method: "DELETE", Path: "/api/message_log", Summary: "Delete all messages matching a search query.", Permission: PermDeleteMessages, Response: APIMessageDeleteResp{}, Params: []OpenAPIParam{
+		{Name: "q", Description: "Words which must each match the from, to, subject, source IP, message id or status.", Required: true},
+	}},
+	{Method: "PUT", Path: "/api/message/{id}/redact", Summary: "Replace the body and attachments of a message with a notice, keeping its metadata.", Permission: PermDeleteMessages, Response: APIMessageEntryResp{}, Params: []OpenAPIParam{
+		{Name: "reason", Description: "Reason included in the notice."},
+	}},
+	{Method: "PUT", Path: "/api/message/{id}/hold", Summary: "Place a legal hold on a message, so that it is not removed or redacted.", Permission: PermHoldMessages, Response: APIMessageEntryResp{}},
+	{Method: "DELETE", Path: "/api/message/{id}/hold", Summary: "Release a legal hold on a message.", Permission: PermHoldMessages, Response: APIMessageEntryResp{}},
+	{Method: "GET", Path: "/api/syslog/unmatched", Summary: "Syslog messages which could not be associated with a message, newest first.", Permission: PermViewDiagnostics, Response: APISysLogUnmatchedResp{}, Params: append(openAPIUnmatchedParams, openAPIPageParam)},
+
+	// Bulk export.
+	{Method: "GET", Path: "/api/message_log/export", Summary: "Download every message matching a search query, newest first.", Permission: PermExportMessages, Params: openAPIExportParams, ContentType: openAPIExportContentTypes},
+	{Method: "POST", Path: "/api/export_jobs", Summary: "Start exporting every message matching a search query in the background.", Permission: PermExportMessages, Response: APIExportJobResp{}, Params: openAPIExportParams},
+	{Method: "GET", Path: "/api/export_jobs", Summary: "Export jobs of the logged in user, newest first.", Permission: PermExportMessages, Response: APIExportJobsResp{}},
+	{Method: "GET", Path: "/api/export_jobs/{id}", Summary: "Progress of an export job.", Permission: PermExportMessages, Response: APIExportJobResp{}},
+	{Method: "GET", Path: "/api/export_jobs/{id}/download", Summary: "Download the file of a complete export job.", Permission: PermExportMessages, ContentType: openAPIExportContentTypes},
+	{Method: "DELETE", Path: "/api/export_jobs/{id}", Summary: "Cancel a running export job, or remove a finished one and its file.", Permission: PermExportMessages, Response: APIGeneralResp{}},
+
+	// Authentication and users.
+	{Method: "POST", Path: "/api/auth/login", Summary: "Login with a username and password.", Response: APIAuthResp{}, Params: []OpenAPIParam{
+		{Name: "username", Required: true},
+		{Name: "password", Required: true},
+	}},
+	{Method: "POST", Path: "/api/auth/logout", Summary: "Logout of the current session.", Response: APIGeneralResp{}},
+	{Method: "GET", Path: "/api/auth/me", Summary: "The logged in user, and the CSRF token for the web interface.", Response: APIAuthResp{}},
+	{Method: "PUT", Path: "/api/auth/password", Summary: "Change the password of the logged in user, ending their other sessions and revoking their API tokens.", Response: APIGeneralResp{}, Params: []OpenAPIParam{
+		{Name: "current_password", Required: true},
+		{Name: "password", Required: true},
+	}},
+	{Method: "GET", Path: "/api/auth/tokens", Summary: "API tokens of the logged in user.", Response: APIAuthTokensResp{}},
+	{Method: "POST", Path: "/api/auth/tokens", Summary: "Create an API token for the logged in user. The token is only provided once.", Response: APIAuthTokenResp{}, Params: []OpenAPIParam{
+		{Name: "name", Description: "Name to identify the token by."},
+	}},
+	{Method: "DELETE", Path: "/api/auth/tokens/{id}", Summary: "Delete an API token of the logged in user.", Response: APIGeneralResp{}},
+	{Method: "GET", Path: "/api/auth/oidc/login", Summary: "Start a single sign-on login.", Redirect: true},
+	{Method: "GET", Path: "/api/auth/oidc/callback", Summary: "Complete a single sign-on login.", Redirect: true, Params: []OpenAPIParam{
+		{Name: "code", Required: true},
+		{Name: "state", Required: true},
+	}},
+	{Method: "GET", Path: "/api/users", Summary: "List users.", Permission: PermManageUsers, Response: APIUsersResp{}},
+	{Method: "POST", Path: "/api/users", Summary: "Create a user.", Permission: PermManageUsers, Response: APIUserResp{}, Params: []OpenAPIParam{
+		{Name: "username", Required: true},
+		{Name: "password", Required: true},
+		{Name: "role", Description: "Defaults to read-only.", Enum: AuthRoles},
+		{Name: "scopes", Description: "Addresses or domains the user is limited to, repeated or comma separated."},
+	}},
+	{Method: "PUT", Path: "/api/users/{id}", Summary: "Change the role or scopes of a user.", Permission: PermManageUsers, Response: APIUserResp{}, Params: []OpenAPIParam{
+		{Name: "role", Enum: AuthRoles},
+		{Name: "scopes", Description: "Addresses or domains the user is limited to, repeated or comma separated. Send empty to remove all scopes."},
+	}},
+	{Method: "PUT", Path: "/api/users/{id}/password", Summary: "Change the password of a local user, ending their sessions and revoking their API tokens.", Permission: PermManageUsers, Response: APIGeneralResp{}, Params: []OpenAPIParam{
+		{Name: "password", Required: true},
+	}},
+	{Method: "DELETE", Path: "/api/users/{id}", Summary: "Delete a user.", Permission: PermManageUsers, Response: APIGeneralResp{}},
+
+	// Audit log.
+	{Method: "GET", Path: "/api/audit", Summary: "Audit log entries, newest first.", Permission: PermViewAudit, Response: APIAuditResp{}, Params: append(openAPIAuditParams, openAPIPageParam)},
+	{Method: "GET", Path: "/api/audit/export", Summary: "Export audit log entries, oldest first.", Permission: PermViewAudit, Params: append(openAPIAuditParams, OpenAPIParam{Name: "format", Enum: []string{"csv", "json"}}), ContentType: map[string]string{
+		"text/csv":             "One entry per row.",
+		"application/x-ndjson": "One JSON entry per line.",
+	}},
+	{Method: "GET", Path: "/api/audit/verify", Summary: "Verify that the audit log has not been modified.", Permission: PermViewAudit, Response: APIAuditVerifyResp{}},
+
+	// Data subject requests.
+	{Method: "GET", Path: "/api/data_subject/export", Summary: "ZIP file with every message and syslog message involving an address, along with a manifest.", Permission: PermDataSubject, Params: openAPIDataSubjectParams, ContentType: map[string]string{
+		"application/zip": "ZIP file with messages/UUID.eml, syslog.txt and manifest.json.",
+	}},
+	{Method: "POST", Path: "/api/data_subject/erase", Summary: "Erase every message and syslog message involving an address, except those under legal hold.", Permission: PermDataSubject + " and " + PermDeleteMessages, Response: APIDataSubjectEraseResp{}, Params: openAPIDataSubjectParams},
+
+	// Configuration reload.
+	{Method: "GET", Path: "/api/config/reload", Summary: "Result of the last reload of the configuration, and settings changed which need a restart.", Permission: PermManageConfig, Response: APIConfigReloadResp{}},
+	{Method: "POST", Path: "/api/config/reload", Summary: "Reload the configuration file, applying settings which are safe to change while running.", Permission: PermManageConfig, Response: APIConfigReloadResp{}},
+
+	// Statistics.
+	{Method: "GET", Path: "/api/stats", Summary: "Statistics of messages received over a time range, for charts.", Permission: PermReadMessages, Response: APIStatsResp{}, Params: openAPIStatsParams},
+
+	// API v2.
+	{Method: "GET", Path: "/api/v2/ping", Summary: "Test to see that the server responds.", Response: struct{}{}},
+	{Method: "GET", Path: "/api/v2/config", Summary: "Configuration for the web UI and the current message count.", Response: APIV2ConfigResp{}},
+	{Method: "GET", Path: "/api/v2/messages", Summary: "Messages matching a search query, newest first.", Response: APIV2MessagesResp{}, Params: []OpenAPIParam{
+		{Name: "q", Description: "Words which must each match the from, to, subject, source IP, message id or status."},
+		openAPILimitParam,
+		openAPICursorParam,
+	}},
+	{Method: "GET", Path: "/api/v2/messages/export", Summary: "Download every message matching a search query, newest first.", Permission: PermExportMessages, Params: openAPIExportParams, ContentType: openAPIExportContentTypes},
+	{Method: "GET", Path: "/api/v2/messages/{id}", Summary: "A message log entry.", Response: APIV2MessageResp{}},
+	{Method: "GET", Path: "/api/v2/messages/{id}/logs", Summary: "Syslog messages of a message from every host it passed through.", Response: APIV2LogsResp{}},
+	{Method: "GET", Path: "/api/v2/messages/{id}/timeline", Summary: "Timeline of delivery events for a message.", Response: APIV2TimelineResp{}},
+	{Method: "GET", Path: "/api/v2/messages/{id}/{format:source|text|html}", Summary: "The original message source, or its text or HTML body.", ContentType: map[string]string{
+		"message/rfc822": "Original message source.",
+		"text/plain":     "Text body.",
+		"text/html":      "HTML body.",
+	}},
+	{Method: "POST", Path: "/api/v2/messages/{id}/report/{type:spam|ham}", Summary: "Report a message as spam or ham to the spam reporting tools.", Permission: PermReportSpam, Response: APIV2ReportResp{}},
+	{Method: "DELETE", Path: "/api/v2/messages/{id}", Summary: "Delete a message, its stored body and related syslog messages.", Permission: PermDeleteMessages, Response: APIV2DeleteResp{}},
+	{Method: "DELETE", Path: "/api/v2/messages", Summary: "Delete all messages matching a search query.", Permission: PermDeleteMessages, Response: APIV2DeleteResp{}, Params: []OpenAPIParam{
+		{Name: "q", Description: "Words which must each match the from, to, subject, source IP, message id or status.", Required: true},
+	}},
+	{Method: "POST", Path: "/api/v2/messages/{id}/redact", Summary: "Replace the body and attachments of a message with a notice, keeping its metadata.", Permission: PermDeleteMessages, Response: APIV2MessageResp{}, Params: []OpenAPIParam{
+		{Name: "reason", Description: "Reason included in the notice."},
+	}},
+	{Method: "POST", Path: "/api/v2/messages/{id}/hold", Summary: "Place a legal hold on a message, so that it is not removed or redacted.", Permission: PermHoldMessages, Response: APIV2MessageResp{}},
+	{Method: "DELETE", Path: "/api/v2/messages/{id}/hold", Summary: "Release a legal hold on a message.", Permission: PermHoldMessages, Response: APIV2MessageResp{}},
+	{Method: "GET", Path: "/api/v2/data_subject/export", Summary: "ZIP file with every message and syslog message involving an address, along with a manifest.", Permission: PermDataSubject, Params: openAPIDataSubjectParams, ContentType: map[string]string{
+		"application/zip": "ZIP file with messages/UUID.eml, syslog.txt and manifest.json.",
+	}},
+	{Method: "POST", Path: "/api/v2/data_subject/erase", Summary: "Erase every message and syslog message involving an address, except those under legal hold.", Permission: PermDataSubject + " and " + PermDeleteMessages, Response: DataSubjectErasure{}, Params: openAPIDataSubjectParams},
+	{Method: "POST", Path: "/api/v2/exports", Summary: "Start exporting every message matching a search query in the background.", Permission: PermExportMessages, Response: APIV2ExportResp{}, Params: openAPIExportParams},
+	{Method: "GET", Path: "/api/v2/exports", Summary: "Export jobs of the logged in user, newest first.", Permission: PermExportMessages, Response: APIV2ExportsResp{}},
+	{Method: "GET", Path: "/api/v2/exports/{id}", Summary: "Progress of an export job.", Permission: PermExportMessages, Response: APIV2ExportResp{}},
+	{Method: "GET", Path: "/api/v2/exports/{id}/download", Summary: "Download the file of a complete export job.", Permission: PermExportMessages, ContentType: openAPIExportContentTypes},
+	{Method: "DELETE", Path: "/api/v2/exports/{id}", Summary: "Cancel a running export job, or remove a finished one and its file.", Permission: PermExportMessages, Response: struct{}{}},
+	{Method: "GET", Path: "/api/v2/syslog/unmatched", Summary: "Syslog messages which could not be associated with a message, newest first.", Permission: PermViewDiagnostics, Response: APIV2SysLogUnmatchedResp{}, Params: append(openAPIUnmatchedParams, openAPILimitParam, openAPICursorParam)},
+	{Method: "GET", Path: "/api/v2/audit", Summary: "Audit log entries, newest first.", Permission: PermViewAudit, Response: APIV2AuditResp{}, Params: append(openAPIAuditParams, openAPILimitParam, openAPICursorParam)},
+	{Method: "GET", Path: "/api/v2/config/reload", Summary: "Result of the last reload of the configuration, and settings changed which need a restart.", Permission: PermManageConfig, Response: APIV2ConfigReloadResp{}},
+	{Method: "POST", Path: "/api/v2/config/reload", Summary: "Reload the configuration file, applying settings which are safe to change while running.", Permission: PermManageConfig, Response: APIV2ConfigReloadResp{}},
+	{Method: "GET", Path: "/api/v2/stats", Summary: "Statistics of messages received over a time range, for charts.", Permission: PermReadMessages, Response: APIV2StatsResp{}, Params: openAPIStatsParams},
+}
+
+// Matches variables in a router path, with an optional pattern.
+var openAPIPathVar = regexp.MustCompile(`\{([^:}]+)(?::([^}]+))?\}`)
+
+// Convert a router path to an OpenAPI path, without variable patterns.
+func OpenAPIPathName(path string) string {
+	return openAPIPathVar.ReplaceAllString(path, "{$1}")
+}
+
+// Build the JSON schema of a type. Structures are added to the components and referenced.
+func OpenAPISchema(t reflect.Type, components map[string]interface{}) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		schema := OpenAPISchema(t.Elem(), components)
+		schema["nullable"] = true
+		return schema
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Int64, reflect.Uint64:
+		if t == reflect.TypeOf(time.Duration(0)) {
+			return map[string]interface{}{"type": "integer", "description": "Nanoseconds."}
+		}
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 { // Bytes are encoded as base64.
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": OpenAPISchema(t.Elem(), components)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": OpenAPISchema(t.Elem(), components)}
+	case reflect.Struct:
+		if t == reflect.TypeOf(time.Time{}) {
+			return map[string]interface{}{"type": "string", "format": "date-time"}
+		}
+		// Anonymous structures are described inline.
+		if t.Name() == "" {
+			return OpenAPIStructSchema(t, components)
+		}
+		if _, ok := components[t.Name()]; !ok {
+			components[t.Name()] = nil // Reserve the name in case the structure refers to itself.
+			components[t.Name()] = OpenAPIStructSchema(t, components)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]interface{}{}
+}
+
+// Build the JSON schema of a structure, following the same field rules as encoding/json.
+func OpenAPIStructSchema(t reflect.Type, components map[string]interface{}) map[string]interface{} {
+	properties := make(map[string]interface{})
+	openAPIStructProperties(t, properties, components)
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+// Add the properties of a structure's fields, including those of embedded structures.
+func openAPIStructProperties(t reflect.Type, properties map[string]interface{}, components map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		// Embedded structures without a name have their fields included.
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			openAPIStructProperties(field.Type, properties, components)
+			continue
+		}
+		if field.PkgPath != "" { // Unexported.
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = OpenAPISchema(field.Type, components)
+	}
+}
+
+// Build the OpenAPI document.
+func OpenAPISpec() map[string]interface{} {
+	components := make(map[string]interface{})
+	paths := make(map[string]map[string]interface{})
+
+	for _, endpoint := range OpenAPIEndpoints {
+		isV2 := strings.HasPrefix(endpoint.Path, "/api/v2/")
+		var parameters []interface{}
+
+		// Path parameters.
+		for _, match := range openAPIPathVar.FindAllStringSubmatch(endpoint.Path, -1) {
+			schema := map[string]interface{}{"type": "string"}
+			if match[2] != "" {
+				schema["enum"] = strings.Split(match[2], "|")
+			}
+			parameters = append(parameters, map[string]interface{}{"name": match[1], "in": "path", "required": true, "schema": schema})
+		}
+
+		// Other parameters are sent in the query for GET and DELETE requests, and as form data otherwise.
+		formProperties := make(map[string]interface{})
+		var formRequired []string
+		for _, param := range endpoint.Params {
+			schema := map[string]interface{}{"type": "string"}
+			if param.Enum != nil {
+				schema["enum"] = param.Enum
+			}
+			if endpoint.Method != http.MethodGet && endpoint.Method != http.MethodDelete {
+				if param.Description != "" {
+					schema["description"] = param.Description
+				}
+				formProperties[param.Name] = schema
+				if param.Required {
+					formRequired = append(formRequired, param.Name)
+				}
+				continue
+			}
+			parameter := map[string]interface{}{"name": param.Name, "in": "query", "required": param.Required, "schema": schema}
+			if param.Description != "" {
+				parameter["description"] = param.Description
+			}
+			parameters = append(parameters, parameter)
+		}
+
+		operation := map[string]interface{}{"summary": endpoint.Summary}
+		if endpoint.Permission != "" {
+			if strings.Contains(endpoint.Permission, " and ") {
+				operation["description"] = "Requires the " + endpoint.Permission + " permissions."
+			} else {
+				operation["description"] = "Requires the " + endpoint.Permission + " permission."
+			}
+		}
+		if len(parameters) != 0 {
+			operation["parameters"] = parameters
+		}
+		if len(formProperties) != 0 {
+			schema := map[string]interface{}{"type": "object", "properties": formProperties}
+			if len(formRequired) != 0 {
+				schema["required"] = formRequired
+			}
+			operation["requestBody"] = map[string]interface{}{
+				"content": map[string]interface{}{"application/x-www-form-urlencoded": map[string]interface{}{"schema": schema}},
+			}
+		}
+
+		// Responses.
+		responses := make(map[string]interface{})
+		if endpoint.Redirect {
+			responses["302"] = map[string]interface{}{"description": "Redirect."}
+		} else if endpoint.ContentType != nil {
+			content := make(map[string]interface{})
+			var descriptions []string
+			for contentType, description := range endpoint.ContentType {
+				content[contentType] = map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}
+				descriptions = append(descriptions, description)
+			}
+			sort.Strings(descriptions)
+			responses["200"] = map[string]interface{}{"description": strings.Join(descriptions, " "), "content": content}
+		} else {
+			description := "Success."
+			if !isV2 {
+				description = "Success, or an error with a status of error."
+			}
+			responses["200"] = map[string]interface{}{
+				"description": description,
+				"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": OpenAPISchema(reflect.TypeOf(endpoint.Response), components)}},
+			}
+		}
+		// Errors in the v2 API are sent with a HTTP status code, the original API only does so for authentication.
+		if isV2 {
+			responses["default"] = map[string]interface{}{
+				"description": "Error.",
+				"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": OpenAPISchema(reflect.TypeOf(APIV2ErrorResp{}), components)}},
+			}
+		} else if !AuthIsPublicPath(endpoint.Path) {
+			responses["401"] = map[string]interface{}{"description": "Login required."}
+		}
+		operation["responses"] = responses
+
+		path := OpenAPIPathName(endpoint.Path)
+		if paths[path] == nil {
+			paths[path] = make(map[string]interface{})
+		}
+		paths[path][strings.ToLower(endpoint.Method)] = operation
+	}
+
+	version := ""
+	if app.context != nil {
+		version = app.context.App.Version
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Mail Archive API",
+			"version": version,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": components,
+			"securitySchemes": map[string]interface{}{
+				"session": map[string]interface{}{"type": "apiKey", "in": "cookie", "name": AuthSessionCookie},
+				"token":   map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+		"security": []interface{}{
+			map[string]interface{}{"session": []string{}},
+			map[string]interface{}{"token": []string{}},
+		},
+	}
+}
+
+// Compare the routes registered with the router against the documented endpoints.
+// Returns a description of each route which is not documented, and each endpoint which is not registered.
+// Variable patterns are not compared, as the documentation may list values the route does not restrict.
+func OpenAPICheckRoutes(r *mux.Router) (problems []string) {
+	documented := make(map[string]bool)
+	for _, endpoint := range OpenAPIEndpoints {
+		documented[endpoint.Method+" "+OpenAPIPathName(endpoint.Path)] = true
+	}
+
+	registered := make(map[string]bool)
+	r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(path, "/api/") {
+			return nil
+		}
+		// Path prefixes, such as the not found handlers, are not endpoints.
+		if pathRegexp, err := route.GetPathRegexp(); err != nil || !strings.HasSuffix(pathRegexp, "$") {
+			return nil
+		}
+		// Routes which accept any method are documented as GET.
+		methods, err := route.GetMethods()
+		if err != nil {
+			methods = []string{http.MethodGet}
+		}
+		path = OpenAPIPathName(path)
+		for _, method := range methods {
+			registered[method+" "+path] = true
+			if !documented[method+" "+path] {
+				problems = append(problems, "Route "+method+" "+path+" is not documented.")
+			}
+		}
+		return nil
+	})
+
+	for _, endpoint := range OpenAPIEndpoints {
+		if !registered[endpoint.Method+" "+OpenAPIPathName(endpoint.Path)] {
+			problems = append(problems, "Endpoint "+endpoint.Method+" "+endpoint.Path+" is not registered.")
+		}
+	}
+	return
+}
+
+// Setup HTTP router with the route for the OpenAPI document.
+func (s *HTTPServer) RegisterOpenAPIRoutes(r *mux.Router) {
+	r.HandleFunc(OpenAPIPath, func(w http.ResponseWriter, r *http.Request) {
+		s.JSONResponse(w, OpenAPISpec())
+	}).Methods("GET")
+}
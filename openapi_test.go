@@ -0,0 +1,9 @@
+package main
+
+import "testing"
+
+func TestOpenAPICheckRoutes(t *testing.T) {
+	for _, problem := range OpenAPICheckRoutes(testRouter()) {
+		t.Error(problem)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/mcuadros/go-syslog.v2"
+)
+
+// Tracks work which should finish before shutdown, such as messages being received and cleanup of old messages.
+type AppWork struct {
+	mutex    sync.RWMutex
+	wait     sync.WaitGroup
+	stopping bool
+}
+
+// Start work, unless shutdown has started. If true is returned, End must be called once the work is done.
+func (w *AppWork) Begin() bool {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	if w.stopping {
+		return false
+	}
+	w.wait.Add(1)
+	return true
+}
+
+// Finish work which was started.
+func (w *AppWork) End() {
+	w.wait.Done()
+}
+
+// Check if shutdown has started, so long running work can stop early.
+func (w *AppWork) Stopping() bool {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	return w.stopping
+}
+
+// Prevent new work from starting.
+func (w *AppWork) Stop() {
+	w.mutex.Lock()
+	w.stopping = true
+	w.mutex.Unlock()
+}
+
+// Wait for work in progress to finish, returning false if the timeout passed first.
+func (w *AppWork) Wait(timeout time.Duration) bool {
+	return appWaitTimeout(w.wait.Wait, timeout)
+}
+
+// Call a function which waits for something, returning false if it did not return within the timeout.
+func appWaitTimeout(wait func(), timeout time.Duration) bool {
+	done := make(chan bool)
+	go func() {
+		wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Wait for SIGTERM or SIGINT, then shutdown. A second signal stops immediately.
+// SIGHUP reloads the configuration while waiting.
+func AppWaitForSignal(sysLogChannel syslog.LogPartsChannel, sysLogDone chan bool) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	sig := <-signals
+	for sig == syscall.SIGHUP {
+		logApp.Info("Reloading configuration", "signal", sig)
+		ConfigReload(ConfigReloadSignal)
+		sig = <-signals
+	}
+	signal.Stop(signals)
+	logApp.Info("Shutting down", "signal", sig)
+	AppShutdown(sysLogChannel, sysLogDone)
+}
+
+// Stop the servers, let messages being received and database writes finish within the shutdown timeout,
+// process the syslog update queue and close the database once the syslog runner has stopped.
+func AppShutdown(sysLogChannel syslog.LogPartsChannel, sysLogDone chan bool) {
+	deadline := time.Now().Add(app.Config().ShutdownTimeout * time.Second)
+	app.work.Stop()
+
+	// Stop accepting new connections. Messages being received over SMTP are allowed to finish.
+	if app.smtpListener != nil {
+		app.smtpListener.Close()
+	}
+	if app.sysLogServer != nil {
+		app.sysLogServer.Kill()
+	}
+	// Running exports would not finish in time, so they are cancelled.
+	ExportCancelAll()
+	// HTTP requests in progress are allowed to finish.
+	httpDone := make(chan bool)
+	go func() {
+		if app.httpServer != nil && app.httpServer.server != nil {
+			ctx, cancel := context.WithDeadline(context.Background(), deadline)
+			app.httpServer.server.Shutdown(ctx)
+			cancel()
+		}
+		close(httpDone)
+	}()
+
+	// Wait for messages being received, cleanup, log file reads and other database writes.
+	workDone := app.work.Wait(time.Until(deadline))
+	if !workDone {
+		logApp.Warn("Timed out waiting for work in progress to finish")
+	}
+	<-httpDone
+
+	// Once nothing is feeding the syslog runner, let it process what it was sent.
+	// Connections from syslog clients are not closed by the syslog server, and keep it running until they disconnect.
+	sysLogStopped := false
+	if workDone && (app.sysLogServer == nil || appWaitTimeout(app.sysLogServer.Wait, time.Until(deadline))) {
+		close(sysLogChannel)
+		sysLogStopped = appWaitTimeout(func() { <-sysLogDone }, time.Until(deadline))
+	}
+
+	// Any remaining SMTP sessions have not sent a message, they will be retried by the client.
+	if app.smtpServer != nil {
+		app.smtpServer.Close()
+	}
+
+	// The syslog runner writes to the database until it stops, so the database is only closed once it has.
+	// Messages left with an unknown status are reconciled after the next start.
+	if !sysLogStopped {
+		logApp.Warn("Syslog messages still being received were not processed")
+		return
+	}
+	// Apply the status of messages which syslog messages were processed for.
+	SysLogProcessMailUpdateQueue()
+	app.db.Close()
+	logApp.Info("Shutdown complete")
+}
@@ -3,11 +3,11 @@ package main
 import (
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"time"
 
 	"github.com/emersion/go-smtp"
+	"github.com/google/uuid"
 )
 
 // The backend structure is called for authentication of a new session.
@@ -18,23 +18,34 @@ type SMTPBackend struct {
 // During the process of receiving an email, this session is called.
 type SMTPSession struct {
 	smtp.Session
+	id         string // Logged with each line about the session, and each message received in it.
+	log        *Logger
 	remoteAddr net.Addr
 	from       string
-	to         string
+	to         []string
+}
+
+// Start a new session with an ID for logs.
+func NewSMTPSession(state *smtp.ConnectionState) *SMTPSession {
+	metricSMTPSessions.Inc()
+	id := uuid.New().String()
+	s := &SMTPSession{
+		id:         id,
+		log:        logSMTP.With("session", id),
+		remoteAddr: state.RemoteAddr,
+	}
+	s.log.Debug("Session started", "remote_addr", state.RemoteAddr, "helo", state.Hostname)
+	return s
 }
 
 // On login, we do not care about authentication. So we just start a new session and provide it ;)
 func (b *SMTPBackend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
-	return &SMTPSession{
-		remoteAddr: state.RemoteAddr,
-	}, nil
+	return NewSMTPSession(state), nil
 }
 
 // We want to receive all emails, including anonymous emails.
 func (b *SMTPBackend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
-	return &SMTPSession{
-		remoteAddr: state.RemoteAddr,
-	}, nil //return nil, smtp.ErrAuthRequired
+	return NewSMTPSession(state), nil //return nil, smtp.ErrAuthRequired
 }
 
 // The session has provided mail options and who the message is from.
@@ -46,43 +57,61 @@ func (s *SMTPSession) Mail(from string, opts smtp.MailOptions) error {
 
 // The session has provided who the mail is to.
 func (s *SMTPSession) Rcpt(to string) error {
-	// Store who the mail is to for final message data.
-	s.to = to
+	// Store who the mail is to for final message data, there may be multiple recipients.
+	s.to = append(s.to, to)
 	return nil
 }
 
 // The session has provided the data for the message.
 func (s *SMTPSession) Data(r io.Reader) error {
+	// Messages are not accepted once shutdown has started, the client will try again later.
+	if !app.work.Begin() {
+		metricSMTPRejections.Inc("shutdown")
+		s.log.Warn("Message rejected while shutting down", "from", s.from)
+		return &smtp.SMTPError{Code: 421, EnhancedCode: smtp.EnhancedCode{4, 3, 2}, Message: "Service shutting down"}
+	}
+	defer app.work.End()
+
 	// Save the message to the database.
-	err := MailSaveMessage(s.remoteAddr.String(), s.from, s.to, r)
+	err := MailSaveMessage(s.id, s.remoteAddr.String(), s.from, s.to, r)
+	// Messages over the maximum size are rejected, so the client knows they were not archived.
+	if err == smtp.ErrDataTooLarge {
+		metricSMTPRejections.Inc("too_large")
+		s.log.Warn("Message rejected as it is too large", "from", s.from)
+		return err
+	}
 	if err != nil {
-		log.Println("Unable to parse email:", err)
+		s.log.Error("Unable to parse email", "from", s.from, "error", err)
 	}
 	return nil
 }
 
-// When the SMTP session is requested to start over.
-func (s *SMTPSession) Reset() {}
+// When the SMTP session is requested to start over, or after a message, the envelope is cleared.
+func (s *SMTPSession) Reset() {
+	s.from = ""
+	s.to = nil
+}
 
 // When the session is done completely.
 func (s *SMTPSession) Logout() error {
+	s.log.Debug("Session ended")
 	return nil
 }
 
 // This function starts the SMTP server.
 func SMTPServe() {
 	// Get the configuration.
-	smtpBindAddr := app.config.SMTPBindAddr
-	smtpPort := app.config.SMTPPort
-	smtpDomain := app.config.SMTPDomain
-	if app.context.String("smtp-bind") != "" {
-		smtpBindAddr = app.context.String("smtp-bind")
+	smtpBindAddr := app.Config().SMTPBindAddr
+	smtpPort := app.Config().SMTPPort
+	smtpDomain := app.Config().SMTPDomain
+	if app.context.GlobalString("smtp-bind") != "" {
+		smtpBindAddr = app.context.GlobalString("smtp-bind")
 	}
-	if app.context.Uint("smtp-port") != 0 {
-		smtpPort = app.context.Uint("smtp-port")
+	if app.context.GlobalUint("smtp-port") != 0 {
+		smtpPort = app.context.GlobalUint("smtp-port")
 	}
-	if app.context.String("smtp-domain") != "" {
-		smtpDomain = app.context.String("smtp-domain")
+	if app.context.GlobalString("smtp-domain") != "" {
+		smtpDomain = app.context.GlobalString("smtp-domain")
 	}
 
 	// Create the SMTP server with our custom backend.
@@ -95,13 +124,22 @@ func SMTPServe() {
 	smtpServer.Domain = smtpDomain
 	smtpServer.ReadTimeout = 10 * time.Second
 	smtpServer.WriteTimeout = 10 * time.Second
-	smtpServer.MaxMessageBytes = app.config.MaxMessageSize
+	smtpServer.MaxMessageBytes = app.Config().MaxMessageSize
 	smtpServer.MaxRecipients = 50
 	smtpServer.AllowInsecureAuth = true
+	smtpServer.ErrorLog = LogWriter{logSMTP, LogLevelWarn}
 
-	// Start the server.
-	log.Println("Starting smtp server on port", smtpPort)
-	if err := smtpServer.ListenAndServe(); err != nil {
-		log.Fatal(err)
+	// Start the server. The listener is kept, so it can be closed on shutdown while messages are still received.
+	listener, err := net.Listen("tcp", smtpServer.Addr)
+	if err != nil {
+		logSMTP.Fatal("Unable to start smtp server", "error", err)
+	}
+	app.smtpListener = listener
+	HealthSetListener("smtp_listener", HealthListenerListening, nil)
+	logSMTP.Info("Starting smtp server", "port", smtpPort)
+	err = smtpServer.Serve(listener)
+	HealthSetListener("smtp_listener", HealthListenerStopped, err)
+	if err != nil && !app.work.Stopping() {
+		logSMTP.Fatal("Smtp server failed", "error", err)
 	}
 }
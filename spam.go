@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Errors returned when a report cannot be sent.
+var (
+	ErrSpamReportNoEndpoint = errors.New(APINoEndpoint)
+	ErrSpamReportNoMessage  = errors.New(APINoMessage)
+	ErrSpamReportBuild      = errors.New("Unable to build report.")
+)
+
+// Report a message as spam or ham to the configured spam reporting tools.
+// Returns the result of the request to each tool, and if any request was successful.
+func SpamReportMessage(UUID, reportType string) (requests []map[string]string, anySuccess bool, err error) {
+	// The configuration is read once, so a reload does not change it part way through.
+	config := app.Config()
+
+	// The response type should only be spam or ham.
+	var reportingURI string
+	if reportType == "spam" {
+		reportingURI = config.SpamReportingSpamURI
+	} else if reportType == "ham" {
+		reportingURI = config.SpamReportingHamURI
+	}
+
+	// If the reporting URI was not sent, there is no endpoint.
+	if reportingURI == "" {
+		err = ErrSpamReportNoEndpoint
+		return
+	}
+
+	// To report spam, we need the message data. So we will find it in either the database or file system accordingly.
+	reader, err := MailGetMessageData(UUID)
+	if err != nil { // If no message found, we tell the client.
+		err = ErrSpamReportNoMessage
+		return
+	}
+	// If we need to close after reading, defer the close to after this function call.
+	if x, ok := reader.(io.Closer); ok {
+		defer x.Close()
+	}
+
+	// Multipart Form Data writer/buffer for sending message via post.
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+
+	// file form entry.
+	fw, err := mw.CreateFormFile(config.SpamReportingUploadName, UUID+".eml")
+	if err != nil {
+		err = ErrSpamReportBuild
+		return
+	}
+	// Copy message data to multipart form entry.
+	if _, err = io.Copy(fw, reader); err != nil {
+		err = ErrSpamReportBuild
+		return
+	}
+
+	// If an authentication field is set, add it to the form data.
+	if config.SpamReportingAuthKey != "" {
+		mw.WriteField(config.SpamReportingAuthKey, config.SpamReportingAuthValue)
+	}
+
+	// We are done adding to the multipart form.
+	mw.Close()
+
+	// Go through the configured spam reporting URLs and submit.
+	for _, baseURL := range config.SpamReportingAPIBaseURLS {
+		url := baseURL + reportingURI
+
+		// Request string map to provide feedback via API on what happend per reporting URL.
+		request := make(map[string]string)
+		request["url"] = url
+
+		// Make request for the report using the form data.
+		// Each request reads the form data from the start.
+		req, err := http.NewRequest("POST", url, bytes.NewReader(b.Bytes()))
+		if err != nil { // If failed, just mark this request as failed and continue.
+			request["success"] = "false"
+			request["error"] = fmt.Sprintf("%v", err)
+			requests = append(requests, request)
+			continue
+		}
+
+		// Set the content type header to the multipart formdata header with proper boundary.
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+
+		// If an authentication header is set in config, we need to send it.
+		authHeaderS := strings.Split(config.SpamReportingAuthHeader, ": ")
+		if len(authHeaderS) == 2 {
+			req.Header.Set(authHeaderS[0], authHeaderS[1])
+		}
+
+		// Setup http client.
+		client := &http.Client{
+			Timeout: time.Second * 10,
+		}
+		// Send report.
+		res, err := client.Do(req)
+		if err != nil { // If error, just store that this errored and continue.
+			request["success"] = "false"
+			request["error"] = fmt.Sprintf("%v", err)
+			requests = append(requests, request)
+			continue
+		}
+
+		// If the status code is not ok, something went wrong... Store that this failed and continue.
+		if res.StatusCode != http.StatusOK {
+			res.Body.Close()
+			request["success"] = "false"
+			request["error"] = fmt.Sprintf("%v", res.StatusCode)
+			requests = append(requests, request)
+			continue
+		}
+		// If we made this this far, sending the report was a success.
+		request["success"] = "true"
+
+		// read the respons ebody.
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		request["response"] = string(body)
+		// Add the request to the list of requests in the response.
+		requests = append(requests, request)
+		// A request was successful.
+		anySuccess = true
+	}
+	return
+}
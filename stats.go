@@ -0,0 +1,389 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Intervals the volume of messages may be grouped by.
+const (
+	StatsIntervalHour = "hour"
+	StatsIntervalDay  = "day"
+)
+
+// Limits of statistics requests.
+const (
+	statsDefaultRange   = 7 * 24 * time.Hour // Used when no start is provided.
+	statsMaxPoints      = 2000               // Points in the volume series, so a year may be grouped by day but not by hour.
+	statsDefaultTop     = 10
+	statsMaxTop         = 100
+	statsMaxSpamBuckets = 20
+)
+
+// Fields of message addresses counted as senders and recipients.
+var (
+	statsSenderFields    = []string{"envelope_from", "from"}
+	statsRecipientFields = []string{"envelope_to", "to", "cc", "bcc"}
+)
+
+// Statuses which are always included in the breakdown, so charts have the same series for every range.
+var statsStatuses = []string{"unknown", "queued", "sent", "deferred", "bounced", "quarantined"}
+
+// What statistics are collected for.
+type StatsFilter struct {
+	Since    time.Time
+	Until    time.Time
+	Interval string // Either hour or day.
+	Query    string // Words which must each match, as in a message log search.
+	Top      int    // Number of senders, recipients and domains to include.
+}
+
+// Messages received in an interval.
+type StatsVolume struct {
+	Time     time.Time `json:"time"` // Start of the interval.
+	Messages int       `json:"messages"`
+	Bytes    int64     `json:"bytes"`
+}
+
+// Number of messages with a status, address or domain.
+type StatsCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// Number of messages with a value from min up to, but not including, max.
+type StatsBucket struct {
+	Min   int `json:"min"`
+	Max   int `json:"max"` // Zero if the bucket has no upper bound.
+	Count int `json:"count"`
+}
+
+// Statistics of messages received over a time range, ordered for use in charts.
+type Stats struct {
+	Since               time.Time     `json:"since"`
+	Until               time.Time     `json:"until"`
+	Interval            string        `json:"interval"`
+	Messages            int           `json:"messages"`
+	Bytes               int64         `json:"bytes"`
+	Volume              []StatsVolume `json:"volume"`                // Every interval in the range, oldest first.
+	Statuses            []StatsCount  `json:"statuses"`              // Most common first.
+	TopSenders          []StatsCount  `json:"top_senders"`           // Addresses in the envelope from or from header.
+	TopRecipients       []StatsCount  `json:"top_recipients"`        // Addresses in the envelope to, to, cc or bcc headers.
+	TopSenderDomains    []StatsCount  `json:"top_sender_domains"`    // Domains of senders, counted once for each address.
+	TopRecipientDomains []StatsCount  `json:"top_recipient_domains"` // Domains of recipients, counted once for each address.
+	Sizes               []StatsBucket `json:"sizes"`                 // Message sizes in bytes.
+	SpamScores          []StatsBucket `json:"spam_scores"`
+	Bounced             int           `json:"bounced"`
+	BounceRate          float64       `json:"bounce_rate"` // Fraction of messages which bounced, from 0 to 1.
+}
+
+// Fill in the defaults of a filter, and check that it may be collected.
+func StatsValidateFilter(filter *StatsFilter) error {
+	if filter.Until.IsZero() {
+		filter.Until = time.Now()
+	}
+	if filter.Since.IsZero() {
+		filter.Since = filter.Until.Add(-statsDefaultRange)
+	}
+	if !filter.Since.Before(filter.Until) {
+		return fmt.Errorf("Since must be before until.")
+	}
+	if filter.Interval == "" {
+		// Short ranges are grouped by hour, so there are enough points to chart.
+		filter.Interval = StatsIntervalDay
+		if filter.Until.Sub(filter.Since) <= 2*24*time.Hour {
+			filter.Interval = StatsIntervalHour
+		}
+	}
+	if filter.Interval != StatsIntervalHour && filter.Interval != StatsIntervalDay {
+		return fmt.Errorf("Interval must be hour or day.")
+	}
+	if len(statsIntervals(filter.Since, filter.Until, filter.Interval)) > statsMaxPoints {
+		return fmt.Errorf("The range has more than %d intervals, use a shorter range or a longer interval.", statsMaxPoints)
+	}
+	if filter.Top == 0 {
+		filter.Top = statsDefaultTop
+	}
+	if filter.Top < 0 || filter.Top > statsMaxTop {
+		return fmt.Errorf("Top must be between 1 and %d.", statsMaxTop)
+	}
+	return nil
+}
+
+// Get the start of the interval a time is in, in local time.
+func statsIntervalStart(t time.Time, interval string) time.Time {
+	t = t.In(time.Local)
+	if interval == StatsIntervalHour {
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, time.Local)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+}
+
+// Get the start of each interval in a range.
+func statsIntervals(since time.Time, until time.Time, interval string) (starts []time.Time) {
+	for t := statsIntervalStart(since, interval); t.Before(until); {
+		starts = append(starts, t)
+		// Stop early on ranges which would not be collected, rather than building every interval.
+		if len(starts) > statsMaxPoints {
+			break
+		}
+		if interval == StatsIntervalHour {
+			t = t.Add(time.Hour)
+		} else {
+			t = t.AddDate(0, 0, 1)
+		}
+	}
+	return
+}
+
+// Limit a message log query to the messages in the range and search of a filter, visible to a user.
+func statsMessageQuery(db *gorm.DB, filter StatsFilter, user *User) *gorm.DB {
+	db = AuthScopeFilter(db.Where("received >= ? AND received < ?", filter.Since, filter.Until), user)
+	if filter.Query != "" {
+		db = APIMessageLogSearch(db, filter.Query)
+	}
+	return db
+}
+
+// Sort counts, most common first, and keep the number requested.
+func statsSortCounts(counts map[string]int, top int) []StatsCount {
+	sorted := []StatsCount{}
+	for name, count := range counts {
+		sorted = append(sorted, StatsCount{Name: name, Count: count})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Count != sorted[j].Count {
+			return sorted[i].Count > sorted[j].Count
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+	if top > 0 && len(sorted) > top {
+		sorted = sorted[:top]
+	}
+	return sorted
+}
+
+// Count the messages involving each address in the fields provided, along with each domain.
+// A message is counted once per address, even if the address is in more than one of the fields.
+func statsAddressCounts(filter StatsFilter, user *User, fields []string) (addresses map[string]int, domains map[string]int, err error) {
+	messages := statsMessageQuery(app.db.Table("message_logs").Select("uuid"), filter, user)
+	rows, err := app.db.Table("message_addresses").
+		Select("address, COUNT(DISTINCT uuid)").
+		Where("field IN (?)", fields).
+		Where("uuid IN ?", messages.SubQuery()).
+		Group("address").
+		Rows()
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	addresses = make(map[string]int)
+	domains = make(map[string]int)
+	for rows.Next() {
+		var address string
+		var count int
+		if err = rows.Scan(&address, &count); err != nil {
+			return
+		}
+		addresses[address] = count
+		if i := strings.LastIndex(address, "@"); i != -1 {
+			domains[address[i+1:]] += count
+		}
+	}
+	err = rows.Err()
+	return
+}
+
+// Get the expression grouping messages by when they were received, into periods of the seconds provided from the epoch.
+// Each database has its own function to get the seconds since the epoch.
+func statsReceivedPeriod(db *gorm.DB, seconds int) string {
+	switch db.Dialect().GetName() {
+	case "mysql":
+		return fmt.Sprintf("UNIX_TIMESTAMP(received) DIV %d", seconds)
+	case "postgres":
+		return fmt.Sprintf("CAST(EXTRACT(EPOCH FROM received) AS BIGINT) / %d", seconds)
+	}
+	return fmt.Sprintf("CAST(strftime('%%s', received) AS INTEGER) / %d", seconds)
+}
+
+// Get the length of the periods messages are grouped into by the database, which are then counted in their interval.
+// Intervals start on the hour in local time, so none start within an hour unless the time zone is offset by part of an hour.
+func statsPeriodSeconds(starts []time.Time) int {
+	for _, start := range starts {
+		if _, offset := start.Zone(); offset%3600 != 0 {
+			return 15 * 60
+		}
+	}
+	return 3600
+}
+
+// Collect statistics of the messages matching a filter, visible to a user.
+// Messages are grouped by the database into periods which are counted in their interval here,
+// as grouping by local time differs between databases.
+func StatsCollect(filter StatsFilter, user *User) (stats Stats, err error) {
+	stats.Since = filter.Since
+	stats.Until = filter.Until
+	stats.Interval = filter.Interval
+
+	// Every interval is included, so charts show when no messages were received.
+	stats.Volume = []StatsVolume{}
+	volumeIndex := make(map[int64]int)
+	starts := statsIntervals(filter.Since, filter.Until, filter.Interval)
+	for _, start := range starts {
+		volumeIndex[start.Unix()] = len(stats.Volume)
+		stats.Volume = append(stats.Volume, StatsVolume{Time: start})
+	}
+
+	statuses := make(map[string]int)
+	for _, status := range statsStatuses {
+		statuses[status] = 0
+	}
+
+	// Count messages by period and status.
+	seconds := statsPeriodSeconds(starts)
+	period := statsReceivedPeriod(app.db, seconds)
+	rows, err := statsMessageQuery(app.db.Table("message_logs").Select(period+", status, COUNT(*), SUM(size)"), filter, user).
+		Group(period + ", status").
+		Rows()
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var periodStart int64
+		var status string
+		var count int
+		var size int64
+		if err = rows.Scan(&periodStart, &status, &count, &size); err != nil {
+			return
+		}
+
+		stats.Messages += count
+		stats.Bytes += size
+		if i, ok := volumeIndex[statsIntervalStart(time.Unix(periodStart*int64(seconds), 0), filter.Interval).Unix()]; ok {
+			stats.Volume[i].Messages += count
+			stats.Volume[i].Bytes += size
+		}
+		statuses[status] += count
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	stats.Statuses = statsSortCounts(statuses, 0)
+	stats.Bounced = statuses["bounced"]
+	if stats.Messages != 0 {
+		stats.BounceRate = float64(stats.Bounced) / float64(stats.Messages)
+	}
+
+	if stats.Sizes, err = statsSizeBuckets(filter, user); err != nil {
+		return
+	}
+	spamScores, err := statsSpamScores(filter, user)
+	if err != nil {
+		return
+	}
+	stats.SpamScores = statsSpamBuckets(spamScores)
+
+	senders, senderDomains, err := statsAddressCounts(filter, user, statsSenderFields)
+	if err != nil {
+		return
+	}
+	recipients, recipientDomains, err := statsAddressCounts(filter, user, statsRecipientFields)
+	if err != nil {
+		return
+	}
+	stats.TopSenders = statsSortCounts(senders, filter.Top)
+	stats.TopRecipients = statsSortCounts(recipients, filter.Top)
+	stats.TopSenderDomains = statsSortCounts(senderDomains, filter.Top)
+	stats.TopRecipientDomains = statsSortCounts(recipientDomains, filter.Top)
+	return
+}
+
+// Count message sizes in bytes, in the same buckets as the size metric.
+func statsSizeBuckets(filter StatsFilter, user *User) (buckets []StatsBucket, err error) {
+	buckets = []StatsBucket{{Min: 0, Max: int(MetricSizeBuckets[0])}}
+	for i := 1; i < len(MetricSizeBuckets); i++ {
+		buckets = append(buckets, StatsBucket{Min: int(MetricSizeBuckets[i-1]), Max: int(MetricSizeBuckets[i])})
+	}
+	buckets = append(buckets, StatsBucket{Min: int(MetricSizeBuckets[len(MetricSizeBuckets)-1])})
+
+	// The database groups messages by the index of their bucket.
+	bucket := "CASE"
+	for i, max := range MetricSizeBuckets {
+		bucket += fmt.Sprintf(" WHEN size < %d THEN %d", int(max), i)
+	}
+	bucket += fmt.Sprintf(" ELSE %d END", len(MetricSizeBuckets))
+	rows, err := statsMessageQuery(app.db.Table("message_logs").Select(bucket+", COUNT(*)"), filter, user).Group(bucket).Rows()
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var i, count int
+		if err = rows.Scan(&i, &count); err != nil {
+			return
+		}
+		buckets[i].Count = count
+	}
+	err = rows.Err()
+	return
+}
+
+// Count the messages with each spam score.
+func statsSpamScores(filter StatsFilter, user *User) (scores map[int]int, err error) {
+	rows, err := statsMessageQuery(app.db.Table("message_logs").Select("spam_score, COUNT(*)"), filter, user).Group("spam_score").Rows()
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	scores = make(map[int]int)
+	for rows.Next() {
+		var score, count int
+		if err = rows.Scan(&score, &count); err != nil {
+			return
+		}
+		scores[score] = count
+	}
+	err = rows.Err()
+	return
+}
+
+// Group spam scores into buckets from the lowest to the highest score found.
+// Each score has its own bucket, unless there are too many to chart, in which case buckets are widened.
+func statsSpamBuckets(scores map[int]int) []StatsBucket {
+	buckets := []StatsBucket{}
+	if len(scores) == 0 {
+		return buckets
+	}
+	lowest, highest := 0, 0
+	first := true
+	for score := range scores {
+		if first || score < lowest {
+			lowest = score
+		}
+		if first || score > highest {
+			highest = score
+		}
+		first = false
+	}
+	width := (highest-lowest)/statsMaxSpamBuckets + 1
+	maxInt := int(^uint(0) >> 1)
+	for i := 0; i <= (highest-lowest)/width; i++ {
+		bucket := StatsBucket{Min: lowest + i*width}
+		// The last bucket has no upper bound if it would be past the largest score possible.
+		if bucket.Min <= maxInt-width {
+			bucket.Max = bucket.Min + width
+		}
+		buckets = append(buckets, bucket)
+	}
+	// Each score is counted in its bucket, rather than going through every score in the range.
+	for score, count := range scores {
+		buckets[(score-lowest)/width].Count += count
+	}
+	return buckets
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatsCollect(t *testing.T) {
+	local := time.Local
+	t.Cleanup(func() { time.Local = local })
+
+	for _, zone := range []*time.Location{time.UTC, time.FixedZone("UTC-4", -4*3600), time.FixedZone("UTC+5:30", 5*3600+1800)} {
+		time.Local = zone
+		testApp(t)
+		day := time.Date(2026, 10, 18, 0, 0, 0, 0, zone)
+		messages := []MessageLog{
+			{Received: day.Add(-time.Minute), Status: "sent", Size: 100},                          // Before the range.
+			{Received: day.Add(10 * time.Minute), Status: "sent", Size: 500, SpamScore: 1},        // First hour.
+			{Received: day.Add(50 * time.Minute), Status: "bounced", Size: 2000, SpamScore: 1},    // First hour.
+			{Received: day.Add(90 * time.Minute), Status: "sent", Size: 5000, SpamScore: 3},       // Second hour.
+			{Received: day.Add(25 * time.Hour), Status: "deferred", Size: 20000000, SpamScore: 9}, // Second day.
+		}
+		for i, message := range messages {
+			message.UUID = string(rune('a' + i))
+			app.db.Create(&message)
+		}
+
+		stats, err := StatsCollect(StatsFilter{Since: day, Until: day.Add(48 * time.Hour), Interval: StatsIntervalDay}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Messages != 4 || stats.Bytes != 20007500 || stats.Bounced != 1 || stats.BounceRate != 0.25 {
+			t.Errorf("%s: %d messages, %d bytes and %d bounced at a rate of %v", zone, stats.Messages, stats.Bytes, stats.Bounced, stats.BounceRate)
+		}
+		if len(stats.Volume) != 2 || stats.Volume[0].Messages != 3 || stats.Volume[0].Bytes != 7500 || stats.Volume[1].Messages != 1 {
+			t.Errorf("%s: daily volume %+v", zone, stats.Volume)
+		}
+		statuses := make(map[string]int)
+		for _, status := range stats.Statuses {
+			statuses[status.Name] = status.Count
+		}
+		if len(statuses) != len(statsStatuses) || statuses["sent"] != 2 || statuses["bounced"] != 1 || statuses["deferred"] != 1 {
+			t.Errorf("%s: statuses %+v", zone, stats.Statuses)
+		}
+		sizes := []int{1, 1, 1, 0, 0, 0, 0, 0, 1}
+		for i, bucket := range stats.Sizes {
+			if bucket.Count != sizes[i] {
+				t.Errorf("%s: %d messages from %d to %d bytes, expected %d", zone, bucket.Count, bucket.Min, bucket.Max, sizes[i])
+			}
+		}
+		spamScores := 0
+		for _, bucket := range stats.SpamScores {
+			spamScores += bucket.Count
+		}
+		if len(stats.SpamScores) != 9 || stats.SpamScores[0].Count != 2 || spamScores != 4 {
+			t.Errorf("%s: spam scores %+v", zone, stats.SpamScores)
+		}
+
+		stats, err = StatsCollect(StatsFilter{Since: day, Until: day.Add(3 * time.Hour), Interval: StatsIntervalHour}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stats.Volume) != 3 || stats.Volume[0].Messages != 2 || stats.Volume[1].Messages != 1 || stats.Volume[2].Messages != 0 {
+			t.Errorf("%s: hourly volume %+v", zone, stats.Volume)
+		}
+	}
+}
+
+func TestStatsSpamBuckets(t *testing.T) {
+	maxInt := int(^uint(0) >> 1)
+	tests := []struct {
+		name    string
+		scores  map[int]int
+		buckets int
+		last    StatsBucket
+	}{
+		{"no scores", map[int]int{}, 0, StatsBucket{}},
+		{"a bucket for each score", map[int]int{1: 2, 3: 1, 9: 1}, 9, StatsBucket{Min: 9, Max: 10, Count: 1}},
+		{"widened buckets", map[int]int{0: 1, 100: 1}, 17, StatsBucket{Min: 96, Max: 102, Count: 1}},
+		{"extreme score", map[int]int{0: 1, 9000000000000000000: 1}, 20, StatsBucket{Min: 8550000000000000019, Max: 9000000000000000020, Count: 1}},
+		{"largest score possible", map[int]int{5: 1, maxInt: 1}, 20, StatsBucket{Min: 5 + 19*((maxInt-5)/20+1), Count: 1}},
+	}
+	for _, test := range tests {
+		buckets := statsSpamBuckets(test.scores)
+		count := 0
+		for _, bucket := range buckets {
+			count += bucket.Count
+		}
+		total := 0
+		for _, c := range test.scores {
+			total += c
+		}
+		if len(buckets) != test.buckets || count != total {
+			t.Errorf("%s: %d buckets counting %d messages, expected %d buckets counting %d", test.name, len(buckets), count, test.buckets, total)
+			continue
+		}
+		if len(buckets) != 0 && buckets[len(buckets)-1] != test.last {
+			t.Errorf("%s: last bucket %+v, expected %+v", test.name, buckets[len(buckets)-1], test.last)
+		}
+	}
+}
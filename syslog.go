@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"regexp"
 	"strings"
 	"time"
@@ -40,6 +39,7 @@ func SysLogCheckIfNewConnection(sid string) {
 		sysLogBuffer.activeConnections = append(sysLogBuffer.activeConnections, newConnection)
 
 		// Any log messages buffered for the new connection are now associated to this syslog id.
+		metricSysLogMatched.Add(float64(len(sysLogBuffer.logMessages)), "connection")
 		for _, logMessage := range sysLogBuffer.logMessages {
 			SysLogStoreMessage(logMessage, sid)
 		}
@@ -56,7 +56,7 @@ func SysLogStoreMessage(logMessage map[string]interface{}, sid string) {
 	hostname := logMessage["hostname"].(string)
 
 	// Check to see if the message received matches any ignore strings set.
-	for _, ignore := range app.config.SysLogIgnoreContaining {
+	for _, ignore := range app.Config().SysLogIgnoreContaining {
 		if strings.Contains(content, ignore) {
 			// If we match, look in the database for syslog id information entries.
 			var match SysLogIDInfo
@@ -81,9 +81,9 @@ func SysLogStoreMessage(logMessage map[string]interface{}, sid string) {
 			//  was never generated for the delivery of the message.
 			match.Ignore = false
 			app.db.Save(&match)
-			log.Println("Syslog:", match.SID, match.Status)
+			logSysLog.Info("Status updated", "queue_id", match.SID, "hostname", match.Hostname, "status", match.Status)
 			// The status was updated, so we can save to the queue for procoessing.
-			app.sysLogMailUpdateQueue[sid+":"+hostname] = true
+			SysLogQueueMailUpdate(sid+":"+hostname)
 		}
 	} else if strings.Contains(content, "status=sent") {
 		// If this message queue id was sent, we update the database.
@@ -91,10 +91,12 @@ func SysLogStoreMessage(logMessage map[string]interface{}, sid string) {
 		app.db.Where("s_id = ? AND hostname = ?", sid, hostname).First(&match)
 		if match.SID != "" {
 			match.Status = "sent"
+			// Keep track of hand-offs to other queues so the whole path can be followed.
+			SysLogRecordHandOff(&match, content)
 			app.db.Save(&match)
-			log.Println("Syslog:", match.SID, match.Status)
+			logSysLog.Info("Status updated", "queue_id", match.SID, "hostname", match.Hostname, "status", match.Status)
 			// The status was updated, so we can save to the queue for procoessing.
-			app.sysLogMailUpdateQueue[sid+":"+hostname] = true
+			SysLogQueueMailUpdate(sid+":"+hostname)
 		}
 	} else if strings.Contains(content, "250 2.5.0 OK") {
 		// If this message queue id was sent, we update the database.
@@ -104,9 +106,9 @@ func SysLogStoreMessage(logMessage map[string]interface{}, sid string) {
 		if match.SID != "" && match.Status != "quarantined" {
 			match.Status = "sent"
 			app.db.Save(&match)
-			log.Println("Syslog:", match.SID, match.Status)
+			logSysLog.Info("Status updated", "queue_id", match.SID, "hostname", match.Hostname, "status", match.Status)
 			// The status was updated, so we can save to the queue for procoessing.
-			app.sysLogMailUpdateQueue[sid+":"+hostname] = true
+			SysLogQueueMailUpdate(sid+":"+hostname)
 		}
 	} else if strings.Contains(content, "status=deferred") {
 		// If this message queue id was deferred, we update the database.
@@ -115,9 +117,9 @@ func SysLogStoreMessage(logMessage map[string]interface{}, sid string) {
 		if match.SID != "" {
 			match.Status = "deferred"
 			app.db.Save(&match)
-			log.Println("Syslog:", match.SID, match.Status)
+			logSysLog.Info("Status updated", "queue_id", match.SID, "hostname", match.Hostname, "status", match.Status)
 			// The status was updated, so we can save to the queue for procoessing.
-			app.sysLogMailUpdateQueue[sid+":"+hostname] = true
+			SysLogQueueMailUpdate(sid+":"+hostname)
 		}
 	} else if strings.Contains(content, "status=bounced") {
 		// If this message queue id was bounced, we update the database.
@@ -126,9 +128,9 @@ func SysLogStoreMessage(logMessage map[string]interface{}, sid string) {
 		if match.SID != "" {
 			match.Status = "bounced"
 			app.db.Save(&match)
-			log.Println("Syslog:", match.SID, match.Status)
+			logSysLog.Info("Status updated", "queue_id", match.SID, "hostname", match.Hostname, "status", match.Status)
 			// The status was updated, so we can save to the queue for procoessing.
-			app.sysLogMailUpdateQueue[sid+":"+hostname] = true
+			SysLogQueueMailUpdate(sid+":"+hostname)
 		}
 	}
 
@@ -161,9 +163,12 @@ func SysLogRunner(channel syslog.LogPartsChannel) {
 
 	// When a log message is received.
 	for logParts := range channel {
+		metricSysLogReceived.Inc()
+		HealthRecordSysLog()
 		// Check to see if the received tag is one associated with emails.
 		tag := logParts["tag"].(string)
 		if !rxMailMessage.MatchString(tag) {
+			SysLogRecordUnmatched(logParts, SysLogDropNotMail)
 			continue
 		}
 		content := logParts["content"].(string)
@@ -173,15 +178,20 @@ func SysLogRunner(channel syslog.LogPartsChannel) {
 		if len(matches) == 3 {
 			// If we received a message id association with the queue id,
 			//  add it to the database for syslog id information.
+			// The entry may already exist if a previous hop handed the message off to this queue.
 			match := SysLogIDInfo{}
+			app.db.Where("s_id = ? AND hostname = ?", matches[1], logParts["hostname"].(string)).First(&match)
 			match.Hostname = logParts["hostname"].(string)
 			match.SID = matches[1]
 			match.MessageID = matches[2]
-			match.Status = "queued"
-			app.db.Create(&match)
-			log.Println("Syslog:", match.SID, match.Status)
+			if match.Status == "" {
+				match.Status = "queued"
+			}
+			app.db.Save(&match)
+			logSysLog.Info("Status updated", "queue_id", match.SID, "hostname", match.Hostname, "status", match.Status)
 			// The status was updated, so we can save to the queue for procoessing.
-			app.sysLogMailUpdateQueue[match.SID+":"+match.Hostname] = true
+			SysLogQueueMailUpdate(match.SID+":"+match.Hostname)
+			metricSysLogMatched.Inc("message_id")
 
 			// Check if this is the first message queue id received for the connection.
 			SysLogCheckIfNewConnection(matches[1])
@@ -193,6 +203,7 @@ func SysLogRunner(channel syslog.LogPartsChannel) {
 		// If message contains a queue id, we can just store it. Ignore NOQUEUE messages.
 		matches = rxMailID.FindStringSubmatch(content)
 		if len(matches) == 2 && matches[1] != "NOQUEUE" {
+			metricSysLogMatched.Inc("queue_id")
 			// Check if this is the first message queue id received for the connection.
 			SysLogCheckIfNewConnection(matches[1])
 			// Save this message to the syslog database.
@@ -203,6 +214,7 @@ func SysLogRunner(channel syslog.LogPartsChannel) {
 		// If this is a end of message ok message, we can store it.
 		matches = rxMailIDOk.FindStringSubmatch(content)
 		if len(matches) == 2 {
+			metricSysLogMatched.Inc("queue_ok")
 			// Check if this is the first message queue id received for the connection.
 			SysLogCheckIfNewConnection(matches[1])
 			// Save this message to the syslog database.
@@ -213,6 +225,12 @@ func SysLogRunner(channel syslog.LogPartsChannel) {
 		// If this is a new connection message, update the buffer.
 		matches = rxConnection.FindStringSubmatch(content)
 		if len(matches) == 2 {
+			// Any messages buffered for the previous connection never received a queue id.
+			if sysLogBuffer.sourceAddr != "" {
+				for _, logMessage := range sysLogBuffer.logMessages {
+					SysLogRecordUnmatched(logMessage, SysLogDropBufferDiscarded)
+				}
+			}
 			// Save source address.
 			sysLogBuffer.sourceAddr = matches[1]
 			// Reset and store current message in message buffer.
@@ -225,6 +243,7 @@ func SysLogRunner(channel syslog.LogPartsChannel) {
 		matches = rxDisconnect.FindStringSubmatch(content)
 		if len(matches) == 2 {
 			// Go through the active connections.
+			matched := false
 			for i := 0; i < len(sysLogBuffer.activeConnections); i++ {
 				connection := sysLogBuffer.activeConnections[i]
 				// If this connection is older than 1 minute... We can discard it.
@@ -235,44 +254,69 @@ func SysLogRunner(channel syslog.LogPartsChannel) {
 				} else if matches[1] == connection.sourceAddr {
 					// If this connection matches our disconnection, we can log the message.
 					SysLogStoreMessage(logParts, connection.sid)
+					matched = true
+					metricSysLogMatched.Inc("disconnect")
 
 					// We can now discard this message.
 					sysLogBuffer.activeConnections = append(sysLogBuffer.activeConnections[:i], sysLogBuffer.activeConnections[i+1:]...)
 					i--
 				}
 			}
+			// If no connection matched, we have nothing to associate the message with.
+			if !matched {
+				SysLogRecordUnmatched(logParts, SysLogDropDisconnectUnmatched)
+			}
 			continue
 		}
 		// If there is a new connection, and this log message was not matched above.
 		// We then store this message in the buffer for associating with a message queue id above.
 		if sysLogBuffer.sourceAddr != "" {
 			sysLogBuffer.logMessages = append(sysLogBuffer.logMessages, logParts)
+		} else if strings.HasPrefix(content, "NOQUEUE") {
+			// Messages such as rejects are never queued.
+			SysLogRecordUnmatched(logParts, SysLogDropNoQueue)
+		} else {
+			// Otherwise, we have nothing to associate the message with.
+			SysLogRecordUnmatched(logParts, SysLogDropUnmatched)
 		}
 	}
 }
 
+// Starts the syslog message runner which all log sources feed into.
+// The done channel receives once the message channel is closed and every message is processed.
+func SysLogStartRunner() (channel syslog.LogPartsChannel, done chan bool) {
+	// Create a new syslog buffer.
+	sysLogBuffer = new(SysLogBuffer)
+
+	// Create the message channel and start the reader.
+	channel = make(syslog.LogPartsChannel)
+	done = make(chan bool, 1)
+	go func() {
+		SysLogRunner(channel)
+		done <- true
+	}()
+	return
+}
+
 // This functions tarts the syslog server.
-func SysLogServe() {
+func SysLogServe(channel syslog.LogPartsChannel) {
 	// If syslog is not enabled, stop here.
-	if !app.config.SysLogUDP && !app.config.SysLogTCP {
+	if !app.Config().SysLogUDP && !app.Config().SysLogTCP {
+		HealthSetListener("syslog_listener", HealthListenerDisabled, nil)
 		return
 	}
 
-	// Create a new syslog buffer.
-	sysLogBuffer = new(SysLogBuffer)
-
 	// Get the configuration/
-	sysLogBindAddr := app.config.SysLogBindAddr
-	sysLogPort := app.config.SysLogPort
-	if app.context.String("syslog-bind") != "" {
-		sysLogBindAddr = app.context.String("syslog-bind")
+	sysLogBindAddr := app.Config().SysLogBindAddr
+	sysLogPort := app.Config().SysLogPort
+	if app.context.GlobalString("syslog-bind") != "" {
+		sysLogBindAddr = app.context.GlobalString("syslog-bind")
 	}
-	if app.context.Uint("syslog-port") != 0 {
-		sysLogPort = app.context.Uint("syslog-port")
+	if app.context.GlobalUint("syslog-port") != 0 {
+		sysLogPort = app.context.GlobalUint("syslog-port")
 	}
 
-	// Create the syslog server and message channel.
-	channel := make(syslog.LogPartsChannel)
+	// Create the syslog server feeding the message channel.
 	handler := syslog.NewChannelHandler(channel)
 	server := syslog.NewServer()
 	app.sysLogServer = server
@@ -280,20 +324,31 @@ func SysLogServe() {
 	// Configure the syslog server.
 	server.SetFormat(syslog.RFC3164)
 	server.SetHandler(handler)
-	if app.config.SysLogUDP {
-		server.ListenUDP(fmt.Sprintf("%s:%d", sysLogBindAddr, sysLogPort))
+	// Listeners which fail are reported by the health checks, while the others continue.
+	var listening []string
+	listen := func(name string, err error) {
+		if err != nil {
+			logSysLog.Error("Unable to start syslog listener", "listener", name, "error", err)
+			HealthSetListener(name, HealthListenerFailed, err)
+			return
+		}
+		HealthSetListener(name, HealthListenerListening, nil)
+		listening = append(listening, name)
+	}
+	if app.Config().SysLogUDP {
+		listen("syslog_udp_listener", server.ListenUDP(fmt.Sprintf("%s:%d", sysLogBindAddr, sysLogPort)))
 	}
-	if app.config.SysLogTCP {
-		server.ListenTCP(fmt.Sprintf("%s:%d", sysLogBindAddr, sysLogPort))
+	if app.Config().SysLogTCP {
+		listen("syslog_tcp_listener", server.ListenTCP(fmt.Sprintf("%s:%d", sysLogBindAddr, sysLogPort)))
 	}
 
 	// Start the syslog server.
-	log.Println("Starting system log server on port", sysLogPort)
+	logSysLog.Info("Starting system log server", "port", sysLogPort)
 	server.Boot()
 
-	// Start the message queue channel reader.
-	go SysLogRunner(channel)
-
 	// Wait until the syslog server stops.
 	server.Wait()
+	for _, name := range listening {
+		HealthSetListener(name, HealthListenerStopped, nil)
+	}
 }
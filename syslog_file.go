@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+	"gopkg.in/mcuadros/go-syslog.v2"
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+)
+
+// Supported log file formats.
+const (
+	LogFileFormatSysLog   = "syslog"
+	LogFileFormatJournald = "journald"
+)
+
+// How much of the start of a file is used to detect if it was replaced.
+const logFileFingerprintSize = 256
+
+// A standard syslog line as written by syslog daemons to files.
+// Example: Oct 18 12:00:00 mx1 postfix/smtp[1234]: 4F3A21: to=<user@example.com>, status=sent
+// High precision timestamps as written by rsyslog are also supported.
+var rxLogFileLine = regexp.MustCompile("^([A-Z][a-z]{2} [ 0-9][0-9] [0-9]{2}:[0-9]{2}:[0-9]{2}|[0-9]{4}-[0-9]{2}-[0-9]{2}T\\S+) (\\S+) ([^\\s\\[:]+)(?:\\[[0-9]+\\])?: ?(.*)$")
+
+// Parse a standard syslog line to log parts matching what the syslog server provides.
+// As traditional syslog timestamps do not include the year, the year is taken from the reference time.
+func LogFileParseSysLogLine(line string, reference time.Time) (format.LogParts, bool) {
+	matches := rxLogFileLine.FindStringSubmatch(line)
+	if len(matches) != 5 {
+		return nil, false
+	}
+
+	// Parse the timestamp.
+	timestamp, err := time.Parse(time.RFC3339Nano, matches[1])
+	if err != nil {
+		timestamp, err = time.ParseInLocation(time.Stamp, matches[1], time.Local)
+		if err != nil {
+			return nil, false
+		}
+		// Use the year of the reference time, unless that would put the message in the future.
+		timestamp = timestamp.AddDate(reference.Year(), 0, 0)
+		if timestamp.After(reference.Add(24 * time.Hour)) {
+			timestamp = timestamp.AddDate(-1, 0, 0)
+		}
+	}
+
+	logParts := format.LogParts{
+		"timestamp": timestamp,
+		"hostname":  matches[2],
+		"tag":       matches[3],
+		"content":   matches[4],
+	}
+	return logParts, true
+}
+
+// Parse a journald entry exported with `journalctl -o json` to log parts matching what the syslog server provides.
+func LogFileParseJournalLine(line []byte) (format.LogParts, bool) {
+	var entry map[string]interface{}
+	if err := json.Unmarshal(line, &entry); err != nil {
+		return nil, false
+	}
+
+	// Only text fields are useful, binary fields are exported as arrays.
+	field := func(name string) string {
+		value, _ := entry[name].(string)
+		return value
+	}
+
+	// The realtime timestamp is in microseconds.
+	usec, err := strconv.ParseInt(field("__REALTIME_TIMESTAMP"), 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	tag := field("SYSLOG_IDENTIFIER")
+	if tag == "" {
+		tag = field("_COMM")
+	}
+
+	logParts := format.LogParts{
+		"timestamp": time.Unix(0, usec*int64(time.Microsecond)),
+		"hostname":  field("_HOSTNAME"),
+		"tag":       tag,
+		"content":   field("MESSAGE"),
+	}
+	return logParts, true
+}
+
+// Parse a line in the log file format provided.
+func LogFileParseLine(logFormat string, line []byte, reference time.Time) (format.LogParts, bool) {
+	line = bytes.TrimRight(line, "\r\n")
+	if len(line) == 0 {
+		return nil, false
+	}
+	if logFormat == LogFileFormatJournald {
+		return LogFileParseJournalLine(line)
+	}
+	return LogFileParseSysLogLine(string(line), reference)
+}
+
+// Hash the start of a file so that we can tell if the file was replaced.
+func LogFileFingerprint(file *os.File, size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := file.ReadAt(b, 0); err != nil {
+		return "", err
+	}
+	sum := sha1.Sum(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Tails a local log file and feeds each line to the syslog runner.
+type LogFileTailer struct {
+	config  LogFileConfig
+	channel syslog.LogPartsChannel
+	file    *os.File
+	reader  *bufio.Reader
+	offset  int64  // Offset after the last complete line read.
+	partial []byte // Data read after the last complete line.
+	lastErr string
+}
+
+// Start reading all configured local log files.
+func LogFileServe(channel syslog.LogPartsChannel) {
+	for _, config := range app.Config().LogFiles {
+		tailer := &LogFileTailer{
+			config:  config,
+			channel: channel,
+		}
+		logSysLog.Info("Reading mail logs", "path", config.Path, "format", config.Format)
+		go tailer.Run()
+	}
+}
+
+// Read the log file every second, following rotations.
+func (t *LogFileTailer) Run() {
+	ticker := time.NewTicker(time.Second)
+	for _ = range ticker.C {
+		// Stop reading on shutdown, the offset of lines read is already stored.
+		if !app.work.Begin() {
+			ticker.Stop()
+			return
+		}
+		// If the file is not open, try to open it. It may not exist yet after a rotation.
+		if t.file == nil {
+			if err := t.open(); err != nil {
+				t.logError(err)
+				app.work.End()
+				continue
+			}
+		}
+		t.readLines()
+		t.checkRotation()
+		app.work.End()
+	}
+}
+
+// Log an error, but only once until a different error happens.
+func (t *LogFileTailer) logError(err error) {
+	if err.Error() != t.lastErr {
+		logSysLog.Warn("Unable to read log file", "path", t.config.Path, "error", err)
+		t.lastErr = err.Error()
+	}
+}
+
+// Open the log file and resume from the stored offset if it is the same file.
+func (t *LogFileTailer) open() error {
+	file, err := os.Open(t.config.Path)
+	if err != nil {
+		return err
+	}
+	t.file = file
+	t.offset = 0
+	t.partial = nil
+	t.lastErr = ""
+
+	// Check the stored offset is for this file, the file could have been rotated while we were not running.
+	var stored LogFileOffset
+	app.db.Where("path = ?", t.config.Path).First(&stored)
+	if stored.Path != "" && stored.Offset > 0 {
+		info, err := file.Stat()
+		if err == nil && stored.Offset <= info.Size() {
+			fingerprint, err := LogFileFingerprint(file, stored.FingerprintSize)
+			if err == nil && fingerprint == stored.Fingerprint {
+				t.offset = stored.Offset
+			}
+		}
+	}
+
+	// Start reading at the offset.
+	if _, err := file.Seek(t.offset, io.SeekStart); err != nil {
+		file.Close()
+		t.file = nil
+		return err
+	}
+	t.reader = bufio.NewReader(file)
+	return nil
+}
+
+// Read all complete lines available, and feed them to the syslog runner.
+func (t *LogFileTailer) readLines() {
+	startOffset := t.offset
+	for {
+		b, err := t.reader.ReadBytes('\n')
+		// A line without a new line is not yet complete, keep it for the next read.
+		if err != nil {
+			t.partial = append(t.partial, b...)
+			if err != io.EOF {
+				t.logError(err)
+			}
+			break
+		}
+		line := append(t.partial, b...)
+		t.partial = nil
+		t.offset += int64(len(line))
+		t.feed(line)
+	}
+
+	// Store the offset if we read anything.
+	if t.offset != startOffset {
+		t.saveOffset()
+	}
+}
+
+// Feed a line to the syslog runner.
+func (t *LogFileTailer) feed(line []byte) {
+	logParts, ok := LogFileParseLine(t.config.Format, line, time.Now())
+	if ok {
+		t.channel <- logParts
+	}
+}
+
+// Save the current offset with a fingerprint of the file.
+func (t *LogFileTailer) saveOffset() {
+	stored := LogFileOffset{}
+	stored.Path = t.config.Path
+	stored.Offset = t.offset
+	stored.FingerprintSize = logFileFingerprintSize
+	if t.offset < logFileFingerprintSize {
+		stored.FingerprintSize = int(t.offset)
+	}
+	fingerprint, err := LogFileFingerprint(t.file, stored.FingerprintSize)
+	if err != nil {
+		t.logError(err)
+		return
+	}
+	stored.Fingerprint = fingerprint
+	app.db.Save(&stored)
+}
+
+// Check if the log file was rotated or truncated.
+func (t *LogFileTailer) checkRotation() {
+	pathInfo, err := os.Stat(t.config.Path)
+	// If the file was moved and not yet replaced, we keep reading the old file.
+	if err != nil {
+		return
+	}
+	fileInfo, err := t.file.Stat()
+	if err != nil {
+		t.logError(err)
+		return
+	}
+
+	// If the path is a new file, the old file was rotated.
+	// The logger may have written to the old file until it reopened its log, so the old file is read to the end
+	//  before we close it and open the new file on the next read.
+	if !os.SameFile(pathInfo, fileInfo) {
+		t.readLines()
+		// A last line without a new line is still a line.
+		if len(t.partial) != 0 {
+			t.feed(t.partial)
+		}
+		t.file.Close()
+		t.file = nil
+		// The stored offset is for the old file, reset it so the new file is read from the start.
+		app.db.Where("path = ?", t.config.Path).Delete(LogFileOffset{})
+		return
+	}
+
+	// If the file is smaller than what we read, it was truncated and we need to start over.
+	if fileInfo.Size() < t.offset+int64(len(t.partial)) {
+		logSysLog.Info("Log file was truncated", "path", t.config.Path)
+		t.offset = 0
+		t.partial = nil
+		t.file.Seek(0, io.SeekStart)
+		t.reader.Reset(t.file)
+		t.saveOffset()
+	}
+}
+
+// Import a log file from start to finish, feeding each line to the syslog runner.
+// Files ending in .gz are decompressed.
+func LogFileImport(path string, logFormat string, channel syslog.LogPartsChannel) (lines int, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	// Traditional syslog timestamps do not include a year, the modification time of
+	//  the file is the best reference we have for historic logs.
+	reference := time.Now()
+	if info, err := file.Stat(); err == nil {
+		reference = info.ModTime()
+	}
+
+	var r io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return 0, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	// Read every line.
+	reader := bufio.NewReader(r)
+	for {
+		b, readErr := reader.ReadBytes('\n')
+		if logParts, ok := LogFileParseLine(logFormat, b, reference); ok {
+			channel <- logParts
+			lines++
+		}
+		if readErr == io.EOF {
+			break
+		} else if readErr != nil {
+			return lines, readErr
+		}
+	}
+	return
+}
+
+// Flags for the import logs command.
+func logFileImportFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "format, f",
+			Value: LogFileFormatSysLog,
+			Usage: "Log file `FORMAT`, either syslog or journald",
+		},
+	}
+}
+
+// Import historic mail log files to backfill message statuses.
+// Files should be provided oldest first, so that connections are associated correctly.
+func LogFileImportCommand(c *cli.Context) error {
+	logFormat := c.String("format")
+	if logFormat != LogFileFormatSysLog && logFormat != LogFileFormatJournald {
+		return fmt.Errorf("Unknown log format: %s", logFormat)
+	}
+	if c.NArg() == 0 {
+		return fmt.Errorf("No log files provided.")
+	}
+	appSetup(c)
+
+	// Start the syslog runner and keep track of when it finishes.
+	channel, done := SysLogStartRunner()
+
+	// Feed every file to the runner.
+	for _, path := range c.Args() {
+		lines, err := LogFileImport(path, logFormat, channel)
+		if err != nil {
+			logImport.Error("Unable to import", "path", path, "error", err)
+		}
+		logImport.Info("Imported lines", "path", path, "lines", lines)
+	}
+	close(channel)
+	<-done
+
+	// Update the status of messages with the imported logs.
+	SysLogProcessMailUpdateQueue()
+	SysLogReconcileUnknownMessages()
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/mcuadros/go-syslog.v2"
+)
+
+// A syslog line as a mail server would write it, with the content provided.
+func testLogLine(content string) string {
+	return fmt.Sprintf("Oct 18 12:00:00 mx1 postfix/smtp[1234]: %s\n", content)
+}
+
+// Append to a file, creating it if needed.
+func testAppendFile(t *testing.T, path, data string) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Create a tailer for a log file, with a channel large enough that reads do not block.
+func testTailer(path string) *LogFileTailer {
+	return &LogFileTailer{
+		config:  LogFileConfig{Path: path, Format: LogFileFormatSysLog},
+		channel: make(syslog.LogPartsChannel, 100),
+	}
+}
+
+// Take the content of each line fed to the runner.
+func (tailer *LogFileTailer) testFed() []string {
+	var contents []string
+	for len(tailer.channel) != 0 {
+		logParts := <-tailer.channel
+		contents = append(contents, logParts["content"].(string))
+	}
+	return contents
+}
+
+// Read what the tailer would read on its next tick, returning the content of each line fed to the runner.
+func (tailer *LogFileTailer) testTick(t *testing.T) []string {
+	if tailer.file == nil {
+		if err := tailer.open(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tailer.readLines()
+	tailer.checkRotation()
+	return tailer.testFed()
+}
+
+func TestLogFileTailer(t *testing.T) {
+	testApp(t)
+	path := filepath.Join(t.TempDir(), "mail.log")
+	testAppendFile(t, path, testLogLine("one")+testLogLine("two")+strings.TrimSuffix(testLogLine("three"), "\n"))
+
+	tests := []struct {
+		name     string
+		change   func()
+		restart  bool // Start a new tailer, as after a restart.
+		expected []string
+	}{
+		{"complete lines are read", func() {}, false, []string{"one", "two"}},
+		{"a partial last line is completed", func() { testAppendFile(t, path, "\n") }, false, []string{"three"}},
+		{"nothing new", func() {}, false, nil},
+		{"resume from the stored offset", func() { testAppendFile(t, path, testLogLine("four")) }, true, []string{"four"}},
+		{"truncated", func() {
+			if err := os.Truncate(path, 0); err != nil {
+				t.Fatal(err)
+			}
+			testAppendFile(t, path, testLogLine("five"))
+		}, false, nil},
+		{"read from the start after truncation", func() {}, false, []string{"five"}},
+		{"replaced while not running", func() {
+			os.Remove(path)
+			testAppendFile(t, path, testLogLine("six")+testLogLine("seven")+testLogLine("eight"))
+		}, true, []string{"six", "seven", "eight"}},
+	}
+	tailer := testTailer(path)
+	for _, test := range tests {
+		test.change()
+		if test.restart {
+			tailer.file.Close()
+			tailer = testTailer(path)
+		}
+		if contents := tailer.testTick(t); strings.Join(contents, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("%s: read %q, expected %q", test.name, contents, test.expected)
+		}
+	}
+
+	// Lines written to the old file after it was read to the end and rotated, until the logger reopens its file,
+	// are read before the new file.
+	tailer.readLines()
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	testAppendFile(t, path+".1", testLogLine("nine")+strings.TrimSuffix(testLogLine("ten"), "\n"))
+	testAppendFile(t, path, testLogLine("eleven"))
+	tailer.checkRotation()
+	if contents := tailer.testFed(); strings.Join(contents, ",") != "nine,ten" {
+		t.Errorf("rotated: read %q from the old file, expected nine and ten", contents)
+	}
+	if tailer.file != nil {
+		t.Fatal("the old file is still open after it was rotated")
+	}
+	if contents := tailer.testTick(t); strings.Join(contents, ",") != "eleven" {
+		t.Errorf("rotated: read %q from the new file, expected eleven", contents)
+	}
+	tailer.file.Close()
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"net"
+	"regexp"
+	"strings"
+)
+
+// Regular expressions used to follow a message as it is handed off between queues.
+var (
+	// The relay a message was delivered to, with an optional address. Example: relay=filter1.example.com[192.0.2.10]:25
+	rxSysLogRelay = regexp.MustCompile("relay=([^\\[,\\s]+)(?:\\[([^\\]]*)\\])?")
+	// The queue id the relay responded with when accepting the message.
+	rxSysLogQueuedAs = regexp.MustCompile("queued as ([A-Za-z0-9]+)")
+)
+
+// Builds the key used to identify a syslog id on a specific host.
+func SysLogHopKey(hop SysLogIDInfo) string {
+	return hop.SID + ":" + hop.Hostname
+}
+
+// Resolve the syslog hostname of the relay a hop handed the message off to.
+// The second return value is true only when we are certain of the hostname,
+//  either because it is configured or because the relay is the host itself.
+func SysLogRelayHostname(hop SysLogIDInfo) (string, bool) {
+	if hop.Relay == "" {
+		return "", false
+	}
+
+	// Relay is stored as name[address], split it back up.
+	name := hop.Relay
+	addr := ""
+	if i := strings.Index(hop.Relay, "["); i != -1 {
+		name = hop.Relay[:i]
+		addr = strings.TrimSuffix(hop.Relay[i+1:], "]")
+	}
+
+	// Configured mappings always win.
+	if hostname, ok := app.Config().SysLogRelayHostnames[name]; ok {
+		return hostname, true
+	}
+	if hostname, ok := app.Config().SysLogRelayHostnames[addr]; ok {
+		return hostname, true
+	}
+
+	// Content filters re-inject on the loopback, so the next queue is on the same host.
+	ip := net.ParseIP(addr)
+	if name == "localhost" || (ip != nil && ip.IsLoopback()) {
+		return hop.Hostname, true
+	}
+
+	// Otherwise, our best guess is the name of the relay.
+	return name, false
+}
+
+// Parse a delivery log message for a hand-off to another queue and record it on the hop.
+// If we know which host the message was handed to, the next hop is created so that
+//  status updates on that host are tracked even if it never logs the message id.
+func SysLogRecordHandOff(hop *SysLogIDInfo, content string) {
+	matches := rxSysLogRelay.FindStringSubmatch(content)
+	if len(matches) != 3 {
+		return
+	}
+	hop.Relay = matches[1]
+	if matches[2] != "" {
+		hop.Relay += "[" + matches[2] + "]"
+	}
+
+	matches = rxSysLogQueuedAs.FindStringSubmatch(content)
+	if len(matches) != 2 {
+		return
+	}
+	hop.QueuedAs = matches[1]
+
+	// Only create the next hop if we are certain of the host.
+	hostname, known := SysLogRelayHostname(*hop)
+	if !known {
+		return
+	}
+	var next SysLogIDInfo
+	app.db.Where("s_id = ? AND hostname = ?", hop.QueuedAs, hostname).First(&next)
+	if next.SID != "" {
+		return
+	}
+	next.Hostname = hostname
+	next.SID = hop.QueuedAs
+	next.MessageID = hop.MessageID
+	next.Status = "queued"
+	app.db.Create(&next)
+	// The status was updated, so we can save to the queue for procoessing.
+	SysLogQueueMailUpdate(SysLogHopKey(next))
+}
+
+// Find the hop a syslog id handed the message off to, if any was logged.
+func SysLogNextHop(hop SysLogIDInfo) (next SysLogIDInfo) {
+	if hop.QueuedAs == "" {
+		return
+	}
+
+	// Find all syslog ids matching the queued as id, there may be more than one across hosts.
+	var candidates []SysLogIDInfo
+	app.db.Where("s_id = ?", hop.QueuedAs).Find(&candidates)
+	hostname, _ := SysLogRelayHostname(hop)
+
+	// Prefer the candidate on the relay host. Relay names are usually fully qualified,
+	//  while hostnames in syslog may be short.
+	var fallback []SysLogIDInfo
+	var sameMessage []SysLogIDInfo
+	for _, candidate := range candidates {
+		if candidate.ID == hop.ID {
+			continue
+		}
+		if candidate.Hostname == hostname || strings.HasPrefix(hostname, candidate.Hostname+".") {
+			return candidate
+		}
+		fallback = append(fallback, candidate)
+		if hop.MessageID != "" && candidate.MessageID == hop.MessageID {
+			sameMessage = append(sameMessage, candidate)
+		}
+	}
+
+	// If the relay host did not match, only accept an unambiguous candidate.
+	if len(sameMessage) == 1 {
+		return sameMessage[0]
+	}
+	if len(fallback) == 1 {
+		return fallback[0]
+	}
+	return
+}
+
+// Build the full path of syslog ids a message took through every host.
+func SysLogMessageHops(messageID string) []SysLogIDInfo {
+	var hops []SysLogIDInfo
+	if messageID == "" {
+		return hops
+	}
+	app.db.Where("message_id = ?", messageID).Find(&hops)
+
+	// Follow hand-offs to include hops which did not log the message id themselves.
+	seen := make(map[string]bool)
+	for _, hop := range hops {
+		seen[SysLogHopKey(hop)] = true
+	}
+	for i := 0; i < len(hops); i++ {
+		next := SysLogNextHop(hops[i])
+		if next.SID != "" && !seen[SysLogHopKey(next)] {
+			seen[SysLogHopKey(next)] = true
+			hops = append(hops, next)
+		}
+	}
+	return hops
+}
+
+// Determine the delivery status of a message from the final hops on its path.
+// A hop which successfully handed the message off to another logged queue is not final.
+// Returns an empty string if no status is known.
+func SysLogMessageStatus(messageID string) string {
+	hops := SysLogMessageHops(messageID)
+
+	// Find hops which handed the message off to another hop we know of.
+	handedOff := make(map[string]bool)
+	for _, hop := range hops {
+		if hop.Status == "sent" && SysLogNextHop(hop).SID != "" {
+			handedOff[SysLogHopKey(hop)] = true
+		}
+	}
+
+	// The most recently updated final hop is the status of the message.
+	var final *SysLogIDInfo
+	for i, hop := range hops {
+		// When a syslog id is ignored, it is likely due to it being either the main message received before sending out,
+		//  or it is the message forwarded to Mail Archive which is not the main mail delivery status.
+		if hop.Ignore || handedOff[SysLogHopKey(hop)] {
+			continue
+		}
+		if final == nil || hop.UpdatedAt.After(final.UpdatedAt) {
+			final = &hops[i]
+		}
+	}
+	if final == nil {
+		return ""
+	}
+	return final.Status
+}
+
+// Find all log messages for a message from every host it passed through, ordered by timestamp.
+func SysLogMessageLogs(messageID string) (messages []SysLogMessage) {
+	// Search for SysLog ID information on every host the message passed through.
+	hops := SysLogMessageHops(messageID)
+	// If no hops, no logs.
+	if len(hops) == 0 {
+		return
+	}
+
+	// Build a condition for each SID and hostname pair so that we can run a single query to get all log messages.
+	var conditions []string
+	var statements []interface{}
+	for _, hop := range hops {
+		conditions = append(conditions, "(s_id = ? AND hostname = ?)")
+		statements = append(statements, hop.SID, hop.Hostname)
+	}
+	app.db.Where(strings.Join(conditions, " OR "), statements...).Order("timestamp").Find(&messages)
+	return
+}
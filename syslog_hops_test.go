@@ -0,0 +1,132 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+)
+
+// A mail log line as received from a host.
+func testSysLogParts(hostname, tag, content string) format.LogParts {
+	return format.LogParts{
+		"timestamp": time.Now(),
+		"hostname":  hostname,
+		"tag":       tag,
+		"content":   content,
+	}
+}
+
+// Feed log lines to the syslog runner, returning once every line is processed.
+func testSysLogFeed(lines []format.LogParts) {
+	channel, done := SysLogStartRunner()
+	for _, logParts := range lines {
+		channel <- logParts
+	}
+	close(channel)
+	<-done
+}
+
+func TestSysLogHops(t *testing.T) {
+	const messageID = "abc@example.com"
+	received := testSysLogParts("mx1", "postfix/cleanup", "4F3A21: message-id=<"+messageID+">")
+	handOff := testSysLogParts("mx1", "postfix/smtp", "4F3A21: to=<user@example.org>, relay=filter1.example.com[192.0.2.10]:10025, delay=0.1, dsn=2.0.0, status=sent (250 2.0.0 Ok: queued as 7B2C11)")
+
+	tests := []struct {
+		name      string
+		relays    map[string]string // Configured hostnames of relays.
+		lines     []format.LogParts
+		hops      []string // Keys of the hops of the message, in any order.
+		next      string   // Key of the hop the first host handed the message off to.
+		status    string   // Final status of the message.
+		relayInfo string   // Relay recorded on the hop of the first host.
+	}{
+		{
+			"hand-off to a configured relay which does not log the message id",
+			map[string]string{"filter1.example.com": "filter1"},
+			[]format.LogParts{
+				received,
+				handOff,
+				testSysLogParts("filter1", "postfix/smtp", "7B2C11: to=<user@example.org>, relay=mx.example.org[198.51.100.1]:25, delay=30, dsn=4.4.1, status=deferred (connection timed out)"),
+			},
+			[]string{"4F3A21:mx1", "7B2C11:filter1"},
+			"7B2C11:filter1",
+			"deferred",
+			"filter1.example.com[192.0.2.10]",
+		},
+		{
+			"relay logs the message before the hand-off is logged",
+			nil,
+			[]format.LogParts{
+				testSysLogParts("filter1", "postfix/cleanup", "7B2C11: message-id=<"+messageID+">"),
+				testSysLogParts("filter1", "postfix/smtp", "7B2C11: to=<user@example.org>, relay=mx.example.org[198.51.100.1]:25, dsn=5.1.1, status=bounced (user unknown)"),
+				received,
+				handOff,
+			},
+			[]string{"4F3A21:mx1", "7B2C11:filter1"},
+			"7B2C11:filter1",
+			"bounced",
+			"filter1.example.com[192.0.2.10]",
+		},
+		{
+			"hand-off to an unknown relay which does not log the message id",
+			nil,
+			[]format.LogParts{
+				received,
+				handOff,
+				testSysLogParts("filter1", "postfix/smtp", "7B2C11: to=<user@example.org>, relay=mx.example.org[198.51.100.1]:25, status=deferred (connection timed out)"),
+			},
+			[]string{"4F3A21:mx1"},
+			"",
+			"sent",
+			"filter1.example.com[192.0.2.10]",
+		},
+		{
+			"content filter re-injecting on the loopback",
+			nil,
+			[]format.LogParts{
+				received,
+				testSysLogParts("mx1", "postfix/smtp", "4F3A21: to=<user@example.org>, relay=127.0.0.1[127.0.0.1]:10025, status=sent (250 2.0.0 Ok: queued as 8D4E55)"),
+				testSysLogParts("mx1", "postfix/smtp", "8D4E55: to=<user@example.org>, relay=mx.example.org[198.51.100.1]:25, status=sent (250 2.0.0 Ok: queued as 1A2B3C)"),
+			},
+			[]string{"4F3A21:mx1", "8D4E55:mx1"},
+			"8D4E55:mx1",
+			"sent",
+			"127.0.0.1[127.0.0.1]",
+		},
+	}
+	for _, test := range tests {
+		testApp(t)
+		config := *app.Config()
+		config.SysLogRelayHostnames = test.relays
+		app.SetConfig(config)
+		testSysLogFeed(test.lines)
+
+		var hops []string
+		for _, hop := range SysLogMessageHops(messageID) {
+			hops = append(hops, SysLogHopKey(hop))
+		}
+		sort.Strings(hops)
+		if strings.Join(hops, ",") != strings.Join(test.hops, ",") {
+			t.Errorf("%s: hops %q, expected %q", test.name, hops, test.hops)
+		}
+
+		var first SysLogIDInfo
+		app.db.Where("s_id = ? AND hostname = ?", "4F3A21", "mx1").First(&first)
+		if first.Relay != test.relayInfo {
+			t.Errorf("%s: relay %q, expected %q", test.name, first.Relay, test.relayInfo)
+		}
+		next := ""
+		if hop := SysLogNextHop(first); hop.SID != "" {
+			next = SysLogHopKey(hop)
+		}
+		if next != test.next {
+			t.Errorf("%s: next hop %q, expected %q", test.name, next, test.next)
+		}
+		if status := SysLogMessageStatus(messageID); status != test.status {
+			t.Errorf("%s: status %q, expected %q", test.name, status, test.status)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Events in the delivery of a message.
+const (
+	TimelineReceived    = "received"
+	TimelineQueued      = "queued"
+	TimelineFiltered    = "filtered"
+	TimelineQuarantined = "quarantined"
+	TimelineDelivered   = "delivered"
+	TimelineDeferred    = "deferred"
+	TimelineBounced     = "bounced"
+	TimelineRejected    = "rejected"
+	TimelineRemoved     = "removed"
+)
+
+// Regular expressions used to parse delivery details from log messages.
+var (
+	// The recipient of a delivery attempt.
+	rxTimelineRecipient = regexp.MustCompile("to=<([^>]*)>")
+	// The delivery status notification code.
+	rxTimelineDSN = regexp.MustCompile("dsn=([0-9.]+)")
+	// Daemon tags of content filters.
+	rxTimelineFilterTag = regexp.MustCompile("(?i)amavis|smtp-filter|spamd|rspamd|clamd|filter")
+)
+
+// A parsed event in the delivery of a message.
+type SysLogTimelineEvent struct {
+	Timestamp time.Time `json:"timestamp"`
+	Hostname  string    `json:"hostname"`
+	Tag       string    `json:"tag"`
+	SID       string    `json:"sid"`
+	Event     string    `json:"event"`
+	Recipient string    `json:"recipient,omitempty"`
+	Relay     string    `json:"relay,omitempty"`
+	DSN       string    `json:"dsn,omitempty"`
+	Delay     float64   `json:"delay"`   // Seconds since the previous event.
+	Elapsed   float64   `json:"elapsed"` // Seconds since the first event.
+	Content   string    `json:"content"`
+}
+
+// Determine which event a log message describes, if any.
+func SysLogTimelineEventType(message SysLogMessage) string {
+	content := message.Content
+	switch {
+	case strings.Contains(content, "quarantine"):
+		return TimelineQuarantined
+	case strings.Contains(content, "status=bounced"):
+		return TimelineBounced
+	case strings.Contains(content, "status=deferred"):
+		return TimelineDeferred
+	case strings.Contains(content, "status=sent"):
+		// A message sent to a content filter on the loopback is not yet delivered.
+		matches := rxSysLogRelay.FindStringSubmatch(content)
+		if len(matches) == 3 {
+			ip := net.ParseIP(matches[2])
+			if matches[1] == "localhost" || (ip != nil && ip.IsLoopback()) {
+				return TimelineFiltered
+			}
+		}
+		return TimelineDelivered
+	case strings.Contains(content, "250 2.5.0 OK"):
+		return TimelineDelivered
+	case strings.Contains(content, "reject:"):
+		return TimelineRejected
+	case strings.Contains(content, "client="), strings.HasPrefix(content, "connect from"):
+		return TimelineReceived
+	case strings.Contains(content, "message-id="), strings.Contains(content, "(queue active)"):
+		return TimelineQueued
+	case strings.HasSuffix(content, ": removed"):
+		return TimelineRemoved
+	case rxTimelineFilterTag.MatchString(message.Tag):
+		return TimelineFiltered
+	}
+	return ""
+}
+
+// Build a timeline of delivery events for a message from its log messages on every host.
+// Log messages which do not describe an event are left out.
+func SysLogMessageTimeline(messageID string) []SysLogTimelineEvent {
+	events := []SysLogTimelineEvent{}
+	for _, message := range SysLogMessageLogs(messageID) {
+		eventType := SysLogTimelineEventType(message)
+		if eventType == "" {
+			continue
+		}
+
+		event := SysLogTimelineEvent{}
+		event.Timestamp = message.Timestamp
+		event.Hostname = message.Hostname
+		event.Tag = message.Tag
+		event.SID = message.SID
+		event.Event = eventType
+		event.Content = message.Content
+
+		// Parse delivery details.
+		if matches := rxTimelineRecipient.FindStringSubmatch(message.Content); len(matches) == 2 {
+			event.Recipient = matches[1]
+		}
+		if matches := rxSysLogRelay.FindStringSubmatch(message.Content); len(matches) == 3 {
+			event.Relay = matches[1]
+		}
+		if matches := rxTimelineDSN.FindStringSubmatch(message.Content); len(matches) == 2 {
+			event.DSN = matches[1]
+		}
+
+		// Compute how long the message sat between steps.
+		if len(events) != 0 {
+			event.Delay = message.Timestamp.Sub(events[len(events)-1].Timestamp).Seconds()
+			event.Elapsed = message.Timestamp.Sub(events[0].Timestamp).Seconds()
+		}
+		events = append(events, event)
+	}
+	return events
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+)
+
+// Reasons a syslog message was not associated with a message.
+const (
+	SysLogDropNotMail             = "not_mail"             // The tag is not one of a mail daemon. These are counted, but not stored.
+	SysLogDropNoQueue             = "noqueue"              // A NOQUEUE message, such as a reject, outside of a connection.
+	SysLogDropUnmatched           = "unmatched"            // No queue id and outside of a connection.
+	SysLogDropBufferDiscarded     = "buffer_discarded"     // Buffered for a connection which never received a queue id.
+	SysLogDropDisconnectUnmatched = "disconnect_unmatched" // A disconnect without a matching connection.
+)
+
+// Stored unmatched messages are trimmed to the maximum after this many are stored, and on the periodic cleanup.
+const sysLogUnmatchedTrimInterval = 100
+
+// Unmatched messages stored since the store was last trimmed.
+var sysLogUnmatchedStored = struct {
+	sync.Mutex
+	count int
+}{}
+
+// Counters of syslog messages dropped per reason since start.
+var sysLogDrops = struct {
+	sync.Mutex
+	counts map[string]uint64
+}{counts: make(map[string]uint64)}
+
+// Get a copy of the drop counters.
+func SysLogDropCounts() map[string]uint64 {
+	sysLogDrops.Lock()
+	defer sysLogDrops.Unlock()
+	counts := make(map[string]uint64)
+	for reason, count := range sysLogDrops.counts {
+		counts[reason] = count
+	}
+	return counts
+}
+
+// Record a syslog message which was not associated with a message.
+// Mail messages are kept in a bounded store for diagnostics.
+func SysLogRecordUnmatched(logParts format.LogParts, reason string) {
+	sysLogDrops.Lock()
+	sysLogDrops.counts[reason]++
+	sysLogDrops.Unlock()
+	metricSysLogUnmatched.Inc(reason)
+
+	// Only mail messages are stored, and only if the store is enabled.
+	if reason == SysLogDropNotMail || app.Config().SysLogUnmatchedMax <= 0 {
+		return
+	}
+
+	entry := SysLogUnmatched{}
+	entry.Hostname, _ = logParts["hostname"].(string)
+	entry.Timestamp, _ = logParts["timestamp"].(time.Time)
+	entry.Tag, _ = logParts["tag"].(string)
+	entry.Content, _ = logParts["content"].(string)
+	entry.Reason = reason
+	if app.db.Create(&entry).Error != nil {
+		return
+	}
+
+	sysLogUnmatchedStored.Lock()
+	sysLogUnmatchedStored.count++
+	trim := sysLogUnmatchedStored.count >= sysLogUnmatchedTrimInterval
+	if trim {
+		sysLogUnmatchedStored.count = 0
+	}
+	sysLogUnmatchedStored.Unlock()
+	if trim {
+		SysLogTrimUnmatched()
+	}
+}
+
+// Remove the oldest unmatched messages stored to keep the store bounded.
+func SysLogTrimUnmatched() {
+	max := int64(app.Config().SysLogUnmatchedMax)
+	if max <= 0 {
+		return
+	}
+	var lastID sql.NullInt64
+	if err := app.db.Model(&SysLogUnmatched{}).Select("max(id)").Row().Scan(&lastID); err != nil {
+		logSysLog.Error("Unable to trim unmatched messages", "error", err)
+		return
+	}
+	if lastID.Int64 > max {
+		app.db.Where("id <= ?", lastID.Int64-max).Delete(SysLogUnmatched{})
+	}
+}
+
+// Filter unmatched syslog messages by a search query and reason.
+func SysLogUnmatchedQuery(query string, reason string) *gorm.DB {
+	db := app.db.Model(&SysLogUnmatched{})
+	if reason != "" {
+		db = db.Where("reason = ?", reason)
+	}
+	// Wildcards in the query match themselves, as in message searches.
+	for _, likeStatement := range APISearchTerms(query) {
+		db = db.Where("(hostname LIKE ? ESCAPE '!' OR tag LIKE ? ESCAPE '!' OR content LIKE ? ESCAPE '!')", likeStatement, likeStatement, likeStatement)
+	}
+	return db
+}
+
+// Find stored unmatched syslog messages, newest first.
+// The query is split by words, each word must match the hostname, tag or content.
+func SysLogFindUnmatched(query string, reason string, page int) (entries []SysLogUnmatched) {
+	db := SysLogUnmatchedQuery(query, reason)
+
+	// Offset based on page number and max messages per page set.
+	offset := app.Config().MessagesPerPage * (page - 1)
+	if offset <= 0 { // If lower than 1, we can just set to -1 to unset the offset field in queries.
+		offset = -1
+	}
+	db.Order("id desc").Offset(offset).Limit(app.Config().MessagesPerPage).Find(&entries)
+	return
+}
@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func TestSysLogUnmatchedQueryWildcards(t *testing.T) {
+	testApp(t)
+	app.db.Create(&SysLogUnmatched{Hostname: "mx1", Tag: "postfix/smtp", Content: "4F3A21: to=<a_b@example.com>, status=sent"})
+	app.db.Create(&SysLogUnmatched{Hostname: "mx2", Tag: "postfix/smtpd", Content: "NOQUEUE: reject: 100% full"})
+
+	for query, expected := range map[string]int{"": 2, "%": 2, "a_b": 1, "a%b": 0, "mx_": 0, "_": 2, "100%": 1, "0%": 1, "mx1 sent": 1} {
+		var count int
+		SysLogUnmatchedQuery(query, "").Count(&count)
+		if count != expected {
+			t.Errorf("query %q matched %d messages, expected %d", query, count, expected)
+		}
+	}
+}
+
+func TestSysLogRecordUnmatchedTrim(t *testing.T) {
+	testApp(t)
+	config := *app.Config()
+	config.SysLogUnmatchedMax = 10
+	app.SetConfig(config)
+	sysLogUnmatchedStored.count = 0
+
+	record := func(lines int) {
+		for i := 0; i < lines; i++ {
+			SysLogRecordUnmatched(testSysLogParts("mx1", "postfix/smtpd", "NOQUEUE: reject"), SysLogDropNoQueue)
+		}
+	}
+	tests := []struct {
+		name   string
+		record func()
+		stored int
+		lastID int64
+	}{
+		{"not trimmed before the interval", func() { record(sysLogUnmatchedTrimInterval - 1) }, sysLogUnmatchedTrimInterval - 1, sysLogUnmatchedTrimInterval - 1},
+		{"trimmed at the interval", func() { record(1) }, 10, sysLogUnmatchedTrimInterval},
+		{"stored past the maximum until the next interval", func() { record(5) }, 15, sysLogUnmatchedTrimInterval + 5},
+		{"trimmed on cleanup", SysLogTrimUnmatched, 10, sysLogUnmatchedTrimInterval + 5},
+	}
+	for _, test := range tests {
+		test.record()
+		var entries []SysLogUnmatched
+		app.db.Order("id").Find(&entries)
+		if len(entries) != test.stored || entries[len(entries)-1].ID != test.lastID {
+			t.Errorf("%s: %d stored, expected %d ending with %d", test.name, len(entries), test.stored, test.lastID)
+		}
+	}
+}
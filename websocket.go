@@ -1,7 +1,6 @@
 package main
 
 import (
-	"log"
 	"net/http"
 	"time"
 
@@ -32,10 +31,18 @@ type WSMessageInterface interface {
 	handleMessage(message []byte, c *WSClient)
 }
 
+// A message to send to clients, along with an optional filter of which clients may receive it.
+// When authentication is enabled, the credentials of connected clients are checked before the message is sent.
+type WSBroadcast struct {
+	message          []byte
+	allow            func(c *WSClient) bool
+	checkCredentials bool
+}
+
 // The websocket server structure.
 type WS struct {
 	clients          map[*WSClient]bool
-	message          chan []byte
+	message          chan WSBroadcast
 	register         chan *WSClient
 	unregister       chan *WSClient
 	messageInterface WSMessageInterface
@@ -44,7 +51,7 @@ type WS struct {
 // Setup the websocket
 func WSInit(messageInterface WSMessageInterface) *WS {
 	ws := &WS{
-		message:          make(chan []byte),
+		message:          make(chan WSBroadcast),
 		register:         make(chan *WSClient),
 		unregister:       make(chan *WSClient),
 		clients:          make(map[*WSClient]bool),
@@ -67,12 +74,32 @@ func (ws *WS) run() {
 				delete(ws.clients, client)
 				close(client.send)
 			}
-		case message := <-ws.message:
+		case broadcast := <-ws.message:
+			// The users of connected clients are found in one lookup, rather than a query for each client.
+			var users map[string]*User
+			if broadcast.checkCredentials && len(ws.clients) != 0 {
+				users = ws.credentialUsers()
+			}
 			// A message is being sent to all clients.
 			for client := range ws.clients {
+				// Clients whose session or API token is no longer valid are disconnected,
+				//  others get their user as it is now in case their role or scopes changed.
+				if users != nil {
+					user, ok := users[client.credential]
+					if !ok {
+						close(client.send)
+						delete(ws.clients, client)
+						continue
+					}
+					client.user = user
+				}
+				// Some messages may only be sent to some clients.
+				if broadcast.allow != nil && !broadcast.allow(client) {
+					continue
+				}
 				// Send message to client if possible.
 				select {
-				case client.send <- message:
+				case client.send <- broadcast.message:
 				default:
 					// If we were unable to send, the client is no longer connected.
 					close(client.send)
@@ -80,7 +107,23 @@ func (ws *WS) run() {
 				}
 			}
 		}
+		metricWSClients.Set(float64(len(ws.clients)))
+	}
+}
+
+// Find the users of the credentials of connected clients which are still valid.
+// Returns nil if they could not be checked, so that clients are not disconnected because of a database error.
+func (ws *WS) credentialUsers() map[string]*User {
+	var hashes []string
+	for client := range ws.clients {
+		hashes = append(hashes, client.credential)
+	}
+	users, err := AuthCredentialUsers(hashes)
+	if err != nil {
+		logWS.Error("Unable to check credentials of clients", "error", err)
+		return nil
 	}
+	return users
 }
 
 // Websocket client structure.
@@ -92,6 +135,12 @@ type WSClient struct {
 
 	// Buffered channel of outbound messages.
 	send chan []byte
+
+	// The authenticated user, nil if authentication is not enabled.
+	user *User
+
+	// Hash of the session or API token the client authenticated with.
+	credential string
 }
 
 // Read messages from the client.
@@ -114,7 +163,7 @@ func (c *WSClient) reader() {
 		// If we received an error, something is wrong and we need to close the connection.
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("error: %v", err)
+				logWS.Warn("Connection closed unexpectedly", "error", err)
 			}
 			break
 		}
@@ -169,16 +218,16 @@ func (c *WSClient) writer() {
 
 // New connection handler for websockets that creates a client and upgrades the connection.
 func (ws *WS) Handler(w http.ResponseWriter, r *http.Request) {
-	log.Println("New websocket connection from ", r.RemoteAddr)
+	LogRequest(logWS, r).Info("New connection", "remote_addr", r.RemoteAddr)
 	// Upgade the connection to a websocket connection.
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println(err)
+		LogRequest(logWS, r).Warn("Unable to upgrade connection", "error", err)
 		return
 	}
 
 	// Create a new client and register it.
-	client := &WSClient{ws: ws, conn: conn, send: make(chan []byte, 256)}
+	client := &WSClient{ws: ws, conn: conn, send: make(chan []byte, 256), user: AuthRequestUser(r), credential: AuthRequestCredential(r)}
 	ws.register <- client
 
 	// Start the reader and writer.
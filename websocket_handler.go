@@ -35,16 +35,31 @@ func (ws *WSInterface) buildMessageJson(msgType string, msg interface{}) (messag
 
 // Send a message to the subscribed clients.
 func (ws *WSInterface) sendMessage(msgType string, msg interface{}) error {
+	return ws.sendMessageFiltered(msgType, msg, nil)
+}
+
+// Send a message to the subscribed clients which the filter allows.
+func (ws *WSInterface) sendMessageFiltered(msgType string, msg interface{}, allow func(c *WSClient) bool) error {
 	// Build json.
 	message, err := ws.buildMessageJson(msgType, msg)
 	if err != nil {
 		return err
 	}
+	// Check who is still logged in when the message is sent.
+	broadcast := WSBroadcast{message: message, allow: allow, checkCredentials: app.Config().AuthEnabled}
 	// Send message to subscribed clients.
-	ws.ws.message <- message
+	ws.ws.message <- broadcast
 	return nil
 }
 
+// Send the message count to the subscribed clients. Users limited to scopes do not see the count of
+//  the whole archive, they get the count of messages within their scopes when they load the configuration.
+func (ws *WSInterface) sendMessageCount() error {
+	return ws.sendMessageFiltered("updateMessageCount", app.messageCount, func(c *WSClient) bool {
+		return AuthUnscoped(c.user)
+	})
+}
+
 // Send a message to a specific client.
 func (ws *WSInterface) sendMessageToClient(msgType string, msg interface{}, c *WSClient) error {
 	// Build json.
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Take the messages sent to a client, and whether it was disconnected.
+func (c *WSClient) testReceived() (messages int, open bool) {
+	for {
+		select {
+		case _, ok := <-c.send:
+			if !ok {
+				return messages, false
+			}
+			messages++
+		default:
+			return messages, true
+		}
+	}
+}
+
+func TestWSBroadcastUsers(t *testing.T) {
+	testApp(t)
+	config := *app.Config()
+	config.AuthEnabled = true
+	app.SetConfig(config)
+
+	scoped, err := AuthCreateUser("helpdesk", "password", RoleHelpdesk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	AuthSetScopes(&scoped, []string{"example.com"})
+	admin, err := AuthCreateUser("admin", "password", RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.db.Create(&Session{TokenHash: "scoped", UserID: scoped.ID, Expires: time.Now().Add(time.Hour)})
+	app.db.Create(&Session{TokenHash: "expired", UserID: admin.ID, Expires: time.Now().Add(-time.Hour)})
+	app.db.Create(&APIToken{TokenHash: "token", UserID: admin.ID})
+
+	ws := WSInit(nil)
+	wsInterface := &WSInterface{ws: ws}
+	clients := map[string]*WSClient{}
+	for _, credential := range []string{"scoped", "expired", "token"} {
+		clients[credential] = &WSClient{ws: ws, send: make(chan []byte, 10), credential: credential}
+		ws.register <- clients[credential]
+	}
+	// The hub handles one broadcast at a time, so once another is taken the previous was sent.
+	sync := func() { ws.message <- WSBroadcast{allow: func(c *WSClient) bool { return false }} }
+
+	newMessage := func(addresses ...string) {
+		wsInterface.sendMessageFiltered("receivedNewMessage", nil, func(c *WSClient) bool {
+			return AuthAddressesInScope(c.user, addresses)
+		})
+		sync()
+	}
+	tests := []struct {
+		name     string
+		send     func()
+		expected map[string]int // Messages received by each client still connected.
+	}{
+		{"message outside of scopes", func() { newMessage("user@example.org") }, map[string]int{"scoped": 0, "token": 1}},
+		{"message within scopes", func() { newMessage("user@example.com") }, map[string]int{"scoped": 1, "token": 1}},
+		{"message count", func() { wsInterface.sendMessageCount(); sync() }, map[string]int{"scoped": 0, "token": 1}},
+		{"scopes changed", func() {
+			AuthSetScopes(&scoped, []string{"example.org"})
+			newMessage("user@example.org")
+		}, map[string]int{"scoped": 1, "token": 1}},
+		{"logged out", func() {
+			app.db.Where("token_hash = ?", "scoped").Delete(Session{})
+			newMessage("user@example.org")
+		}, map[string]int{"token": 1}},
+	}
+	for _, test := range tests {
+		test.send()
+		for credential, client := range clients {
+			messages, open := client.testReceived()
+			expected, connected := test.expected[credential]
+			if open != connected || messages != expected {
+				t.Errorf("%s: %s received %d messages and connected is %v, expected %d and %v", test.name, credential, messages, open, expected, connected)
+			}
+		}
+		// A disconnected client has nothing more to receive.
+		for credential := range clients {
+			if _, connected := test.expected[credential]; !connected {
+				delete(clients, credential)
+			}
+		}
+	}
+}
+
+func TestAuthCredentialUsers(t *testing.T) {
+	testApp(t)
+	scoped, err := AuthCreateUser("helpdesk", "password", RoleHelpdesk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	AuthSetScopes(&scoped, []string{"example.org", "example.com"})
+	admin, err := AuthCreateUser("admin", "password", RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.db.Create(&Session{TokenHash: "scoped", UserID: scoped.ID, Expires: time.Now().Add(time.Hour)})
+	app.db.Create(&Session{TokenHash: "expired", UserID: admin.ID, Expires: time.Now().Add(-time.Hour)})
+	app.db.Create(&Session{TokenHash: "not connected", UserID: admin.ID, Expires: time.Now().Add(time.Hour)})
+	app.db.Create(&APIToken{TokenHash: "token", UserID: admin.ID})
+
+	// Only the credentials asked for are found, and only while they are valid.
+	users, err := AuthCredentialUsers([]string{"scoped", "expired", "token", "unknown"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users["scoped"] == nil || users["token"] == nil {
+		t.Fatalf("found users of %v, expected scoped and token", users)
+	}
+	if users["scoped"].Username != "helpdesk" || len(users["scoped"].Scopes) != 2 || users["scoped"].Scopes[0] != "example.com" {
+		t.Errorf("scoped credential has user %+v", users["scoped"])
+	}
+	if users["token"].Username != "admin" || len(users["token"].Scopes) != 0 {
+		t.Errorf("token credential has user %+v", users["token"])
+	}
+	if users, err := AuthCredentialUsers(nil); err != nil || len(users) != 0 {
+		t.Errorf("found users %v without credentials", users)
+	}
+}
@@ -63,13 +63,16 @@ function displayMessage(message, color, timeout) {
 var UIDisableSpamReporting = false;
 var UIDisableLogs = false;
 
+// Permissions of the logged in user, which limit what is shown.
+var UICanReportSpam = true;
+
 // The width calculated for the subject.
 var UISubjectWidth = 0;
 
 // Build custom CSS based on configuration.
 function rebuildCustomCSS() {
     var cssConfig = '<style type="text/css">';
-    if (UIDisableSpamReporting) {
+    if (UIDisableSpamReporting || !UICanReportSpam) {
         cssConfig += `
         #mailLearnHamButton {
             display: none;
@@ -85,7 +88,7 @@ function rebuildCustomCSS() {
     }
     if (UIDisableLogs) {
         cssConfig += `
-        .nav-link.log {
+        .nav-link.log, .nav-link.timeline {
             display: none;
         }
         #message_list th.status, #message_list td.status {
@@ -139,6 +142,48 @@ function loadConfig() {
     });
 }
 
+// Token which must be sent with requests that change state when logged in.
+var CSRFToken = "";
+
+// Load the logged in user from the API.
+function loadAuth() {
+    $.ajax({
+        dataType: "json",
+        type: "GET",
+        url: "/api/auth/me"
+    })
+    .done(function(data) {
+        // If an error ocurred. Display it.
+        if (data.status=="error") {
+            displayError("Unable to load login: "+data.error);
+            return;
+        }
+        // Save the CSRF token, and show the logout button if logged in.
+        CSRFToken = data.csrf_token;
+        if (data.auth_enabled) {
+            $("#logoutButton").show();
+        }
+
+        // Hide actions the user's role does not permit.
+        if (data.user!=null) {
+            UICanReportSpam = data.permissions.indexOf("report_spam")!=-1;
+            rebuildCustomCSS();
+        }
+    });
+}
+
+// End the session and return to the login page.
+function logout() {
+    $.ajax({
+        dataType: "json",
+        type: "POST",
+        url: "/api/auth/logout"
+    })
+    .always(function() {
+        window.location = "/login.html";
+    });
+}
+
 // Storage of the currently selected email message.
 var selectedMessage = null;
 
@@ -516,6 +561,12 @@ function handleSourceSelection() {
     $("#message_header .nav-tabs .active").removeClass("active");
     selection.addClass("active");
 
+    // The timeline is rendered as a table from JSON.
+    if (selection.hasClass("timeline")) {
+        loadTimeline();
+        return;
+    }
+
     // Determine the extension for selected soruce type.
     var extension = ".txt";
     if (selection.hasClass("html")) {
@@ -565,6 +616,46 @@ function handleSourceSelection() {
     }
 }
 
+// Load the delivery timeline of the selected message and render it.
+function loadTimeline() {
+    $.ajax({
+        dataType: "json",
+        type: "GET",
+        url: "/api/message/"+selectedMessage.uuid+"/timeline"
+    })
+    .done(function(data) {
+        // If an error was returned, we display it.
+        if (data.status=="error") {
+            displayError("Unable to pull timeline: "+data.error);
+            return;
+        }
+
+        // Build a table with the event template.
+        var template = $("#message_timeline_event_template").html();
+        var table = $("<table>").addClass("table table-sm");
+        table.append("<thead><tr><th>Time</th><th>Delay</th><th>Host</th><th>Event</th><th>Recipient</th><th>Relay</th><th>DSN</th></tr></thead>");
+        var body = $("<tbody>");
+        for (var i=0; i<data.events.length; i++) {
+            var event = data.events[i];
+            event.formatted_date = moment(event.timestamp).format('YYYY-MM-DD HH:mm:ss');
+            event.formatted_delay = moment.duration(event.delay, "seconds").humanize();
+            if (i==0) {
+                event.formatted_delay = "";
+            }
+            body.append(Mustache.render(template, event));
+        }
+        table.append(body);
+
+        // Replace the message contents with the timeline.
+        $("#message_contents").html("");
+        $("#message_contents").append(table);
+    })
+    .fail(function(jqXHR, textStatus) {
+        // On error, display a message.
+        displayError("Unable to pull timeline: "+textStatus);
+    });
+}
+
 // This function is used to update the currently selected message view.
 function updateSelectedMessage() {
     // Update the header information.
@@ -693,6 +784,22 @@ function learnSpam() {
 
 // When the document has fully loaded, we get everything started.
 $(document).ready(function() {
+    // Send the CSRF token with every request, and go to the login page if not logged in.
+    $.ajaxSetup({
+        beforeSend: function(xhr) {
+            if (CSRFToken!="") {
+                xhr.setRequestHeader("X-CSRF-Token", CSRFToken);
+            }
+        }
+    });
+    $(document).ajaxError(function(event, jqXHR) {
+        if (jqXHR.status==401) {
+            window.location = "/login.html";
+        }
+    });
+    // Load the logged in user.
+    loadAuth();
+
     // Connect to websockets if available.
     if (!window["WebSocket"]) {
         displayError("Your browser does not support websockets, auto refresh will only occur once every minute.");
@@ -754,6 +861,9 @@ $(document).ready(function() {
         document.body.removeChild(a);
     });
 
+    // Handle a click on the logout button.
+    $("#logoutButton").click(logout);
+
     // Setup handlers for spam reporting.
     $("#mailLearnHamButton").click(learnHam);
     $("#mailLearnSpamButton").click(learnSpam);
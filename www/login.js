@@ -0,0 +1,49 @@
+// Display an error message on screen.
+function displayError(message) {
+    // Log the message to the javascript console.
+    console.log(message);
+
+    // Get the message div.
+    var messageDiv = document.getElementById("message");
+    messageDiv.innerText = message;
+    messageDiv.style.backgroundColor = "red";
+    messageDiv.style.display = "block"; // Make message visable.
+}
+
+// Submit the login form to the API.
+function login(e) {
+    // Do not submit the form the traditional way.
+    e.preventDefault();
+
+    $.ajax({
+        dataType: "json",
+        type: "POST",
+        url: "/api/auth/login",
+        data: $("#login_form").serialize()
+    })
+    .done(function(data) {
+        // If an error ocurred. Display it.
+        if (data.status=="error") {
+            displayError("Unable to login: "+data.error);
+            return;
+        }
+        // We are logged in, go to the archive.
+        window.location = "/";
+    })
+    .fail(function(jqXHR, textStatus) {
+        // On error, display a message.
+        displayError("Unable to login: "+textStatus);
+    });
+}
+
+// When the document has fully loaded, we setup the login form.
+$(document).ready(function() {
+    $("#login_form").submit(login);
+
+    // Show the SSO login if it is available.
+    $.getJSON("/api/auth/me", function(data) {
+        if (data.oidc_enabled) {
+            $("#oidc_login").show();
+        }
+    });
+});